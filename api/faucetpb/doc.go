@@ -0,0 +1,4 @@
+// Package faucetpb holds the gRPC service of the faucet, generated from faucet.proto.
+package faucetpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative faucet.proto
@@ -0,0 +1,251 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: faucet.proto
+
+package faucetpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// FaucetClient is the client API for Faucet service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FaucetClient interface {
+	// Claim submits a claim, which is sent right away or queued.
+	Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (*Claim, error)
+	// GetClaim returns a claim by ID.
+	GetClaim(ctx context.Context, in *GetClaimRequest, opts ...grpc.CallOption) (*Claim, error)
+	// StreamClaimUpdates sends the claim, then every change of it until it is settled: mined or
+	// failed, or sent if the faucet does not watch receipts.
+	StreamClaimUpdates(ctx context.Context, in *GetClaimRequest, opts ...grpc.CallOption) (Faucet_StreamClaimUpdatesClient, error)
+	// GetInfo returns the assets and settings of the faucet.
+	GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*Info, error)
+}
+
+type faucetClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFaucetClient(cc grpc.ClientConnInterface) FaucetClient {
+	return &faucetClient{cc}
+}
+
+func (c *faucetClient) Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (*Claim, error) {
+	out := new(Claim)
+	err := c.cc.Invoke(ctx, "/faucet.v1.Faucet/Claim", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *faucetClient) GetClaim(ctx context.Context, in *GetClaimRequest, opts ...grpc.CallOption) (*Claim, error) {
+	out := new(Claim)
+	err := c.cc.Invoke(ctx, "/faucet.v1.Faucet/GetClaim", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *faucetClient) StreamClaimUpdates(ctx context.Context, in *GetClaimRequest, opts ...grpc.CallOption) (Faucet_StreamClaimUpdatesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Faucet_ServiceDesc.Streams[0], "/faucet.v1.Faucet/StreamClaimUpdates", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &faucetStreamClaimUpdatesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Faucet_StreamClaimUpdatesClient interface {
+	Recv() (*Claim, error)
+	grpc.ClientStream
+}
+
+type faucetStreamClaimUpdatesClient struct {
+	grpc.ClientStream
+}
+
+func (x *faucetStreamClaimUpdatesClient) Recv() (*Claim, error) {
+	m := new(Claim)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *faucetClient) GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*Info, error) {
+	out := new(Info)
+	err := c.cc.Invoke(ctx, "/faucet.v1.Faucet/GetInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FaucetServer is the server API for Faucet service.
+// All implementations must embed UnimplementedFaucetServer
+// for forward compatibility
+type FaucetServer interface {
+	// Claim submits a claim, which is sent right away or queued.
+	Claim(context.Context, *ClaimRequest) (*Claim, error)
+	// GetClaim returns a claim by ID.
+	GetClaim(context.Context, *GetClaimRequest) (*Claim, error)
+	// StreamClaimUpdates sends the claim, then every change of it until it is settled: mined or
+	// failed, or sent if the faucet does not watch receipts.
+	StreamClaimUpdates(*GetClaimRequest, Faucet_StreamClaimUpdatesServer) error
+	// GetInfo returns the assets and settings of the faucet.
+	GetInfo(context.Context, *GetInfoRequest) (*Info, error)
+	mustEmbedUnimplementedFaucetServer()
+}
+
+// UnimplementedFaucetServer must be embedded to have forward compatible implementations.
+type UnimplementedFaucetServer struct {
+}
+
+func (UnimplementedFaucetServer) Claim(context.Context, *ClaimRequest) (*Claim, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Claim not implemented")
+}
+func (UnimplementedFaucetServer) GetClaim(context.Context, *GetClaimRequest) (*Claim, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClaim not implemented")
+}
+func (UnimplementedFaucetServer) StreamClaimUpdates(*GetClaimRequest, Faucet_StreamClaimUpdatesServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamClaimUpdates not implemented")
+}
+func (UnimplementedFaucetServer) GetInfo(context.Context, *GetInfoRequest) (*Info, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInfo not implemented")
+}
+func (UnimplementedFaucetServer) mustEmbedUnimplementedFaucetServer() {}
+
+// UnsafeFaucetServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FaucetServer will
+// result in compilation errors.
+type UnsafeFaucetServer interface {
+	mustEmbedUnimplementedFaucetServer()
+}
+
+func RegisterFaucetServer(s grpc.ServiceRegistrar, srv FaucetServer) {
+	s.RegisterService(&Faucet_ServiceDesc, srv)
+}
+
+func _Faucet_Claim_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClaimRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FaucetServer).Claim(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/faucet.v1.Faucet/Claim",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FaucetServer).Claim(ctx, req.(*ClaimRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Faucet_GetClaim_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetClaimRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FaucetServer).GetClaim(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/faucet.v1.Faucet/GetClaim",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FaucetServer).GetClaim(ctx, req.(*GetClaimRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Faucet_StreamClaimUpdates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetClaimRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FaucetServer).StreamClaimUpdates(m, &faucetStreamClaimUpdatesServer{stream})
+}
+
+type Faucet_StreamClaimUpdatesServer interface {
+	Send(*Claim) error
+	grpc.ServerStream
+}
+
+type faucetStreamClaimUpdatesServer struct {
+	grpc.ServerStream
+}
+
+func (x *faucetStreamClaimUpdatesServer) Send(m *Claim) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Faucet_GetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FaucetServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/faucet.v1.Faucet/GetInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FaucetServer).GetInfo(ctx, req.(*GetInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Faucet_ServiceDesc is the grpc.ServiceDesc for Faucet service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Faucet_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "faucet.v1.Faucet",
+	HandlerType: (*FaucetServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Claim",
+			Handler:    _Faucet_Claim_Handler,
+		},
+		{
+			MethodName: "GetClaim",
+			Handler:    _Faucet_GetClaim_Handler,
+		},
+		{
+			MethodName: "GetInfo",
+			Handler:    _Faucet_GetInfo_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamClaimUpdates",
+			Handler:       _Faucet_StreamClaimUpdates_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "faucet.proto",
+}
@@ -0,0 +1,315 @@
+// Package client talks to the JSON API of an eth-faucet server. The API is described by the
+// OpenAPI document the server serves at /api/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes the faucet replies with.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeInvalidAddress       = "invalid_address"
+	CodeInvalidAmount        = "invalid_amount"
+	CodeUnknownAsset         = "unknown_asset"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeVerificationRequired = "verification_required"
+	CodeVerificationFailed   = "verification_failed"
+	CodeRateLimited          = "rate_limited"
+	CodeQueueFull            = "queue_full"
+	CodeInsufficientFunds    = "insufficient_faucet_funds"
+	CodeTransferFailed       = "transfer_failed"
+	CodeUnavailable          = "unavailable"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodePaused               = "paused"
+)
+
+// Statuses of a claim. A sent claim becomes mined if the faucet watches the receipts of its
+// transactions.
+const (
+	StatusQueued = "queued"
+	StatusSent   = "sent"
+	StatusMined  = "mined"
+	StatusFailed = "failed"
+)
+
+// ErrClaimFailed is returned by WaitForClaim when the faucet failed to pay out a claim.
+var ErrClaimFailed = errors.New("claim failed")
+
+// Error is a request the faucet rejected.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// RetryAfter is how long to wait before a rate limited claim can succeed.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("faucet: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// Claim is a claim and its progress.
+type Claim struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Address string `json:"address"`
+	Asset   string `json:"asset"`
+	Amount  string `json:"amount"`
+	TxHash  string `json:"txHash,omitempty"`
+	Block   uint64 `json:"block,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Position is the place of a queued claim in the queue, starting at 1 for the next one.
+	Position  int       `json:"position,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Done reports whether the claim has been sent or has failed.
+func (c *Claim) Done() bool {
+	return c.Status == StatusSent || c.Status == StatusMined || c.Status == StatusFailed
+}
+
+// ClaimRequest is a claim with an amount or the fields of the faucet's anti-bot checks.
+type ClaimRequest struct {
+	Address string
+	// Asset is the symbol or contract address of the asset, the native asset if empty.
+	Asset string
+	// Amount is the decimal amount to claim, the asset's payout if empty.
+	Amount string
+	// Fields holds extra fields such as "captcha", or "challenge" and "solution".
+	Fields map[string]string
+	// IdempotencyKey makes the claim safe to retry: a claim sent again with the same key
+	// returns the claim accepted the first time instead of claiming again.
+	IdempotencyKey string
+}
+
+// Asset is an asset the faucet pays out.
+type Asset struct {
+	Symbol      string `json:"symbol"`
+	Name        string `json:"name"`
+	Decimals    int    `json:"decimals"`
+	Address     string `json:"address,omitempty"`
+	LogoURI     string `json:"logoURI,omitempty"`
+	Payout      string `json:"payout"`
+	Cooldown    int64  `json:"cooldown"`
+	DailyCap    string `json:"dailyCap,omitempty"`
+	MinAmount   string `json:"minAmount"`
+	MaxAmount   string `json:"maxAmount"`
+	Quota       string `json:"quota"`
+	IPQuota     string `json:"ipQuota,omitempty"`
+	SubnetQuota string `json:"subnetQuota,omitempty"`
+	// Enabled tells whether the asset can be claimed.
+	Enabled bool `json:"enabled"`
+	// Paused tells whether an operator paused claims of the asset.
+	Paused bool `json:"paused,omitempty"`
+	// Balance is the faucet's balance of the asset, empty if the faucet can't read it.
+	Balance string `json:"balance,omitempty"`
+}
+
+// Info describes the faucet and the assets it pays out.
+type Info struct {
+	Account string  `json:"account"`
+	Network string  `json:"network"`
+	Payout  string  `json:"payout"`
+	Symbol  string  `json:"symbol"`
+	Name    string  `json:"name"`
+	Assets  []Asset `json:"assets"`
+	Queue   int     `json:"queue"`
+	// Paused tells whether an operator paused the faucet.
+	Paused bool `json:"paused,omitempty"`
+	// ExplorerURL is the block explorer URL of a transaction, with {tx} in place of its hash.
+	ExplorerURL string                     `json:"explorerURL,omitempty"`
+	AntiBot     map[string]json.RawMessage `json:"antiBot,omitempty"`
+}
+
+// Cooldown tells whether the payout of an asset can be claimed now.
+type Cooldown struct {
+	Symbol  string `json:"symbol"`
+	Allowed bool   `json:"allowed"`
+	// RetryAfter is the number of seconds until the payout can be claimed.
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+	// Message tells why the payout can't be claimed now.
+	Message string `json:"message,omitempty"`
+}
+
+// Client calls the API of one faucet.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+
+	// APIKey is sent with every request if set, which lets claims skip the anti-bot checks.
+	APIKey string
+	// PollInterval is how often WaitForClaim checks on a claim.
+	PollInterval time.Duration
+}
+
+// New creates a client of the faucet at the base URL, such as https://faucet.example.com. A
+// nil HTTP client uses http.DefaultClient.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		httpClient:   httpClient,
+		PollInterval: 2 * time.Second,
+	}
+}
+
+// Claim claims the asset's payout for the address.
+func (c *Client) Claim(ctx context.Context, address, asset string) (*Claim, error) {
+	return c.ClaimWith(ctx, ClaimRequest{Address: address, Asset: asset})
+}
+
+// ClaimWith submits the claim. The returned claim has been sent or is queued.
+func (c *Client) ClaimWith(ctx context.Context, req ClaimRequest) (*Claim, error) {
+	body := make(map[string]string, len(req.Fields)+3)
+	for name, value := range req.Fields {
+		body[name] = value
+	}
+	body["address"] = req.Address
+	if req.Asset != "" {
+		body["asset"] = req.Asset
+	}
+	if req.Amount != "" {
+		body["amount"] = req.Amount
+	}
+	var claim Claim
+	var header http.Header
+	if req.IdempotencyKey != "" {
+		header = http.Header{"Idempotency-Key": {req.IdempotencyKey}}
+	}
+	if err := c.do(ctx, "POST", "/api/v2/claim", header, body, &claim); err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// GetClaim returns the claim with the ID.
+func (c *Client) GetClaim(ctx context.Context, id string) (*Claim, error) {
+	var claim Claim
+	if err := c.do(ctx, "GET", "/api/v2/claims/"+url.PathEscape(id), nil, nil, &claim); err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// WaitForClaim polls the claim until it has been sent or has failed, or the context is done.
+// A failed claim is returned together with an error wrapping ErrClaimFailed.
+func (c *Client) WaitForClaim(ctx context.Context, id string) (*Claim, error) {
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+	for {
+		claim, err := c.GetClaim(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if claim.Status == StatusFailed {
+			return claim, fmt.Errorf("%w: %s", ErrClaimFailed, claim.Error)
+		}
+		if claim.Done() {
+			return claim, nil
+		}
+		select {
+		case <-ctx.Done():
+			return claim, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Info returns the faucet's assets and settings.
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	var info Info
+	if err := c.do(ctx, "GET", "/api/v2/info", nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Cooldowns looks up whether the payout of each asset can be claimed for the address now,
+// without claiming anything. The quotas of the caller's IP apply as well, and with an empty
+// address only those are checked.
+func (c *Client) Cooldowns(ctx context.Context, address string) ([]Cooldown, error) {
+	path := "/api/v2/cooldown"
+	if address != "" {
+		path += "?address=" + url.QueryEscape(address)
+	}
+	var body struct {
+		Assets []Cooldown `json:"assets"`
+	}
+	if err := c.do(ctx, "GET", path, nil, nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Assets, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func decodeError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	var body struct {
+		Error struct {
+			Code       string `json:"code"`
+			Message    string `json:"message"`
+			RetryAfter int64  `json:"retry_after"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Error.Code == "" {
+		// Errors outside the JSON API, such as a proxy in front of the faucet, are plain text.
+		retryAfter, _ := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data)), RetryAfter: time.Duration(retryAfter) * time.Second}
+	}
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Code:       body.Error.Code,
+		Message:    body.Error.Message,
+		RetryAfter: time.Duration(body.Error.RetryAfter) * time.Second,
+	}
+}
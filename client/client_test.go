@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/chainflag/eth-faucet/internal/server"
+)
+
+const (
+	alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+	bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+	carol = "0x6eBE9511781cE5a000D29C1963158838278e274E"
+)
+
+// fakeTxBuilder pays out instantly, except that a transfer to bob holds the faucet busy
+// until it is released.
+type fakeTxBuilder struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (f *fakeTxBuilder) Sender() common.Address { return common.HexToAddress("0x1") }
+func (f *fakeTxBuilder) ChainID() *big.Int      { return big.NewInt(1337) }
+func (f *fakeTxBuilder) Transfer(_ context.Context, to string, _ *big.Int) (common.Hash, error) {
+	if to == bob {
+		close(f.entered)
+		<-f.release
+	}
+	return common.BytesToHash(common.HexToAddress(to).Bytes()), nil
+}
+
+func newTestFaucet(t *testing.T) (*Client, *fakeTxBuilder) {
+	payout := big.NewInt(1000000000000000000)
+	native := &server.Asset{Symbol: "xt", Name: "XT", Decimals: 18, Payout: payout, Cooldown: time.Hour, MinAmount: payout, MaxAmount: payout, Quota: payout}
+	settings := &server.Settings{Registry: server.NewRegistry(native, nil)}
+	tx := &fakeTxBuilder{entered: make(chan struct{}), release: make(chan struct{})}
+	srv := server.NewServer(tx, settings, server.NewConfig("testnet", "", 0, 10, server.ClientIPConfig{}, nil, nil, nil, nil, server.BatchConfig{}, server.AdminConfig{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go srv.ProcessQueue(ctx, 10*time.Millisecond)
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(func() {
+		cancel()
+		ts.Close()
+	})
+
+	c := New(ts.URL, ts.Client())
+	c.PollInterval = 10 * time.Millisecond
+	return c, tx
+}
+
+func TestClient(t *testing.T) {
+	c, _ := newTestFaucet(t)
+	ctx := context.Background()
+
+	info, err := c.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Network != "testnet" || len(info.Assets) != 1 || info.Assets[0].Symbol != "xt" {
+		t.Errorf("Info() = %+v, want the xt asset on testnet", info)
+	}
+
+	claim, err := c.Claim(ctx, alice, "xt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.Status != StatusSent || claim.TxHash == "" || claim.Amount != "1" {
+		t.Errorf("Claim() = %+v, want a sent claim of 1 xt", claim)
+	}
+	if got, err := c.WaitForClaim(ctx, claim.ID); err != nil || got.TxHash != claim.TxHash {
+		t.Errorf("WaitForClaim() = %+v, %v, want %s", got, err, claim.TxHash)
+	}
+
+	retried, err := c.ClaimWith(ctx, ClaimRequest{Address: carol, IdempotencyKey: "ci-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.ClaimWith(ctx, ClaimRequest{Address: carol, IdempotencyKey: "ci-1"}); err != nil || again.ID != retried.ID {
+		t.Errorf("retried ClaimWith() = %+v, %v, want claim %s", again, err, retried.ID)
+	}
+
+	cooldowns, err := c.Cooldowns(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cooldowns) != 1 || cooldowns[0].Allowed || cooldowns[0].RetryAfter <= 0 {
+		t.Errorf("Cooldowns() = %+v, want xt on cooldown", cooldowns)
+	}
+
+	tests := []struct {
+		name      string
+		call      func() error
+		wantCode  string
+		wantRetry bool
+	}{
+		{name: "rate limited", call: func() error { _, err := c.Claim(ctx, alice, "xt"); return err }, wantCode: CodeRateLimited, wantRetry: true},
+		{name: "unknown asset", call: func() error { _, err := c.Claim(ctx, carol, "doge"); return err }, wantCode: CodeUnknownAsset},
+		{name: "invalid amount", call: func() error {
+			_, err := c.ClaimWith(ctx, ClaimRequest{Address: carol, Amount: "5"})
+			return err
+		}, wantCode: CodeInvalidAmount},
+		{name: "unknown claim", call: func() error { _, err := c.GetClaim(ctx, "bogus"); return err }, wantCode: CodeNotFound},
+	}
+	for _, tt := range tests {
+		var apiErr *Error
+		if err := tt.call(); !errors.As(err, &apiErr) || apiErr.Code != tt.wantCode || (apiErr.RetryAfter > 0) != tt.wantRetry {
+			t.Errorf("%s: error = %v, want code %s", tt.name, err, tt.wantCode)
+		}
+	}
+}
+
+func TestClientWaitForQueuedClaim(t *testing.T) {
+	c, tx := newTestFaucet(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	busy := make(chan error, 1)
+	go func() {
+		_, err := c.Claim(ctx, bob, "")
+		busy <- err
+	}()
+	<-tx.entered
+
+	claim, err := c.Claim(ctx, carol, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.Status != StatusQueued || claim.Position != 1 || claim.Done() {
+		t.Fatalf("Claim() while busy = %+v, want a claim queued first", claim)
+	}
+	close(tx.release)
+	if err := <-busy; err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := c.WaitForClaim(ctx, claim.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != StatusSent || done.TxHash != common.BytesToHash(common.HexToAddress(carol).Bytes()).Hex() {
+		t.Errorf("WaitForClaim() = %+v, want carol's claim sent", done)
+	}
+}
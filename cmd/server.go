@@ -1,21 +1,26 @@
 package cmd
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/chainflag/eth-faucet/internal/common"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"io"
 	"math/big"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/go-redis/redis/v8"
 
 	"github.com/chainflag/eth-faucet/internal/chain"
 	"github.com/chainflag/eth-faucet/internal/server"
@@ -26,14 +31,78 @@ var (
 	chainIDMap = map[string]int{"ropsten": 3, "rinkeby": 4, "goerli": 5, "kovan": 42, "xsc": 530}
 
 	httpPortFlag = flag.Int("httpport", 8080, "Listener port to serve HTTP connection")
-	proxyCntFlag = flag.Int("proxycount", 0, "Count of reverse proxies in front of the server")
+	grpcPortFlag = flag.Int("grpcport", 0, "Listener port to serve the gRPC service, disabled if 0")
+	proxyCntFlag = flag.Int("proxycount", 0, "Count of reverse proxies in front of the server, ignored if trustedproxies is set")
+	trustedFlag  = flag.String("trustedproxies", "", "Comma separated CIDRs of reverse proxies whose forwarding headers are trusted")
+	proxyHdrFlag = flag.String("proxyheader", "X-Forwarded-For", "Forwarding header the trusted proxies set: X-Forwarded-For, Forwarded or X-Real-Ip")
+	ipv6Flag     = flag.Int("ipv6prefix", 64, "Prefix length IPv6 clients are grouped by for rate limiting")
+	proxyProto   = flag.Bool("proxyprotocol", false, "Expect a PROXY protocol header on every connection")
 	queueCapFlag = flag.Int("queuecap", 100, "Maximum transactions waiting to be sent")
 	versionFlag  = flag.Bool("version", false, "Print version number")
+	redisFlag    = flag.String("redis.url", os.Getenv("REDIS_URL"), "Redis URL to share rate limits between replicas, kept in memory if empty")
+	redisPrefix  = flag.String("redis.prefix", "eth-faucet:", "Prefix of the rate limit keys in Redis")
+	adminFlag    = flag.String("admin.token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the admin API, disabled if empty")
 
-	payoutFlag   = flag.Int("faucet.amount", 1, "Number of Ethers to transfer per user request")
+	adminPortFlag     = flag.Int("admin.port", 0, "Listener port to serve the admin API on, served on httpport if 0")
+	adminCertFlag     = flag.String("admin.tlscert", "", "TLS certificate file of the admin listener")
+	adminKeyFlag      = flag.String("admin.tlskey", "", "TLS key file of the admin listener")
+	adminClientCAFlag = flag.String("admin.clientca", "", "CA file of the client certificates operators may authenticate with instead of the token")
+	adminAuditFlag    = flag.String("admin.auditlog", "", "File to append every admin action to as JSON lines")
+
+	allowFlag  = flag.String("access.allowlist", "", "File of addresses, IPs and CIDRs with elevated quotas, one per line")
+	denyFlag   = flag.String("access.denylist", "", "File of addresses, IPs and CIDRs that may not claim, one per line")
+	factorFlag = flag.Int("access.quotafactor", 10, "Multiplier of the per-client quotas of allowlisted clients, exempt if 0")
+
+	apiKeysFlag    = flag.String("apikeys.file", "", "JSON file of issued API keys, kept in memory if empty")
+	ledgerFlag     = flag.String("ledger.file", "", "File to append every claim and its outcome to as JSON lines")
+	ledgerSizeFlag = flag.Int("ledger.size", 10000, "Number of recent claims kept in memory for lookups")
+	batchMaxFlag   = flag.Int("batch.maxitems", 100, "Maximum claims in one batch request, batches disabled if 0")
+	multisendFlag  = flag.String("batch.multisend", "", "Address of a Disperse contract paying each asset of a batch in one transaction")
+
+	captchaProviderFlag = flag.String("captcha.provider", "", "CAPTCHA provider to verify claims with: hcaptcha, recaptcha, recaptchav3 or turnstile, disabled if empty")
+	captchaSiteKeyFlag  = flag.String("captcha.sitekey", "", "Public site key of the CAPTCHA widget")
+	captchaSecretFlag   = flag.String("captcha.secret", os.Getenv("CAPTCHA_SECRET"), "Secret key to verify CAPTCHA responses with")
+	captchaVerifyFlag   = flag.String("captcha.verifyurl", "", "Override of the provider's siteverify endpoint")
+	captchaScoreFlag    = flag.Float64("captcha.minscore", 0.5, "Lowest reCAPTCHA v3 score accepted")
+
+	powDifficultyFlag = flag.Int("pow.difficulty", 0, "Leading zero bits of a proof-of-work solution while the queue is empty, disabled if 0")
+	powMaxFlag        = flag.Int("pow.maxdifficulty", 24, "Highest proof-of-work difficulty however long the queue grows")
+	powStepFlag       = flag.Int("pow.queuestep", 10, "Number of queued claims that add one bit of proof-of-work difficulty")
+	powTTLFlag        = flag.Int("pow.ttl", 5, "Number of minutes a proof-of-work challenge stays valid")
+	powSecretFlag     = flag.String("pow.secret", os.Getenv("POW_SECRET"), "Secret to sign proof-of-work challenges with, random if empty")
+
+	signatureFormatFlag = flag.String("signature.format", "", "Require claims to be signed by the claim address, as a siwe or personal message, disabled if empty")
+	signatureTTLFlag    = flag.Int("signature.ttl", 10, "Number of minutes a message to sign stays valid")
+	signatureSecretFlag = flag.String("signature.secret", os.Getenv("SIGNATURE_SECRET"), "Secret to sign message nonces with, random if empty")
+
+	oauthProviderFlag = flag.String("oauth.provider", "", "Require claimants to log in with an oidc or github provider, disabled if empty")
+	oauthIssuerFlag   = flag.String("oauth.issuer", "", "Issuer URL of the OIDC provider, used to discover its endpoints")
+	oauthClientFlag   = flag.String("oauth.clientid", "", "OAuth client id of the faucet")
+	oauthSecretFlag   = flag.String("oauth.clientsecret", os.Getenv("OAUTH_CLIENT_SECRET"), "OAuth client secret of the faucet")
+	oauthRedirectFlag = flag.String("oauth.redirecturl", "", "Public URL of /api/login/callback registered with the provider")
+	oauthMinAgeFlag   = flag.Int("oauth.minage", 0, "Number of days an account must exist before it may claim, not checked if 0")
+	oauthCreatedFlag  = flag.String("oauth.createdclaim", "created_at", "User info field holding the account creation time")
+	oauthSessionFlag  = flag.String("oauth.sessionsecret", os.Getenv("OAUTH_SESSION_SECRET"), "Secret to sign login sessions with, random if empty")
+	oauthTTLFlag      = flag.Int("oauth.sessionhours", 24, "Number of hours a login session lasts")
+
+	payoutFlag   = flag.String("faucet.amount", "1", "Amount of each asset to transfer per user request, as a decimal string")
 	intervalFlag = flag.Int("faucet.minutes", 1440, "Number of minutes to wait between funding rounds")
+	dailyFlag    = flag.Int("faucet.dailyclaims", 0, "Maximum number of claims of all assets per 24 hours, unlimited if 0")
 	netnameFlag  = flag.String("faucet.name", "testnet", "Network name to display on the frontend")
-	tokensFlag   = flag.String("faucet.tokens", "tokens.json", "tokens config file")
+	explorerFlag = flag.String("faucet.explorer", "", "Block explorer URL of a transaction with {tx} in place of its hash, such as https://etherscan.io/tx/{tx}")
+	tokensFlag   = flag.String("faucet.tokens", "tokens.json", "Token config file or URL, either a list of tokens or a standard token list")
+	settingsFlag = flag.String("faucet.config", "", "Optional JSON file with payout and interval settings that are reloaded at runtime")
+
+	nativeSymbolFlag   = flag.String("native.symbol", "xt", "Symbol of the chain's native asset")
+	nativeNameFlag     = flag.String("native.name", "XT", "Display name of the chain's native asset")
+	nativeDecimalsFlag = flag.Int("native.decimals", 18, "Number of decimals of the chain's native asset")
+	nativePayoutFlag   = flag.String("native.amount", "", "Amount of the native asset to transfer per user request, defaults to faucet.amount")
+	nativeMinFlag      = flag.String("native.minamount", "", "Smallest amount of the native asset a user may ask for, defaults to native.amount")
+	nativeMaxFlag      = flag.String("native.maxamount", "", "Largest amount of the native asset a user may ask for, defaults to native.amount")
+	nativeQuotaFlag    = flag.String("native.quota", "", "Amount of the native asset an address may claim per cooldown window, defaults to native.maxamount")
+
+	nativeIPQuotaFlag     = flag.String("native.ipquota", "", "Amount of the native asset a client IP may claim per cooldown window, defaults to native.quota")
+	nativeSubnetQuotaFlag = flag.String("native.subnetquota", "", "Amount of the native asset a client subnet may claim per cooldown window, unlimited if empty")
 
 	keyJSONFlag  = flag.String("wallet.keyjson", os.Getenv("KEYSTORE"), "Keystore file to fund user requests with")
 	keyPassFlag  = flag.String("wallet.keypass", "password.txt", "Passphrase text file to decrypt keystore")
@@ -41,11 +110,6 @@ var (
 	providerFlag = flag.String("wallet.provider", os.Getenv("WEB3_PROVIDER"), "Endpoint for Ethereum JSON-RPC connection")
 )
 
-var (
-	tokenList     []server.Erc20Token
-	tokenBuilders = make(map[string]*chain.TxTokenBuild)
-)
-
 func init() {
 	flag.Parse()
 	if *versionFlag {
@@ -75,34 +139,310 @@ func Execute() {
 		panic(fmt.Errorf("cannot connect to web3 provider: %v", err))
 	}
 
-	jsonContent, err := ioutil.ReadFile(*tokensFlag)
+	dial := func(token server.Erc20Token) (chain.TokenTxBuilder, error) {
+		return chain.NewTxTokenBuilder(*providerFlag, token.ContractAddress, &privateKey, chainID)
+	}
+	access, err := server.NewAccessControl(*allowFlag, *denyFlag, *factorFlag)
 	if err != nil {
-		log.Warningf("load tokens file error: %s %v", *tokensFlag, err)
+		panic(fmt.Errorf("invalid access lists: %w", err))
+	}
+	keys, err := server.NewKeyStore(*apiKeysFlag)
+	if err != nil {
+		panic(fmt.Errorf("invalid api keys: %w", err))
+	}
+	// running is the registry of the accepted settings, which a reload falls back on for tokens
+	// whose chain can't be reached. Only the first load, without it, may go without a tokens
+	// file, so deleting the file while the faucet runs can't silently remove every token.
+	var running *server.Registry
+	load := func() (*server.Settings, func(), error) {
+		applyAccess, err := access.Prepare()
+		if err != nil {
+			return nil, nil, err
+		}
+		settings, err := loadSettings(txBuilder.ChainID(), dial, running)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The daily amounts of the keys are checked against the assets being loaded.
+		applyKeys, err := keys.Prepare(settings.Registry)
+		if err != nil {
+			return nil, nil, err
+		}
+		return settings, func() {
+			applyAccess()
+			applyKeys()
+			running = settings.Registry
+		}, nil
+	}
+	settings, _, err := load()
+	if err != nil {
+		panic(fmt.Errorf("invalid faucet config: %w", err))
+	}
+	running = settings.Registry
+
+	trustedProxies, err := server.ParseCIDRs(*trustedFlag)
+	if err != nil {
+		panic(fmt.Errorf("invalid trusted proxies: %w", err))
+	}
+	if *proxyProto && len(trustedProxies) == 0 {
+		panic(errors.New("proxyprotocol requires trustedproxies"))
+	}
+	forwardingHeader, err := server.ParseProxyHeader(*proxyHdrFlag)
+	if err != nil {
+		panic(err)
+	}
+	if *ipv6Flag < 0 || *ipv6Flag > 128 {
+		panic(fmt.Errorf("invalid IPv6 prefix length %d", *ipv6Flag))
+	}
+	clientIP := server.ClientIPConfig{
+		TrustedProxies: trustedProxies,
+		ProxyHeader:    forwardingHeader,
+		ProxyCount:     *proxyCntFlag,
+		IPv6Prefix:     *ipv6Flag,
+		ProxyProtocol:  *proxyProto,
+	}
+
+	var store server.LimiterStore
+	if *redisFlag != "" {
+		options, err := redis.ParseURL(*redisFlag)
+		if err != nil {
+			panic(fmt.Errorf("invalid redis url: %w", err))
+		}
+		client := redis.NewClient(options)
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			panic(fmt.Errorf("cannot connect to redis: %w", err))
+		}
+		store = server.NewRedisStore(client, *redisPrefix)
+	}
+
+	var guards []server.Guard
+	if *captchaProviderFlag != "" {
+		captcha, err := server.NewCaptcha(server.CaptchaConfig{
+			Provider:  *captchaProviderFlag,
+			SiteKey:   *captchaSiteKeyFlag,
+			Secret:    *captchaSecretFlag,
+			VerifyURL: *captchaVerifyFlag,
+			MinScore:  *captchaScoreFlag,
+		}, clientIP)
+		if err != nil {
+			panic(fmt.Errorf("invalid captcha config: %w", err))
+		}
+		guards = append(guards, captcha)
+	}
+	if *powDifficultyFlag > 0 {
+		if *powSecretFlag == "" && store != nil {
+			log.Warn("Proof of work challenges are signed with a random secret, set pow.secret to share them between replicas")
+		}
+		pow, err := server.NewProofOfWork(server.ProofOfWorkConfig{
+			Secret:        []byte(*powSecretFlag),
+			Difficulty:    *powDifficultyFlag,
+			MaxDifficulty: *powMaxFlag,
+			QueueStep:     *powStepFlag,
+			TTL:           time.Duration(*powTTLFlag) * time.Minute,
+		}, store)
+		if err != nil {
+			panic(fmt.Errorf("invalid proof of work config: %w", err))
+		}
+		guards = append(guards, pow)
+	}
+	if *signatureFormatFlag != "" {
+		ownership, err := server.NewOwnership(server.OwnershipConfig{
+			Format:    *signatureFormatFlag,
+			ChainID:   txBuilder.ChainID().Int64(),
+			Statement: fmt.Sprintf("Claim %s funds from the faucet.", *netnameFlag),
+			Secret:    []byte(*signatureSecretFlag),
+			TTL:       time.Duration(*signatureTTLFlag) * time.Minute,
+		}, store)
+		if err != nil {
+			panic(fmt.Errorf("invalid signature config: %w", err))
+		}
+		guards = append(guards, ownership)
+	}
+	if *oauthProviderFlag != "" {
+		identity, err := server.NewIdentity(context.Background(), server.IdentityConfig{
+			Provider:      *oauthProviderFlag,
+			ClientID:      *oauthClientFlag,
+			ClientSecret:  *oauthSecretFlag,
+			RedirectURL:   *oauthRedirectFlag,
+			Issuer:        *oauthIssuerFlag,
+			MinAccountAge: time.Duration(*oauthMinAgeFlag) * 24 * time.Hour,
+			CreatedClaim:  *oauthCreatedFlag,
+			SessionSecret: []byte(*oauthSessionFlag),
+			SessionTTL:    time.Duration(*oauthTTLFlag) * time.Hour,
+		})
+		if err != nil {
+			panic(fmt.Errorf("invalid login config: %w", err))
+		}
+		guards = append(guards, identity)
 	}
 
-	if len(jsonContent) > 0 {
-		if err := json.Unmarshal(jsonContent, &tokenList); err != nil {
-			log.Warningf("parse json tokens error: %s %v", string(jsonContent), err)
+	var audit io.Writer
+	if *ledgerFlag != "" {
+		file, err := os.OpenFile(*ledgerFlag, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			panic(fmt.Errorf("cannot open claim ledger: %w", err))
 		}
+		defer file.Close()
+		audit = file
 	}
+	ledger := server.NewLedger(*ledgerSizeFlag, audit)
 
-	for _, token := range tokenList {
-		log.Infof("token %s >> %v", token.Symbol, token.ContractAddress)
-		builder, err := chain.NewTxTokenBuilder(*providerFlag, token.ContractAddress, &privateKey, chainID)
+	batch := server.BatchConfig{MaxItems: *batchMaxFlag}
+	if *multisendFlag != "" {
+		if !chain.IsValidAddress(*multisendFlag, false) {
+			panic(fmt.Errorf("invalid multisend contract address %q", *multisendFlag))
+		}
+		batch.MultiSend, err = chain.NewMultiSender(*providerFlag, *multisendFlag, &privateKey, chainID)
 		if err != nil {
-			panic(fmt.Errorf("NewTxTokenBuilder error: %v", err))
+			panic(fmt.Errorf("cannot connect to web3 provider: %v", err))
 		}
-		tokenBuilders[strings.ToLower(token.Symbol)] = builder
 	}
 
-	config := server.NewConfig(*netnameFlag, *httpPortFlag, *intervalFlag, *payoutFlag, *proxyCntFlag, *queueCapFlag)
-	go server.NewServer(txBuilder, tokenBuilders, config).Run()
+	admin, err := adminConfig()
+	if err != nil {
+		panic(fmt.Errorf("invalid admin config: %w", err))
+	}
+	if *adminAuditFlag != "" {
+		file, err := os.OpenFile(*adminAuditFlag, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			panic(fmt.Errorf("cannot open admin audit log: %w", err))
+		}
+		defer file.Close()
+		admin.Audit = server.NewAuditLog(1000, file)
+	}
+
+	config := server.NewConfig(*netnameFlag, *explorerFlag, *httpPortFlag, *queueCapFlag, clientIP, store, access, keys, ledger, batch, admin, guards...)
+	srv := server.NewServer(txBuilder, settings, config)
+	go srv.Run()
+	if *grpcPortFlag > 0 {
+		go srv.RunGRPC(*grpcPortFlag)
+	}
+	if admin.Port > 0 && (admin.Token != "" || *adminClientCAFlag != "") {
+		go srv.RunAdmin()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	watched := []string{*tokensFlag}
+	if *settingsFlag != "" {
+		watched = append(watched, *settingsFlag)
+	}
+	watched = append(watched, access.Paths()...)
+	watched = append(watched, keys.Paths()...)
+	go srv.WatchConfig(watched, 5*time.Second, hup, load)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
 }
 
+// adminConfig builds the admin API config from the flags. Client certificates require a TLS
+// listener of its own, and are optional as long as an admin token is set.
+func adminConfig() (server.AdminConfig, error) {
+	admin := server.AdminConfig{Token: *adminFlag, Port: *adminPortFlag}
+	if *adminCertFlag == "" && *adminKeyFlag == "" {
+		if *adminClientCAFlag != "" {
+			return admin, errors.New("client certificates require admin.tlscert and admin.tlskey")
+		}
+		return admin, nil
+	}
+	if admin.Port == 0 {
+		return admin, errors.New("TLS requires admin.port")
+	}
+	cert, err := tls.LoadX509KeyPair(*adminCertFlag, *adminKeyFlag)
+	if err != nil {
+		return admin, err
+	}
+	admin.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if *adminClientCAFlag != "" {
+		pem, err := os.ReadFile(*adminClientCAFlag)
+		if err != nil {
+			return admin, err
+		}
+		admin.TLS.ClientCAs = x509.NewCertPool()
+		if !admin.TLS.ClientCAs.AppendCertsFromPEM(pem) {
+			return admin, fmt.Errorf("no certificates in %s", *adminClientCAFlag)
+		}
+		admin.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		if admin.Token != "" {
+			admin.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return admin, nil
+}
+
+// loadSettings builds the runtime settings from the flags, the optional settings file and the
+// token list. It is used both at startup, without a running registry, and on every config
+// reload. A missing token list is only tolerated at startup.
+func loadSettings(chainID *big.Int, dial server.TokenDialer, running *server.Registry) (*server.Settings, error) {
+	payout, interval := *payoutFlag, *intervalFlag
+	native := server.NativeAsset{
+		Symbol:    *nativeSymbolFlag,
+		Name:      *nativeNameFlag,
+		Decimals:  *nativeDecimalsFlag,
+		Payout:    server.Amount(*nativePayoutFlag),
+		MinAmount: server.Amount(*nativeMinFlag),
+		MaxAmount: server.Amount(*nativeMaxFlag),
+		Quota:     server.Amount(*nativeQuotaFlag),
+
+		IPQuota:     server.Amount(*nativeIPQuotaFlag),
+		SubnetQuota: server.Amount(*nativeSubnetQuotaFlag),
+	}
+	dailyClaims := *dailyFlag
+
+	if *settingsFlag != "" {
+		runtimeCfg, err := server.LoadRuntimeConfig(*settingsFlag)
+		if err != nil {
+			return nil, err
+		}
+		if runtimeCfg.Payout != "" {
+			payout = string(runtimeCfg.Payout)
+		}
+		if runtimeCfg.Interval != nil {
+			interval = *runtimeCfg.Interval
+		}
+		if runtimeCfg.NativePayout != "" {
+			native.Payout = runtimeCfg.NativePayout
+		}
+		if runtimeCfg.NativeMinAmount != "" {
+			native.MinAmount = runtimeCfg.NativeMinAmount
+		}
+		if runtimeCfg.NativeMaxAmount != "" {
+			native.MaxAmount = runtimeCfg.NativeMaxAmount
+		}
+		if runtimeCfg.NativeQuota != "" {
+			native.Quota = runtimeCfg.NativeQuota
+		}
+		if runtimeCfg.DailyClaims != nil {
+			dailyClaims = *runtimeCfg.DailyClaims
+		}
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("interval must not be negative, got %d", interval)
+	}
+	if dailyClaims < 0 {
+		return nil, fmt.Errorf("daily claims must not be negative, got %d", dailyClaims)
+	}
+
+	tokenList, err := server.LoadTokenConfig(*tokensFlag, chainID.Int64())
+	if errors.Is(err, os.ErrNotExist) && running == nil {
+		log.Warningf("load tokens file error: %s %v", *tokensFlag, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	defaults := server.AssetDefaults{
+		Payout:   payout,
+		Cooldown: time.Duration(interval) * time.Minute,
+	}
+	registry, err := server.BuildRegistry(context.Background(), native, tokenList, defaults, dial, running)
+	if err != nil {
+		return nil, err
+	}
+
+	return &server.Settings{Registry: registry, DailyClaims: dailyClaims}, nil
+}
+
 func decode(input string) string {
 	content, err := base64.StdEncoding.DecodeString(input)
 	if err != nil {
@@ -6,8 +6,15 @@ go 1.16
 require (
 	github.com/LK4D4/trylock v0.0.0-20191027065348-ff7e133a5c54
 	github.com/agiledragon/gomonkey/v2 v2.6.0
+	github.com/alicebob/miniredis/v2 v2.23.0
 	github.com/ethereum/go-ethereum v1.10.17
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/jellydator/ttlcache/v2 v2.11.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/urfave/negroni v1.0.0
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
+	google.golang.org/genproto v0.0.0-20200825200019-8632dd797987
+	google.golang.org/grpc v1.46.2
+	google.golang.org/protobuf v1.28.0
 )
@@ -0,0 +1,86 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const erc20ABIJSON = `[
+	{"constant":true,"inputs":[],"name":"symbol","outputs":[{"name":"","type":"string"}],"type":"function"},
+	{"constant":true,"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"type":"function"},
+	{"constant":true,"inputs":[{"name":"owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"type":"function"}
+]`
+
+var erc20ABI abi.ABI
+
+func init() {
+	parsed, err := abi.JSON(strings.NewReader(erc20ABIJSON))
+	if err != nil {
+		panic(err)
+	}
+	erc20ABI = parsed
+}
+
+// ContractAddress returns the address of the token contract.
+func (b *TxTokenBuild) ContractAddress() common.Address {
+	return b.contractAddress
+}
+
+// HasCode reports whether there is contract code deployed at the token address.
+func (b *TxTokenBuild) HasCode(ctx context.Context) (bool, error) {
+	code, err := b.client.CodeAt(ctx, b.contractAddress, nil)
+	if err != nil {
+		return false, err
+	}
+	return len(code) > 0, nil
+}
+
+// Symbol calls symbol() on the token contract.
+func (b *TxTokenBuild) Symbol(ctx context.Context) (string, error) {
+	var symbol string
+	if err := b.call(ctx, &symbol, "symbol"); err != nil {
+		return "", err
+	}
+	return symbol, nil
+}
+
+// Decimals calls decimals() on the token contract.
+func (b *TxTokenBuild) Decimals(ctx context.Context) (uint8, error) {
+	var decimals uint8
+	if err := b.call(ctx, &decimals, "decimals"); err != nil {
+		return 0, err
+	}
+	return decimals, nil
+}
+
+// BalanceOf calls balanceOf(owner) on the token contract.
+func (b *TxTokenBuild) BalanceOf(ctx context.Context, owner common.Address) (*big.Int, error) {
+	balance := new(big.Int)
+	if err := b.call(ctx, &balance, "balanceOf", owner); err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+func (b *TxTokenBuild) call(ctx context.Context, out interface{}, method string, args ...interface{}) error {
+	data, err := erc20ABI.Pack(method, args...)
+	if err != nil {
+		return err
+	}
+
+	output, err := b.client.CallContract(ctx, ethereum.CallMsg{To: &b.contractAddress, Data: data}, nil)
+	if err != nil {
+		return err
+	}
+	if len(output) == 0 {
+		return fmt.Errorf("%s() returned no data", method)
+	}
+
+	return erc20ABI.UnpackIntoInterface(out, method, output)
+}
@@ -0,0 +1,149 @@
+package chain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+)
+
+const disperseABIJSON = `[
+	{"inputs":[{"name":"recipients","type":"address[]"},{"name":"values","type":"uint256[]"}],"name":"disperseEther","outputs":[],"stateMutability":"payable","type":"function"},
+	{"inputs":[{"name":"token","type":"address"},{"name":"recipients","type":"address[]"},{"name":"values","type":"uint256[]"}],"name":"disperseToken","outputs":[],"stateMutability":"nonpayable","type":"function"}
+]`
+
+var disperseABI abi.ABI
+
+func init() {
+	parsed, err := abi.JSON(strings.NewReader(disperseABIJSON))
+	if err != nil {
+		panic(err)
+	}
+	disperseABI = parsed
+}
+
+// MultiSender pays several recipients in one transaction through a Disperse contract
+// (https://disperse.app). Tokens are pulled from the sender with transferFrom, so the sender
+// has to approve the contract for every token it pays out this way.
+type MultiSender interface {
+	DisperseEther(ctx context.Context, recipients []common.Address, values []*big.Int) (common.Hash, error)
+	DisperseToken(ctx context.Context, token common.Address, recipients []common.Address, values []*big.Int) (common.Hash, error)
+}
+
+type MultiSend struct {
+	client      *ethclient.Client
+	privateKey  *ecdsa.PrivateKey
+	signer      types.Signer
+	fromAddress common.Address
+	contract    common.Address
+}
+
+func NewMultiSender(provider, contractAddress string, privateKey *ecdsa.PrivateKey, chainID *big.Int) (*MultiSend, error) {
+	client, err := ethclient.Dial(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	if chainID == nil {
+		chainID, err = client.ChainID(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &MultiSend{
+		client:      client,
+		privateKey:  privateKey,
+		signer:      types.NewEIP155Signer(chainID),
+		fromAddress: crypto.PubkeyToAddress(privateKey.PublicKey),
+		contract:    common.HexToAddress(contractAddress),
+	}, nil
+}
+
+// DisperseEther sends each recipient its value of the native asset.
+func (m *MultiSend) DisperseEther(ctx context.Context, recipients []common.Address, values []*big.Int) (common.Hash, error) {
+	data, total, err := disperseCall(nil, recipients, values)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return m.send(ctx, total, data)
+}
+
+// DisperseToken sends each recipient its value of the token.
+func (m *MultiSend) DisperseToken(ctx context.Context, token common.Address, recipients []common.Address, values []*big.Int) (common.Hash, error) {
+	data, _, err := disperseCall(&token, recipients, values)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return m.send(ctx, big.NewInt(0), data)
+}
+
+// disperseCall packs the call paying out the values of the token, or of the native asset if
+// the token is nil, and returns it with the total of the values.
+func disperseCall(token *common.Address, recipients []common.Address, values []*big.Int) ([]byte, *big.Int, error) {
+	if len(recipients) == 0 || len(recipients) != len(values) {
+		return nil, nil, fmt.Errorf("got %d recipients for %d values", len(recipients), len(values))
+	}
+	total := new(big.Int)
+	for _, value := range values {
+		total.Add(total, value)
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if token == nil {
+		data, err = disperseABI.Pack("disperseEther", recipients, values)
+	} else {
+		data, err = disperseABI.Pack("disperseToken", *token, recipients, values)
+	}
+	return data, total, err
+}
+
+func (m *MultiSend) send(ctx context.Context, value *big.Int, data []byte) (common.Hash, error) {
+	nonce, err := m.client.PendingNonceAt(ctx, m.fromAddress)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	gasPrice, err := m.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	gasLimit, err := m.client.EstimateGas(ctx, ethereum.CallMsg{From: m.fromAddress, To: &m.contract, Value: value, Data: data})
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("cannot estimate multisend gas: %w", err)
+	}
+
+	unsignedTx := types.NewTx(&types.LegacyTx{
+		Nonce:    nonce,
+		To:       &m.contract,
+		Value:    value,
+		Gas:      gasLimit,
+		GasPrice: gasPrice,
+		Data:     data,
+	})
+	signedTx, err := types.SignTx(unsignedTx, m.signer, m.privateKey)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := m.client.SendTransaction(ctx, signedTx); err != nil {
+		log.Errorf("multisend SendTransaction error, %v", err)
+		return common.Hash{}, err
+	}
+	log.Infof("multisend tx-hash: %s", signedTx.Hash().Hex())
+
+	if _, err := bind.WaitMined(context.Background(), m.client, signedTx); err != nil {
+		log.Errorf("multisend WaitMined error, %v", err)
+	}
+	return signedTx.Hash(), nil
+}
@@ -0,0 +1,48 @@
+package chain
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestDisperseCall(t *testing.T) {
+	token := common.HexToAddress("0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	recipients := []common.Address{
+		common.HexToAddress("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"),
+		common.HexToAddress("0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"),
+	}
+	values := []*big.Int{big.NewInt(1000), big.NewInt(500)}
+
+	tests := []struct {
+		name     string
+		token    *common.Address
+		values   []*big.Int
+		selector string
+		wantErr  bool
+	}{
+		{name: "ether", values: values, selector: "0xe63d38ed"},
+		{name: "token", token: &token, values: values, selector: "0xc73a2d60"},
+		{name: "mismatched values", values: values[:1], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, total, err := disperseCall(tt.token, recipients, tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("disperseCall() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(data[:4], hexutil.MustDecode(tt.selector)) {
+				t.Errorf("disperseCall() selector = %x, want %s", data[:4], tt.selector)
+			}
+			if total.Cmp(big.NewInt(1500)) != 0 {
+				t.Errorf("disperseCall() total = %v, want 1500", total)
+			}
+		})
+	}
+}
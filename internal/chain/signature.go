@@ -0,0 +1,32 @@
+package chain
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// RecoverPersonalSigner returns the address whose key made the signature over the message
+// with personal_sign, which hashes the message with the EIP-191 prefix. The recovery id of
+// the 65-byte signature may be either 0/1 or 27/28 as produced by wallets.
+func RecoverPersonalSigner(message, signature []byte) (common.Address, error) {
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, errors.New("signature must be 65 bytes long")
+	}
+	sig := make([]byte, crypto.SignatureLength)
+	copy(sig, signature)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	if sig[crypto.RecoveryIDOffset] > 1 {
+		return common.Address{}, errors.New("invalid signature recovery id")
+	}
+
+	pub, err := crypto.SigToPub(accounts.TextHash(message), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
@@ -0,0 +1,47 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestRecoverPersonalSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	message := []byte("Claim testnet funds")
+	signature, err := crypto.Sign(accounts.TextHash(message), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletSignature := append([]byte{}, signature...)
+	walletSignature[64] += 27
+
+	tests := []struct {
+		name      string
+		message   []byte
+		signature []byte
+		wantErr   bool
+		want      bool
+	}{
+		{name: "raw recovery id", message: message, signature: signature, want: true},
+		{name: "wallet recovery id", message: message, signature: walletSignature, want: true},
+		{name: "other message", message: []byte("Claim mainnet funds"), signature: signature, want: false},
+		{name: "truncated", message: message, signature: signature[:64], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RecoverPersonalSigner(tt.message, tt.signature)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RecoverPersonalSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got == address) != tt.want {
+				t.Errorf("RecoverPersonalSigner() = %v, signer %v, want match %v", got.Hex(), address.Hex(), tt.want)
+			}
+		})
+	}
+}
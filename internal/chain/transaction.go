@@ -14,14 +14,27 @@ import (
 
 type TxBuilder interface {
 	Sender() common.Address
+	ChainID() *big.Int
 	Transfer(ctx context.Context, to string, value *big.Int) (common.Hash, error)
 }
 
+// ReceiptReader looks up the receipts of sent transactions. It returns ethereum.NotFound while
+// a transaction is pending.
+type ReceiptReader interface {
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// BalanceReader reads the native balance of the sending account.
+type BalanceReader interface {
+	Balance(ctx context.Context) (*big.Int, error)
+}
+
 type TxBuild struct {
 	client      *ethclient.Client
 	privateKey  *ecdsa.PrivateKey
 	signer      types.Signer
 	fromAddress common.Address
+	chainID     *big.Int
 }
 
 func NewTxBuilder(provider string, privateKey *ecdsa.PrivateKey, chainID *big.Int) (TxBuilder, error) {
@@ -42,6 +55,7 @@ func NewTxBuilder(provider string, privateKey *ecdsa.PrivateKey, chainID *big.In
 		privateKey:  privateKey,
 		signer:      types.NewEIP155Signer(chainID),
 		fromAddress: crypto.PubkeyToAddress(privateKey.PublicKey),
+		chainID:     chainID,
 	}, nil
 }
 
@@ -49,6 +63,21 @@ func (b *TxBuild) Sender() common.Address {
 	return b.fromAddress
 }
 
+// ChainID returns the chain ID transactions are signed for.
+func (b *TxBuild) ChainID() *big.Int {
+	return b.chainID
+}
+
+// Balance returns the native balance of the sender at the latest block.
+func (b *TxBuild) Balance(ctx context.Context) (*big.Int, error) {
+	return b.client.BalanceAt(ctx, b.fromAddress, nil)
+}
+
+// TransactionReceipt returns the receipt of a mined transaction.
+func (b *TxBuild) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return b.client.TransactionReceipt(ctx, txHash)
+}
+
 func (b *TxBuild) Transfer(ctx context.Context, to string, value *big.Int) (common.Hash, error) {
 	log.Infof("transer >> contractAddress: fromAddress: %s toAddress: %s  amount:  %s",
 		b.fromAddress.Hex(), to, value.String())
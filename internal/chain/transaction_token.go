@@ -16,6 +16,17 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
+// TokenTxBuilder pays out an ERC-20 token and reads the contract state needed to validate it.
+type TokenTxBuilder interface {
+	Sender() common.Address
+	ContractAddress() common.Address
+	Transfer(ctx context.Context, to string, amt *big.Int) (common.Hash, error)
+	HasCode(ctx context.Context) (bool, error)
+	Symbol(ctx context.Context) (string, error)
+	Decimals(ctx context.Context) (uint8, error)
+	BalanceOf(ctx context.Context, owner common.Address) (*big.Int, error)
+}
+
 type TxTokenBuild struct {
 	client          *ethclient.Client
 	privateKey      *ecdsa.PrivateKey
@@ -81,10 +92,8 @@ func (b *TxTokenBuild) Transfer(ctx context.Context, to string, amt *big.Int) (c
 	paddedAddress := common.LeftPadBytes(toAddress.Bytes(), 32)
 	fmt.Printf("To address: %s\n", hexutil.Encode(paddedAddress))
 
-	amount := new(big.Int)
-	amount.SetString("1000000000000000000", 10) // 1 token
 	// zero pad (to the left) the amount. The resulting byte slice must be 32 bytes long.
-	paddedAmount := common.LeftPadBytes(amount.Bytes(), 32)
+	paddedAmount := common.LeftPadBytes(amt.Bytes(), 32)
 	fmt.Printf("Token amount: %s\n", hexutil.Encode(paddedAmount))
 
 	var data []byte
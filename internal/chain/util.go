@@ -1,7 +1,10 @@
 package chain
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
 )
@@ -18,7 +21,73 @@ func EtherToWei(amount int64) *big.Int {
 	return new(big.Int).Mul(big.NewInt(amount), ether)
 }
 
-func EtherTokenAmount(amount int64) *big.Int {
-	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
-	return new(big.Int).Mul(big.NewInt(amount), ether)
+// maxUint256Digits is the number of decimal digits of 2^256.
+const maxUint256Digits = 78
+
+// ParseUnits converts a decimal string such as "0.05" into the smallest unit of an asset with
+// the given decimals. Amounts with more fractional digits than the asset supports are rejected
+// rather than rounded, and so are amounts that don't fit in a uint256.
+func ParseUnits(amount string, decimals int) (*big.Int, error) {
+	amount = strings.TrimSpace(amount)
+	if amount == "" {
+		return nil, errors.New("empty amount")
+	}
+
+	whole, frac := amount, ""
+	if i := strings.IndexByte(amount, '.'); i >= 0 {
+		whole, frac = amount[:i], amount[i+1:]
+	}
+	if whole == "" && frac == "" {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	if !isDigits(whole) || !isDigits(frac) {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > decimals {
+		return nil, fmt.Errorf("amount %q has more than %d decimal places", amount, decimals)
+	}
+	// Parsing is slow for long strings, so amounts with more digits than 2^256 are rejected
+	// before they are parsed.
+	if len(strings.TrimLeft(whole, "0"))+decimals > maxUint256Digits {
+		return nil, fmt.Errorf("amount %q does not fit in 256 bits", amount)
+	}
+
+	digits := whole + frac + strings.Repeat("0", decimals-len(frac))
+	value, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	if value.BitLen() > 256 {
+		return nil, fmt.Errorf("amount %q does not fit in 256 bits", amount)
+	}
+	return value, nil
+}
+
+// FormatUnits renders an amount in the smallest unit as a decimal string without trailing zeros.
+func FormatUnits(value *big.Int, decimals int) string {
+	digits := new(big.Int).Abs(value).String()
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+
+	whole, frac := digits[:len(digits)-decimals], strings.TrimRight(digits[len(digits)-decimals:], "0")
+	result := whole
+	if frac != "" {
+		result += "." + frac
+	}
+	if value.Sign() < 0 {
+		result = "-" + result
+	}
+	return result
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
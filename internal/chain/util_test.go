@@ -3,6 +3,7 @@ package chain
 import (
 	"math/big"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -48,3 +49,63 @@ func TestEtherToWei(t *testing.T) {
 		})
 	}
 }
+
+func TestParseUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   string
+		decimals int
+		want     string
+		wantErr  bool
+	}{
+		{name: "whole", amount: "2", decimals: 18, want: "2000000000000000000"},
+		{name: "fraction", amount: "0.05", decimals: 18, want: "50000000000000000"},
+		{name: "leading dot", amount: ".5", decimals: 6, want: "500000"},
+		{name: "trailing zeros", amount: "1.500000000", decimals: 1, want: "15"},
+		{name: "zero decimals", amount: "3", decimals: 0, want: "3"},
+		{name: "too precise", amount: "0.0000001", decimals: 6, wantErr: true},
+		{name: "negative", amount: "-1", decimals: 18, wantErr: true},
+		{name: "exponent", amount: "1e18", decimals: 18, wantErr: true},
+		{name: "empty", amount: "", decimals: 18, wantErr: true},
+		{name: "dot", amount: ".", decimals: 18, wantErr: true},
+		{name: "max uint256", amount: "115792089237316195423570985008687907853269984665640564039457584007913129639935", decimals: 0, want: "115792089237316195423570985008687907853269984665640564039457584007913129639935"},
+		{name: "overflow", amount: "115792089237316195423570985008687907853269984665640564039457584007913129639936", decimals: 0, wantErr: true},
+		{name: "overflow by decimals", amount: "1157920892373161954235709850086879078532699846656405640394575", decimals: 18, wantErr: true},
+		{name: "leading zeros", amount: strings.Repeat("0", 100) + "1.5", decimals: 18, want: "1500000000000000000"},
+		{name: "too many digits", amount: strings.Repeat("9", 1000000), decimals: 18, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUnits(tt.amount, tt.decimals)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseUnits() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseUnits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    *big.Int
+		decimals int
+		want     string
+	}{
+		{name: "whole", value: EtherToWei(2), decimals: 18, want: "2"},
+		{name: "fraction", value: big.NewInt(50000000000000000), decimals: 18, want: "0.05"},
+		{name: "mixed", value: big.NewInt(1500000), decimals: 6, want: "1.5"},
+		{name: "zero", value: big.NewInt(0), decimals: 6, want: "0"},
+		{name: "zero decimals", value: big.NewInt(42), decimals: 0, want: "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatUnits(tt.value, tt.decimals); got != tt.want {
+				t.Errorf("FormatUnits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
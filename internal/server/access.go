@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// ListKind names one of the access lists.
+type ListKind string
+
+const (
+	AllowList ListKind = "allow"
+	DenyList  ListKind = "deny"
+)
+
+// AccessControl holds the allowlist and denylist of addresses, IPs and CIDR ranges. Denied
+// clients can't claim at all, while allowed clients get their per-client quotas multiplied by
+// the quota factor, or lifted entirely if the factor is zero.
+//
+// Each list may be backed by a file with one entry per line and # comments. Changes made
+// through Add and Remove are written back to the file, so they survive a restart.
+type AccessControl struct {
+	mutex  sync.RWMutex
+	lists  map[ListKind]*accessList
+	paths  map[ListKind]string
+	factor int64
+}
+
+// NewAccessControl loads the lists from their files. An empty path keeps that list in memory
+// only, and a file that doesn't exist yet starts out as an empty list.
+func NewAccessControl(allowPath, denyPath string, factor int) (*AccessControl, error) {
+	if factor < 0 {
+		return nil, fmt.Errorf("allowlist quota factor must not be negative, got %d", factor)
+	}
+	a := &AccessControl{
+		lists:  map[ListKind]*accessList{AllowList: {}, DenyList: {}},
+		paths:  map[ListKind]string{AllowList: allowPath, DenyList: denyPath},
+		factor: int64(factor),
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Paths returns the files backing the lists.
+func (a *AccessControl) Paths() []string {
+	var paths []string
+	for _, kind := range []ListKind{AllowList, DenyList} {
+		if a.paths[kind] != "" {
+			paths = append(paths, a.paths[kind])
+		}
+	}
+	return paths
+}
+
+// Reload reads the lists from their files again. If either file is invalid neither list changes.
+func (a *AccessControl) Reload() error {
+	apply, err := a.Prepare()
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare reads the lists from their files again and returns a function that swaps them in,
+// so they can be applied together with the rest of a config reload.
+func (a *AccessControl) Prepare() (func(), error) {
+	next := make(map[ListKind]*accessList, len(a.paths))
+	for kind, path := range a.paths {
+		if path == "" {
+			continue
+		}
+		list, err := loadAccessList(path)
+		if err != nil {
+			return nil, fmt.Errorf("%slist %s: %w", kind, path, err)
+		}
+		next[kind] = list
+	}
+
+	return func() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		for kind, list := range next {
+			a.lists[kind] = list
+		}
+	}, nil
+}
+
+// Denied reports whether the address or client IP is on the denylist.
+func (a *AccessControl) Denied(address, ip string) bool {
+	return a.contains(DenyList, address, ip)
+}
+
+// Allowed reports whether the address or client IP is on the allowlist.
+func (a *AccessControl) Allowed(address, ip string) bool {
+	return a.contains(AllowList, address, ip)
+}
+
+func (a *AccessControl) contains(kind ListKind, address, ip string) bool {
+	if a == nil {
+		return false
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.lists[kind].contains(address, ip)
+}
+
+// elevate returns the per-client quota that applies to an allowlisted client, which is nil
+// when allowlisted clients are exempt.
+func (a *AccessControl) elevate(quota *big.Int) *big.Int {
+	if quota == nil || a.factor == 0 {
+		return nil
+	}
+	return new(big.Int).Mul(quota, big.NewInt(a.factor))
+}
+
+// Entries returns the entries of a list in the order they were added.
+func (a *AccessControl) Entries(kind ListKind) []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return append([]string{}, a.lists[kind].entries...)
+}
+
+// Add puts an address, IP or CIDR range on a list and writes it to the list's file.
+func (a *AccessControl) Add(kind ListKind, entry string) error {
+	return a.update(kind, entry, true)
+}
+
+// Remove takes an entry off a list and out of the list's file.
+func (a *AccessControl) Remove(kind ListKind, entry string) error {
+	return a.update(kind, entry, false)
+}
+
+func (a *AccessControl) update(kind ListKind, entry string, add bool) error {
+	if _, ok := a.paths[kind]; !ok {
+		return fmt.Errorf("unknown list %q", kind)
+	}
+	normalized, err := normalizeAccessEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if path := a.paths[kind]; path != "" {
+		if err := rewriteAccessFile(path, normalized, add); err != nil {
+			return err
+		}
+	}
+	var entries []string
+	for _, existing := range a.lists[kind].entries {
+		if existing != normalized {
+			entries = append(entries, existing)
+		}
+	}
+	if add {
+		entries = append(entries, normalized)
+	}
+	list, err := newAccessList(entries)
+	if err != nil {
+		return err
+	}
+	a.lists[kind] = list
+	return nil
+}
+
+type accessList struct {
+	entries   []string
+	addresses map[string]bool
+	networks  []*net.IPNet
+}
+
+func newAccessList(entries []string) (*accessList, error) {
+	list := &accessList{addresses: make(map[string]bool)}
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		normalized, err := normalizeAccessEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		if strings.HasPrefix(normalized, "0x") {
+			list.addresses[normalized] = true
+		} else {
+			_, network, _ := net.ParseCIDR(normalized)
+			list.networks = append(list.networks, network)
+		}
+		list.entries = append(list.entries, normalized)
+	}
+	return list, nil
+}
+
+func (l *accessList) contains(address, ip string) bool {
+	if l.addresses[strings.ToLower(address)] {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range l.networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAccessEntry turns an entry into its canonical form: a lowercase address or a CIDR
+// range, with single IPs written as a /32 or /128 range.
+func normalizeAccessEntry(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if chain.IsValidAddress(entry, false) {
+		return strings.ToLower(entry), nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 128
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 32
+		}
+		return (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), nil
+	}
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		return network.String(), nil
+	}
+	return "", fmt.Errorf("invalid access list entry %q, want an address, IP or CIDR range", entry)
+}
+
+func loadAccessList(path string) (*accessList, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newAccessList(nil)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := accessFileEntry(scanner.Text())
+		if entry == "" {
+			continue
+		}
+		if _, err := normalizeAccessEntry(entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newAccessList(entries)
+}
+
+// accessFileEntry strips the comment and surrounding space from a line of a list file.
+func accessFileEntry(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// rewriteAccessFile appends the entry to the file, or drops every line holding it, keeping
+// comments and other entries as they are. The file is replaced atomically.
+func rewriteAccessFile(path, normalized string, add bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var out bytes.Buffer
+	present := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if entry := accessFileEntry(line); entry != "" {
+			if existing, err := normalizeAccessEntry(entry); err == nil && existing == normalized {
+				present = true
+				if !add {
+					continue
+				}
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if add && present || !add && !present {
+		return nil
+	}
+	if add {
+		out.WriteString(normalized + "\n")
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
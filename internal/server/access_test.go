@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAccessControlFiles(t *testing.T) {
+	dir := t.TempDir()
+	allowPath := filepath.Join(dir, "allow.txt")
+	denyPath := filepath.Join(dir, "deny.txt")
+	allowFile := "# CI wallets\n0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B\n\n10.0.0.0/8 # office\n"
+	if err := ioutil.WriteFile(allowPath, []byte(allowFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	access, err := NewAccessControl(allowPath, denyPath, 10)
+	if err != nil {
+		t.Fatalf("NewAccessControl() error = %v", err)
+	}
+	if !access.Allowed("0xab5801a7d398351b8be11c439e05c5b3259aec9b", "") {
+		t.Error("Allowed() = false for an allowlisted address")
+	}
+	if !access.Allowed("", "10.20.30.40") {
+		t.Error("Allowed() = false for an IP in an allowlisted range")
+	}
+	if access.Denied("", "10.20.30.40") {
+		t.Error("Denied() = true with a missing denylist file")
+	}
+
+	if err := access.Add(DenyList, "2001:db8::1"); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := access.Add(AllowList, "0xfECE6a24ea30226a75139085A88bad1740B4fF6C"); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := access.Remove(AllowList, "10.0.0.0/8"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if err := access.Add(AllowList, "not an entry"); err == nil {
+		t.Error("Add() error = nil for an invalid entry")
+	}
+
+	data, _ := ioutil.ReadFile(allowPath)
+	want := "# CI wallets\n0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B\n\n0xfece6a24ea30226a75139085a88bad1740b4ff6c\n"
+	if string(data) != want {
+		t.Errorf("allowlist file = %q, want %q", data, want)
+	}
+	if !access.Denied("", "2001:db8::1") || access.Allowed("", "10.20.30.40") {
+		t.Error("list changes were not applied")
+	}
+
+	reloaded, err := NewAccessControl(allowPath, denyPath, 10)
+	if err != nil {
+		t.Fatalf("NewAccessControl() error = %v", err)
+	}
+	for _, kind := range []ListKind{AllowList, DenyList} {
+		if got, want := reloaded.Entries(kind), access.Entries(kind); !reflect.DeepEqual(got, want) {
+			t.Errorf("reloaded %slist = %v, want %v", kind, got, want)
+		}
+	}
+
+	if err := ioutil.WriteFile(denyPath, []byte("2001:db8::1\n300.1.1.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := access.Reload(); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Reload() error = %v, want an error on line 2", err)
+	}
+	if !access.Denied("", "2001:db8::1") {
+		t.Error("failed reload dropped the running denylist")
+	}
+}
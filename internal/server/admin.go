@@ -0,0 +1,494 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/negroni"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// adminRoutes registers the admin API on the router.
+func (s *Server) adminRoutes(router *http.ServeMux) {
+	router.Handle("/api/admin/pause", s.requireAdmin(s.handlePause(true)))
+	router.Handle("/api/admin/resume", s.requireAdmin(s.handlePause(false)))
+	router.Handle("/api/admin/assets", s.requireAdmin(s.handleAssets()))
+	router.Handle("/api/admin/assets/", s.requireAdmin(s.handleAsset()))
+	router.Handle("/api/admin/cooldowns/", s.requireAdmin(s.handleCooldownReset()))
+	router.Handle("/api/admin/queue", s.requireAdmin(s.handleQueue()))
+	router.Handle("/api/admin/claims", s.requireAdmin(s.handleClaims()))
+	router.Handle("/api/admin/claims/", s.requireAdmin(s.handleRetry()))
+	router.Handle("/api/admin/audit", s.requireAdmin(s.handleAudit()))
+	if s.cfg.access != nil {
+		router.Handle("/api/admin/lists", s.requireAdmin(s.handleLists()))
+		router.Handle("/api/admin/lists/", s.requireAdmin(s.handleListEntry()))
+	}
+	if s.cfg.keys != nil {
+		router.Handle("/api/admin/keys", s.requireAdmin(s.handleKeys()))
+		router.Handle("/api/admin/keys/", s.requireAdmin(s.handleKey()))
+	}
+}
+
+// AdminHandler returns the HTTP handler of the admin API alone, for a listener of its own.
+func (s *Server) AdminHandler() http.Handler {
+	router := http.NewServeMux()
+	s.adminRoutes(router)
+	n := negroni.New(negroni.NewRecovery(), negroni.NewLogger())
+	n.UseHandler(router)
+	return n
+}
+
+// RunAdmin serves the admin API on its own port, over TLS if it is configured.
+func (s *Server) RunAdmin() {
+	srv := &http.Server{
+		Addr:      ":" + strconv.Itoa(s.cfg.admin.Port),
+		Handler:   s.AdminHandler(),
+		TLSConfig: s.cfg.admin.TLS,
+	}
+	log.Infof("Starting admin server %d", s.cfg.admin.Port)
+	if s.cfg.admin.TLS != nil {
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(srv.ListenAndServe())
+}
+
+// operatorOf returns who authorized the request: "cert:" and the common name of a verified
+// client certificate, or "token" for the admin token. It returns "" if neither is presented.
+func (s *Server) operatorOf(r *http.Request) string {
+	if s.cfg.admin.clientCerts() && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if s.cfg.admin.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.admin.Token)) == 1 {
+		return "token"
+	}
+	return ""
+}
+
+// requireAdmin only passes on requests carrying the admin token as a bearer token, or a
+// verified client certificate.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.operatorOf(r) == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// audit records an action taken through the admin API.
+func (s *Server) audit(r *http.Request, action, target, detail string) {
+	s.cfg.admin.Audit.Record(AuditEntry{
+		Operator: s.operatorOf(r),
+		ClientIP: s.cfg.clientIP.ClientIP(r),
+		Action:   action,
+		Target:   target,
+		Detail:   detail,
+	})
+}
+
+// adminAsset is an asset as the faucet runs it, with the changes operators made to it.
+type adminAsset struct {
+	assetInfo
+	Overrides assetOverride `json:"overrides"`
+}
+
+// adminAssets describes whether the faucet and its assets are paused and how they are paid out.
+type adminAssets struct {
+	Paused bool         `json:"paused"`
+	Assets []adminAsset `json:"assets"`
+}
+
+func (s *Server) adminAssets() adminAssets {
+	info := s.info()
+	status := adminAssets{Paused: info.Paused, Assets: []adminAsset{}}
+	for _, asset := range info.Assets {
+		status.Assets = append(status.Assets, adminAsset{assetInfo: asset, Overrides: s.overrides(asset.Symbol)})
+	}
+	return status
+}
+
+// handleAssets returns the running assets with the changes operators made to them.
+func (s *Server) handleAssets() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.adminAssets())
+	}
+}
+
+// handlePause pauses or resumes the faucet with a POST, or only the asset given with ?asset=.
+// While the faucet is paused, no claims are accepted and the queue is not paid out.
+func (s *Server) handlePause(paused bool) http.HandlerFunc {
+	action := "resume"
+	if paused {
+		action = "pause"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		symbol := r.URL.Query().Get("asset")
+		if symbol != "" {
+			asset, err := s.resolve(symbol)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			symbol = asset.Symbol
+		}
+		changes, err := s.operate(func(state *operatorState) {
+			if symbol == "" {
+				state.paused = paused
+				return
+			}
+			override := state.assets[symbol]
+			override.Paused = paused
+			state.assets[symbol] = override
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.audit(r, action, symbol, strings.Join(changes, "; "))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.adminAssets())
+	}
+}
+
+// handleAsset changes the payout and cooldown of the asset at /api/admin/assets/{symbol} with
+// a PATCH of {"payout": "...", "minutes": ...}, or restores the configured ones with a DELETE.
+// The changes last until the faucet restarts.
+func (s *Server) handleAsset() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		symbol := strings.TrimPrefix(r.URL.Path, "/api/admin/assets/")
+		if symbol == "" {
+			http.NotFound(w, r)
+			return
+		}
+		asset, err := s.resolve(symbol)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		var (
+			body   assetOverride
+			action string
+		)
+		switch r.Method {
+		case "PATCH":
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			if body.Minutes != nil && *body.Minutes < 0 {
+				http.Error(w, "minutes must not be negative", http.StatusBadRequest)
+				return
+			}
+			action = "update asset"
+		case "DELETE":
+			action = "restore asset"
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		changes, err := s.operate(func(state *operatorState) {
+			override := state.assets[asset.Symbol]
+			if r.Method == "DELETE" {
+				override.Payout, override.Minutes = "", nil
+			}
+			if body.Payout != "" {
+				override.Payout = body.Payout
+			}
+			if body.Minutes != nil {
+				override.Minutes = body.Minutes
+			}
+			state.assets[asset.Symbol] = override
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.audit(r, action, asset.Symbol, strings.Join(changes, "; "))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.adminAssets())
+	}
+}
+
+// handleCooldownReset forgets what the address at /api/admin/cooldowns/{address} claimed with
+// a DELETE, so it can claim again right away. ?asset= limits the reset to one asset. The
+// quotas of the client's IP, subnet and login are left alone.
+func (s *Server) handleCooldownReset() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.NotFound(w, r)
+			return
+		}
+		address := strings.TrimPrefix(r.URL.Path, "/api/admin/cooldowns/")
+		if !chain.IsValidAddress(address, false) {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		address = common.HexToAddress(address).Hex()
+
+		assets := s.current().Registry.Assets()
+		if symbol := r.URL.Query().Get("asset"); symbol != "" {
+			asset, err := s.resolve(symbol)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			assets = []*Asset{asset}
+		}
+		if err := s.limiter.resetCooldown(r.Context(), address, assets); err != nil {
+			log.WithError(err).Error("Failed to reset a cooldown")
+			http.Error(w, "rate limits are unavailable, please try again later", http.StatusServiceUnavailable)
+			return
+		}
+		symbols := make([]string, len(assets))
+		for i, asset := range assets {
+			symbols[i] = asset.Symbol
+		}
+		s.audit(r, "reset cooldown", address, strings.Join(symbols, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleQueue lists the queued claims in the order they will be paid with a GET, or removes
+// them from the queue with a DELETE. The id and address query parameters limit which claims
+// are removed. Removed claims fail and can be retried.
+func (s *Server) handleQueue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]ClaimRecord{"claims": s.queued()})
+		case "DELETE":
+			query := r.URL.Query()
+			id, address := query.Get("id"), query.Get("address")
+			purged := s.purgeQueue(func(c claim) bool {
+				return (id == "" || c.id == id) && (address == "" || strings.EqualFold(c.address, address))
+			})
+			ids := make([]string, len(purged))
+			for i, c := range purged {
+				ids[i] = c.id
+			}
+			s.audit(r, "purge queue", strings.Trim(id+" "+address, " "), fmt.Sprintf("removed %d claims", len(ids)))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]string{"purged": ids})
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// handleRetry pays out the failed claim at /api/admin/claims/{id}/retry again with a POST, and
+// returns it.
+func (s *Server) handleRetry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/claims/")
+		if r.Method != "POST" || !strings.HasSuffix(id, "/retry") {
+			http.NotFound(w, r)
+			return
+		}
+		id = strings.TrimSuffix(id, "/retry")
+		record, rejected := s.retryClaim(r.Context(), id)
+		if rejected != nil {
+			http.Error(w, rejected.message, rejected.status)
+			return
+		}
+		s.audit(r, "retry claim", id, record.Status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(record)
+	}
+}
+
+// handleAudit returns the most recent admin actions, newest first. limit caps their number
+// (100 by default).
+func (s *Server) handleAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]AuditEntry{"actions": s.cfg.admin.Audit.List(limit)})
+	}
+}
+
+// parseLimit reads the limit query parameter, 100 by default, and replies with an error if it
+// is invalid.
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	text := r.URL.Query().Get("limit")
+	if text == "" {
+		return 100, true
+	}
+	limit, err := strconv.Atoi(text)
+	if err != nil || limit < 0 {
+		http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
+
+// handleLists returns the entries of both access lists.
+func (s *Server) handleLists() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[ListKind][]string{
+			AllowList: s.cfg.access.Entries(AllowList),
+			DenyList:  s.cfg.access.Entries(DenyList),
+		})
+	}
+}
+
+// handleListEntry adds an entry to /api/admin/lists/{allow,deny} with a POST of
+// {"entry": "..."}, or removes one with a DELETE carrying ?entry=..., and returns the list.
+func (s *Server) handleListEntry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kind := ListKind(strings.TrimPrefix(r.URL.Path, "/api/admin/lists/"))
+		if kind != AllowList && kind != DenyList {
+			http.NotFound(w, r)
+			return
+		}
+
+		var (
+			entry  string
+			action string
+			err    error
+		)
+		switch r.Method {
+		case "POST":
+			var body struct {
+				Entry string `json:"entry"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			entry, action = body.Entry, "add list entry"
+			err = s.cfg.access.Add(kind, entry)
+		case "DELETE":
+			entry, action = r.URL.Query().Get("entry"), "remove list entry"
+			err = s.cfg.access.Remove(kind, entry)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.audit(r, action, string(kind), entry)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"entries": s.cfg.access.Entries(kind)})
+	}
+}
+
+// handleClaims returns the most recent claims in the ledger, newest first. The address,
+// apiKey and status query parameters filter them, and limit caps their number (100 by default).
+func (s *Server) handleClaims() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		address, key, status := query.Get("address"), query.Get("apiKey"), query.Get("status")
+		claims := s.cfg.ledger.List(func(entry ClaimRecord) bool {
+			return (address == "" || strings.EqualFold(entry.Address, address)) &&
+				(key == "" || entry.APIKey == key) &&
+				(status == "" || entry.Status == status)
+		}, limit)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]ClaimRecord{"claims": claims})
+	}
+}
+
+// handleKeys lists the API keys with a GET, or issues one with a POST of its name and quotas.
+// The plaintext of an issued key is only returned in the response to the POST.
+func (s *Server) handleKeys() http.HandlerFunc {
+	type issued struct {
+		Key    string `json:"key"`
+		APIKey APIKey `json:"apiKey"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]APIKey{"keys": s.cfg.keys.List()})
+		case "POST":
+			var spec APIKey
+			if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			plaintext, key, err := s.cfg.keys.Create(APIKey{
+				Name:         spec.Name,
+				Assets:       spec.Assets,
+				DailyClaims:  spec.DailyClaims,
+				DailyAmounts: spec.DailyAmounts,
+			}, s.current().Registry)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.audit(r, "issue api key", key.ID, key.Name)
+			key.Hash = ""
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(issued{Key: plaintext, APIKey: key})
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// handleKey revokes the API key at /api/admin/keys/{id} with a DELETE.
+func (s *Server) handleKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.NotFound(w, r)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/keys/")
+		if err := s.cfg.keys.Revoke(id); errors.Is(err, ErrUnknownAPIKey) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.WithError(err).Error("Failed to revoke API key")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, "revoke api key", id, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
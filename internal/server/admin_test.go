@@ -0,0 +1,349 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestAdminLists(t *testing.T) {
+	access, err := NewAccessControl("", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(nil, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, access, nil, nil, BatchConfig{}, AdminConfig{Token: "secret"}))
+	router := s.setupRouter()
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("GET", "/api/admin/lists", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := request("GET", "/api/admin/lists", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := request("POST", "/api/admin/lists/deny", "secret", `{"entry": "bogus"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid entry: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := request("POST", "/api/admin/lists/deny", "secret", `{"entry": "198.51.100.0/24"}`); rec.Code != http.StatusOK {
+		t.Errorf("add entry: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !access.Denied("", "198.51.100.7") {
+		t.Error("entry added through the admin API is not denied")
+	}
+	request("POST", "/api/admin/lists/allow", "secret", `{"entry": "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"}`)
+	request("DELETE", "/api/admin/lists/deny?entry=198.51.100.0/24", "secret", "")
+
+	rec := request("GET", "/api/admin/lists", "secret", "")
+	var lists map[string][]string
+	if err := json.NewDecoder(rec.Body).Decode(&lists); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"allow": {"0xab5801a7d398351b8be11c439e05c5b3259aec9b"}, "deny": {}}
+	if !reflect.DeepEqual(lists, want) {
+		t.Errorf("lists = %v, want %v", lists, want)
+	}
+}
+
+func TestAdminKeys(t *testing.T) {
+	keys, err := NewKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(nil, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, keys, nil, BatchConfig{}, AdminConfig{Token: "secret"}))
+	router := s.setupRouter()
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("POST", "/api/admin/keys", `{"dailyClaims": 5}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("without name: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := request("POST", "/api/admin/keys", `{"name": "ci", "assets": ["xt"], "dailyClaims": 5, "hash": "ignored"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var issued struct {
+		Key    string `json:"key"`
+		APIKey APIKey `json:"apiKey"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&issued); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := keys.Authenticate(issued.Key); !ok || key.ID != issued.APIKey.ID || issued.APIKey.Hash != "" {
+		t.Errorf("issued key %+v does not authenticate as %s", issued.APIKey, issued.Key)
+	}
+
+	var listed struct {
+		Keys []APIKey `json:"keys"`
+	}
+	if err := json.NewDecoder(request("GET", "/api/admin/keys", "").Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Keys) != 1 || listed.Keys[0].Name != "ci" || listed.Keys[0].Hash != "" {
+		t.Errorf("keys = %+v, want the issued key without its hash", listed.Keys)
+	}
+
+	if rec := request("DELETE", "/api/admin/keys/"+issued.APIKey.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("revoke: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := request("DELETE", "/api/admin/keys/"+issued.APIKey.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("revoke twice: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	s.cfg.ledger.Add(ClaimRecord{Address: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", Symbol: "xt", Status: ClaimSent})
+	s.cfg.ledger.Add(ClaimRecord{Address: "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8", Symbol: "xt", Status: ClaimFailed})
+	var claims struct {
+		Claims []ClaimRecord `json:"claims"`
+	}
+	if err := json.NewDecoder(request("GET", "/api/admin/claims?status=sent", "").Body).Decode(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if len(claims.Claims) != 1 || claims.Claims[0].Status != ClaimSent {
+		t.Errorf("claims = %+v, want the sent claim", claims.Claims)
+	}
+}
+
+// adminRequest sends a request to the handler with the admin token and returns the response.
+func adminRequest(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminPause(t *testing.T) {
+	registry := newTestRegistry()
+	registry.Native().Cooldown = 0
+	s := NewServer(&fakeTxBuilder{}, &Settings{Registry: registry}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{Token: "secret"}))
+	router := s.setupRouter()
+
+	const alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+	tests := []struct {
+		name   string
+		target string
+		want   int
+		paused bool
+	}{
+		{name: "pause faucet", target: "/api/admin/pause", want: http.StatusServiceUnavailable, paused: true},
+		{name: "resume faucet", target: "/api/admin/resume", want: http.StatusOK},
+		{name: "pause asset", target: "/api/admin/pause?asset=XT", want: http.StatusServiceUnavailable},
+		{name: "resume asset", target: "/api/admin/resume?asset=xt", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := adminRequest(router, "POST", tt.target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200: %s", tt.name, rec.Code, rec.Body)
+		}
+		if got := postClaimFrom(router, "198.51.100.1:1", alice, "xt", ""); got != tt.want {
+			t.Errorf("%s: claim status = %d, want %d", tt.name, got, tt.want)
+		}
+		if info := s.info(); info.Paused != tt.paused || info.Assets[0].Enabled != (tt.want == http.StatusOK) {
+			t.Errorf("%s: info paused = %v, enabled = %v", tt.name, info.Paused, info.Assets[0].Enabled)
+		}
+	}
+	if rec := adminRequest(router, "POST", "/api/admin/pause?asset=nope", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown asset: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if s.current() != s.loaded {
+		t.Error("resuming everything did not restore the loaded settings")
+	}
+}
+
+func TestAdminAssets(t *testing.T) {
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	usdc.DailyCap = big.NewInt(5000000)
+	s := NewServer(&fakeTxBuilder{}, &Settings{Registry: newTestRegistry(usdc)}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{Token: "secret"}))
+	router := s.setupRouter()
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		want    int
+		payout  int64
+		minutes time.Duration
+	}{
+		{name: "payout and cooldown", method: "PATCH", body: `{"payout": "2", "minutes": 5}`, want: http.StatusOK, payout: 2000000, minutes: 5},
+		{name: "cooldown only", method: "PATCH", body: `{"minutes": 0}`, want: http.StatusOK, payout: 2000000},
+		{name: "above the daily cap", method: "PATCH", body: `{"payout": "6"}`, want: http.StatusBadRequest, payout: 2000000},
+		{name: "negative cooldown", method: "PATCH", body: `{"minutes": -1}`, want: http.StatusBadRequest, payout: 2000000},
+		{name: "invalid payout", method: "PATCH", body: `{"payout": "0.0000001"}`, want: http.StatusBadRequest, payout: 2000000},
+		{name: "restore", method: "DELETE", want: http.StatusOK, payout: 1000000, minutes: 60},
+	}
+	for _, tt := range tests {
+		if rec := adminRequest(router, tt.method, "/api/admin/assets/usdc", tt.body); rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+		asset, _ := s.resolve("usdc")
+		if asset.Payout.Int64() != tt.payout || asset.Quota.Int64() != tt.payout || asset.Cooldown != tt.minutes*time.Minute {
+			t.Errorf("%s: payout = %s, quota = %s, cooldown = %s", tt.name, asset.Payout, asset.Quota, asset.Cooldown)
+		}
+	}
+
+	// Overrides outlive config reloads.
+	adminRequest(router, "PATCH", "/api/admin/assets/usdc", `{"payout": "3"}`)
+	reloaded := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	if err := s.Reload(func() (*Settings, func(), error) { return &Settings{Registry: newTestRegistry(reloaded)}, nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	var status adminAssets
+	if err := json.NewDecoder(adminRequest(router, "GET", "/api/admin/assets", "").Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Assets) != 2 || status.Assets[1].Payout != "3" || status.Assets[1].Overrides.Payout != "3" {
+		t.Errorf("assets = %+v, want usdc paying out 3 after the reload", status.Assets)
+	}
+	if rec := adminRequest(router, "PATCH", "/api/admin/assets/nope", `{"minutes": 1}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown asset: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminCooldownReset(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	stores := map[string]func() LimiterStore{
+		"memory": func() LimiterStore { return NewMemoryStore() },
+		"redis": func() LimiterStore {
+			return NewRedisStore(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), "test:")
+		},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := NewServer(&fakeTxBuilder{}, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, store(), nil, nil, nil, BatchConfig{}, AdminConfig{Token: "secret"}))
+			router := s.setupRouter()
+
+			const alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+			postClaimFrom(router, "198.51.100.1:1", alice, "xt", "")
+			if got := postClaimFrom(router, "198.51.100.2:1", alice, "xt", ""); got != http.StatusTooManyRequests {
+				t.Fatalf("second claim status = %d, want 429", got)
+			}
+			if rec := adminRequest(router, "DELETE", "/api/admin/cooldowns/"+strings.ToLower(alice)+"?asset=xt", ""); rec.Code != http.StatusNoContent {
+				t.Fatalf("reset: status = %d, want 204: %s", rec.Code, rec.Body)
+			}
+			if got := postClaimFrom(router, "198.51.100.2:1", alice, "xt", ""); got != http.StatusOK {
+				t.Errorf("claim after the reset status = %d, want 200", got)
+			}
+			if rec := adminRequest(router, "DELETE", "/api/admin/cooldowns/0x123", ""); rec.Code != http.StatusBadRequest {
+				t.Errorf("invalid address: status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestAdminQueue(t *testing.T) {
+	tx := &fakeTxBuilder{}
+	s := NewServer(tx, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{Token: "secret"}))
+	router := s.setupRouter()
+
+	const alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+	tx.err = errors.New("nonce too low")
+	if got := postClaimFrom(router, "198.51.100.1:1", alice, "xt", ""); got != http.StatusInternalServerError {
+		t.Fatalf("claim status = %d, want 500", got)
+	}
+	tx.err = nil
+	failed := s.cfg.ledger.List(nil, 1)[0]
+
+	// Retried claims wait in the queue while the faucet is paused.
+	adminRequest(router, "POST", "/api/admin/pause", "")
+	if rec := adminRequest(router, "POST", "/api/admin/claims/"+failed.ID+"/retry", ""); rec.Code != http.StatusOK {
+		t.Fatalf("retry: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(router, "POST", "/api/admin/claims/"+failed.ID+"/retry", ""); rec.Code != http.StatusConflict {
+		t.Errorf("retry of a queued claim: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	s.consumeQueue()
+	var queue struct {
+		Claims []ClaimRecord `json:"claims"`
+	}
+	if err := json.NewDecoder(adminRequest(router, "GET", "/api/admin/queue", "").Body).Decode(&queue); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.Claims) != 1 || queue.Claims[0].ID != failed.ID || queue.Claims[0].Status != ClaimQueued {
+		t.Fatalf("queue = %+v, want the retried claim", queue.Claims)
+	}
+
+	if rec := adminRequest(router, "DELETE", "/api/admin/queue?id="+failed.ID, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), failed.ID) {
+		t.Fatalf("purge: status = %d: %s", rec.Code, rec.Body)
+	}
+	if record, _ := s.cfg.ledger.Get(failed.ID); record.Status != ClaimFailed || len(s.queue) != 0 || len(s.feed.queued()) != 0 {
+		t.Fatalf("purged claim = %+v, queue length = %d", record, len(s.queue))
+	}
+
+	adminRequest(router, "POST", "/api/admin/resume", "")
+	rec := adminRequest(router, "POST", "/api/admin/claims/"+failed.ID+"/retry", "")
+	var retried ClaimRecord
+	if err := json.NewDecoder(rec.Body).Decode(&retried); err != nil || retried.Status != ClaimSent || retried.TxHash == "" {
+		t.Errorf("retry: status = %d, claim = %+v, want a sent claim", rec.Code, retried)
+	}
+	if rec := adminRequest(router, "POST", "/api/admin/claims/nope/retry", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown claim: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	var audit struct {
+		Actions []AuditEntry `json:"actions"`
+	}
+	if err := json.NewDecoder(adminRequest(router, "GET", "/api/admin/audit?limit=2", "").Body).Decode(&audit); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Actions) != 2 || audit.Actions[0].Action != "retry claim" || audit.Actions[1].Action != "resume" || audit.Actions[0].Operator != "token" {
+		t.Errorf("audit = %+v, want the retry and the resume, newest first", audit.Actions)
+	}
+}
+
+func TestAdminClientCert(t *testing.T) {
+	admin := AdminConfig{Port: 8443, TLS: &tls.Config{ClientCAs: x509.NewCertPool()}}
+	s := NewServer(&fakeTxBuilder{}, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, admin))
+
+	rec := httptest.NewRecorder()
+	s.setupRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/api/admin/pause", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("public listener: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	handler := s.AdminHandler()
+	pause := func(cert *x509.Certificate) int {
+		req := httptest.NewRequest("POST", "/api/admin/pause", nil)
+		req.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if got := pause(nil); got != http.StatusUnauthorized {
+		t.Errorf("without a certificate: status = %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := pause(&x509.Certificate{Subject: pkix.Name{CommonName: "ops"}}); got != http.StatusOK {
+		t.Errorf("with a certificate: status = %d, want 200", got)
+	}
+	if actions := s.cfg.admin.Audit.List(0); len(actions) != 1 || actions[0].Operator != "cert:ops" {
+		t.Errorf("audit = %+v, want the pause by cert:ops", actions)
+	}
+}
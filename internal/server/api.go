@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes of the JSON API. Clients should branch on the code, as the message is meant
+// for people and may change.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeInvalidAddress       = "invalid_address"
+	CodeInvalidAmount        = "invalid_amount"
+	CodeUnknownAsset         = "unknown_asset"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeVerificationRequired = "verification_required"
+	CodeVerificationFailed   = "verification_failed"
+	CodeRateLimited          = "rate_limited"
+	CodeQueueFull            = "queue_full"
+	CodeInsufficientFunds    = "insufficient_faucet_funds"
+	CodeTransferFailed       = "transfer_failed"
+	CodeUnavailable          = "unavailable"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodePaused               = "paused"
+)
+
+// openAPI describes the JSON API.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// maxJSONBody caps the size of a JSON request body.
+const maxJSONBody = 1 << 16
+
+// maxFormBody caps the size of a v1 claim body, which is parsed as a form.
+const maxFormBody = 1 << 16
+
+// apiError is the body of a failed JSON API response, wrapped in {"error": ...}.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfter is the number of seconds to wait before a rate limited claim can succeed.
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// jsonAPIKey marks requests made through the JSON API in their context.
+type jsonAPIKey struct{}
+
+func wantsJSON(r *http.Request) bool {
+	return r.Context().Value(jsonAPIKey{}) != nil
+}
+
+// writeError replies to a JSON API request with the error code and message, and to a form
+// request with the plain text message, as v1 always has.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeAPIError(w, r, status, apiError{Code: code, Message: message})
+}
+
+// claimError is a claim rejected by the faucet, described for both the HTTP and gRPC APIs.
+type claimError struct {
+	status  int
+	code    string
+	message string
+	// wait is how long a rate limited claim has to wait before it can succeed, and limit and
+	// remaining are the quota it went over and what is left of it.
+	wait      time.Duration
+	limit     *big.Int
+	remaining *big.Int
+}
+
+func (e *claimError) retryAfter() int64 {
+	return int64(math.Ceil(e.wait.Seconds()))
+}
+
+// writeClaimError replies to a rejected claim. A rate limited claim carries the Retry-After
+// header and the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the quota
+// it went over.
+func writeClaimError(w http.ResponseWriter, r *http.Request, e *claimError) {
+	if e.wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(e.retryAfter(), 10))
+	}
+	if e.limit != nil {
+		w.Header().Set("RateLimit-Limit", e.limit.String())
+		w.Header().Set("RateLimit-Remaining", e.remaining.String())
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(e.retryAfter(), 10))
+	}
+	writeAPIError(w, r, e.status, apiError{Code: e.code, Message: e.message, RetryAfter: e.retryAfter()})
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, e apiError) {
+	if !wantsJSON(r) {
+		http.Error(w, e.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{"error": e})
+}
+
+// claimErrorCode tells an unknown asset apart from an invalid amount in the error of newClaim.
+func claimErrorCode(err error) string {
+	var unknown *UnknownAssetError
+	if errors.As(err, &unknown) {
+		return CodeUnknownAsset
+	}
+	return CodeInvalidAmount
+}
+
+// transferErrorCode tells a faucet account that ran dry apart from other failed transfers.
+func transferErrorCode(err error) string {
+	message := strings.ToLower(err.Error())
+	if strings.Contains(message, "insufficient funds") || strings.Contains(message, "exceeds balance") {
+		return CodeInsufficientFunds
+	}
+	return CodeTransferFailed
+}
+
+// claimResult is the JSON API view of a claim in the ledger.
+type claimResult struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Address   string    `json:"address"`
+	Asset     string    `json:"asset"`
+	Amount    string    `json:"amount"`
+	TxHash    string    `json:"txHash,omitempty"`
+	Block     uint64    `json:"block,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Position  int       `json:"position,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// claimResult describes a claim with its place in the queue while it is queued.
+func (s *Server) claimResult(record ClaimRecord) claimResult {
+	result := claimResult{
+		ID:        record.ID,
+		Status:    record.Status,
+		Address:   record.Address,
+		Asset:     record.Symbol,
+		Amount:    record.Amount,
+		TxHash:    record.TxHash,
+		Block:     record.Block,
+		Error:     record.Error,
+		CreatedAt: record.CreatedAt,
+		UpdatedAt: record.UpdatedAt,
+	}
+	if record.Status == ClaimQueued {
+		result.Position = s.feed.position(record.ID)
+	}
+	return result
+}
+
+// jsonAPI marks requests to a route of the JSON API, so errors are written as JSON even
+// before its handler runs, as for an invalid API key.
+func jsonAPI(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(w, r.WithContext(context.WithValue(r.Context(), jsonAPIKey{}, true)))
+}
+
+// formClaim caps the body of a v1 claim before the guards and the limiter read its form.
+func formClaim(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBody)
+	next(w, r)
+}
+
+// jsonClaim accepts a claim with a JSON body such as {"address": "0x...", "asset": "usdc"}.
+// The fields are handed to the guards and the limiter as the form fields they already read,
+// so v1 and v2 claims go through the same checks, and replies are written as JSON.
+func jsonClaim(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	r = r.WithContext(context.WithValue(r.Context(), jsonAPIKey{}, true))
+	if r.Method != "POST" {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeInvalidRequest, "claims must be posted")
+		return
+	}
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody)).Decode(&body); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "request body must be a JSON object")
+		return
+	}
+	form := url.Values{}
+	for name, raw := range body {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			// Numbers such as an amount of 0.5 are kept verbatim.
+			text = string(raw)
+		}
+		form.Set(name, text)
+	}
+	if asset := form.Get("asset"); asset != "" && form.Get(SymbolKey) == "" {
+		form.Set(SymbolKey, asset)
+	}
+	r.Form, r.PostForm = form, form
+	next(w, r)
+}
+
+// handleClaimStatus returns the claim at /api/v2/claims/{id}, and streams its events at
+// /api/v2/claims/{id}/events.
+func (s *Server) handleClaimStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), jsonAPIKey{}, true))
+		if r.Method != "GET" {
+			writeError(w, r, http.StatusMethodNotAllowed, CodeInvalidRequest, "claims must be fetched with GET")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/v2/claims/")
+		if strings.HasSuffix(id, "/events") {
+			s.handleClaimEvents(w, r, strings.TrimSuffix(id, "/events"))
+			return
+		}
+		record, ok := s.cfg.ledger.Get(id)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "unknown claim")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.claimResult(record))
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of the JSON API.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
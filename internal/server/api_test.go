@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// fakeTxBuilder pays out the native asset, or fails with err.
+type fakeTxBuilder struct {
+	err error
+}
+
+func (f *fakeTxBuilder) Sender() common.Address { return common.HexToAddress("0x1") }
+func (f *fakeTxBuilder) ChainID() *big.Int      { return big.NewInt(1337) }
+func (f *fakeTxBuilder) Transfer(context.Context, string, *big.Int) (common.Hash, error) {
+	if f.err != nil {
+		return common.Hash{}, f.err
+	}
+	return common.HexToHash("0xabc"), nil
+}
+
+func TestClaimV2(t *testing.T) {
+	tx := &fakeTxBuilder{}
+	s := NewServer(tx, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 0, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	router := s.setupRouter()
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+		carol = "0x6eBE9511781cE5a000D29C1963158838278e274E"
+		dave  = "0x7A9772Dda42b938aE9d8f19b7d14AA1f0dae939e"
+	)
+	tests := []struct {
+		name      string
+		body      string
+		txErr     error
+		busy      bool
+		want      int
+		wantCode  string
+		wantRetry bool
+	}{
+		{name: "not json", body: `address=` + alice, want: http.StatusBadRequest, wantCode: CodeInvalidRequest},
+		{name: "invalid address", body: `{"address": "0x1"}`, want: http.StatusBadRequest, wantCode: CodeInvalidAddress},
+		{name: "unknown asset", body: `{"address": "` + alice + `", "asset": "doge"}`, want: http.StatusBadRequest, wantCode: CodeUnknownAsset},
+		{name: "invalid amount", body: `{"address": "` + alice + `", "amount": 7}`, want: http.StatusBadRequest, wantCode: CodeInvalidAmount},
+		{name: "sent", body: `{"address": "` + alice + `", "asset": "xt", "amount": 1}`, want: http.StatusOK},
+		{name: "rate limited", body: `{"address": "` + alice + `"}`, want: http.StatusTooManyRequests, wantCode: CodeRateLimited, wantRetry: true},
+		{name: "insufficient funds", body: `{"address": "` + bob + `"}`, txErr: errors.New("insufficient funds for gas * price + value"),
+			want: http.StatusInternalServerError, wantCode: CodeInsufficientFunds},
+		{name: "transfer failed", body: `{"address": "` + carol + `"}`, txErr: errors.New("nonce too low"),
+			want: http.StatusInternalServerError, wantCode: CodeTransferFailed},
+		{name: "queue full", body: `{"address": "` + dave + `"}`, busy: true, want: http.StatusServiceUnavailable, wantCode: CodeQueueFull},
+	}
+	for _, tt := range tests {
+		tx.err = tt.txErr
+		if tt.busy {
+			s.mutex.Lock()
+		}
+		req := httptest.NewRequest("POST", "/api/v2/claim", strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if tt.busy {
+			s.mutex.Unlock()
+		}
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+			continue
+		}
+		if tt.wantCode == "" {
+			var result claimResult
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != ClaimSent || result.TxHash != common.HexToHash("0xabc").Hex() || result.ID != rec.Header().Get("X-Claim-Id") {
+				t.Errorf("%s: result = %+v, want a sent claim", tt.name, result)
+			}
+			continue
+		}
+		var body struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != tt.wantCode || (body.Error.RetryAfter > 0) != tt.wantRetry {
+			t.Errorf("%s: error = %+v, want code %s", tt.name, body.Error, tt.wantCode)
+		}
+		if tt.wantRetry && (rec.Header().Get("Retry-After") == "" || rec.Header().Get("RateLimit-Limit") != chain.EtherToWei(1).String() ||
+			rec.Header().Get("RateLimit-Remaining") != "0" || rec.Header().Get("RateLimit-Reset") != rec.Header().Get("Retry-After")) {
+			t.Errorf("%s: headers = %v, want Retry-After and RateLimit headers", tt.name, rec.Header())
+		}
+	}
+}
+
+func TestClaimStatusV2(t *testing.T) {
+	s := NewServer(nil, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	router := s.setupRouter()
+	record := s.cfg.ledger.Add(ClaimRecord{Address: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", Symbol: "xt", Amount: "1", Status: ClaimQueued, ClientIP: "192.0.2.1"})
+
+	tests := []struct {
+		name string
+		id   string
+		want int
+	}{
+		{name: "known claim", id: record.ID, want: http.StatusOK},
+		{name: "unknown claim", id: "bogus", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v2/claims/"+tt.id, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if strings.Contains(rec.Body.String(), "192.0.2.1") {
+			t.Errorf("%s: response leaks the client IP: %s", tt.name, rec.Body)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	s := NewServer(nil, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, &KeyStore{}, nil, BatchConfig{MaxItems: 1}, AdminConfig{}))
+	router := s.setupRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	var doc struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI == "" || len(doc.Paths) == 0 {
+		t.Fatalf("document = %+v, want an OpenAPI document with paths", doc)
+	}
+	for path := range doc.Paths {
+		target := strings.ReplaceAll(path, "{id}", "abc")
+		if _, pattern := router.Handler(httptest.NewRequest("GET", target, nil)); pattern == "" || pattern == "/" {
+			t.Errorf("documented path %s is not routed", path)
+		}
+	}
+}
+
+func TestClaimV1BodyLimit(t *testing.T) {
+	s := NewServer(&fakeTxBuilder{}, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 0, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	router := s.setupRouter()
+
+	// The address comes after the limit, so it is never read.
+	body := "pad=" + strings.Repeat("x", maxFormBody) + "&address=0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+	req := httptest.NewRequest("POST", "/api/claim", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || len(s.cfg.ledger.List(nil, 0)) != 0 {
+		t.Errorf("oversized claim: status = %d, want %d and nothing recorded: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+}
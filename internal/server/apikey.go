@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/negroni"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// APIKeyHeader is the request header carrying an API key.
+const APIKeyHeader = "X-API-Key"
+
+// ErrUnknownAPIKey is returned when revoking a key that doesn't exist.
+var ErrUnknownAPIKey = errors.New("unknown api key")
+
+// apiKeyPrefix marks the plaintext of an API key so it is easy to spot in configs and logs.
+const apiKeyPrefix = "fk_"
+
+// APIKey is an issued key for programmatic clients. Only the SHA-256 hash of the key is
+// kept. Claims made with a key skip the anti-bot guards and the public per-client quotas, and
+// are limited by the key's own daily claims and amounts instead.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Hash string `json:"hash,omitempty"`
+	// Assets lists the symbols the key may claim, or all assets if empty.
+	Assets []string `json:"assets,omitempty"`
+	// DailyClaims caps the claims made with the key in a rolling 24 hours. Zero means no cap.
+	DailyClaims int `json:"dailyClaims,omitempty"`
+	// DailyAmounts caps the amount of an asset claimed with the key in a rolling 24 hours.
+	DailyAmounts map[string]Amount `json:"dailyAmounts,omitempty"`
+	CreatedAt    time.Time         `json:"createdAt"`
+}
+
+// allows reports whether the key may claim the asset.
+func (k *APIKey) allows(symbol string) bool {
+	if len(k.Assets) == 0 {
+		return true
+	}
+	for _, allowed := range k.Assets {
+		if strings.EqualFold(allowed, symbol) {
+			return true
+		}
+	}
+	return false
+}
+
+// check verifies the daily amounts of the key against the decimals of the assets in the
+// registry.
+func (k *APIKey) check(registry *Registry) error {
+	// Without a registry, as when the keys file is edited offline, the decimals of the assets
+	// are unknown, so the amounts are left for the faucet to check when it loads the file.
+	if registry == nil {
+		return nil
+	}
+	for symbol, amount := range k.DailyAmounts {
+		asset, ok := registry.lookup(symbol)
+		if !ok {
+			return fmt.Errorf("daily amount of unknown asset %q", symbol)
+		}
+		if _, err := chain.ParseUnits(string(amount), asset.Decimals); err != nil {
+			return fmt.Errorf("invalid daily amount of %s: %w", symbol, err)
+		}
+	}
+	return nil
+}
+
+// KeyStore holds the issued API keys, optionally backed by a JSON file.
+type KeyStore struct {
+	mutex  sync.RWMutex
+	path   string
+	keys   map[string]*APIKey
+	hashes map[string]*APIKey
+}
+
+// NewKeyStore loads the keys from the file. An empty path keeps keys in memory only, and a
+// file that doesn't exist yet starts out without keys.
+func NewKeyStore(path string) (*KeyStore, error) {
+	k := &KeyStore{path: path, keys: map[string]*APIKey{}, hashes: map[string]*APIKey{}}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Paths returns the file backing the store.
+func (k *KeyStore) Paths() []string {
+	if k.path == "" {
+		return nil
+	}
+	return []string{k.path}
+}
+
+// Reload reads the keys from the file again, without checking their daily amounts.
+func (k *KeyStore) Reload() error {
+	apply, err := k.Prepare(nil)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare reads the keys from the file again, checks their daily amounts against the assets
+// of the registry, and returns a function that swaps them in, so they can be applied together
+// with the rest of a config reload. The registry may be nil.
+func (k *KeyStore) Prepare(registry *Registry) (func(), error) {
+	if k.path == "" {
+		return func() {}, nil
+	}
+	data, err := ioutil.ReadFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		data = []byte("[]")
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*APIKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("api keys %s: %w", k.path, err)
+	}
+
+	keys, hashes := make(map[string]*APIKey, len(list)), make(map[string]*APIKey, len(list))
+	for _, key := range list {
+		if key.ID == "" || key.Hash == "" {
+			return nil, fmt.Errorf("api keys %s: every key needs an id and a hash", k.path)
+		}
+		if err := key.check(registry); err != nil {
+			return nil, fmt.Errorf("api keys %s: key %s: %w", k.path, key.ID, err)
+		}
+		keys[key.ID], hashes[key.Hash] = key, key
+	}
+	return func() {
+		k.mutex.Lock()
+		k.keys, k.hashes = keys, hashes
+		k.mutex.Unlock()
+	}, nil
+}
+
+// Create issues a key with the name and limits of the spec. The plaintext key is returned
+// once and can't be recovered later. Its daily amounts are checked against the assets of the
+// registry, which may be nil.
+func (k *KeyStore) Create(spec APIKey, registry *Registry) (string, APIKey, error) {
+	if spec.Name == "" {
+		return "", APIKey{}, errors.New("api key needs a name")
+	}
+	if spec.DailyClaims < 0 {
+		return "", APIKey{}, fmt.Errorf("daily claims must not be negative, got %d", spec.DailyClaims)
+	}
+	if err := spec.check(registry); err != nil {
+		return "", APIKey{}, err
+	}
+
+	secret := make([]byte, 32)
+	id := make([]byte, 6)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", APIKey{}, err
+	}
+	plaintext := apiKeyPrefix + hex.EncodeToString(secret)
+	key := spec
+	key.ID = hex.EncodeToString(id)
+	key.Hash = hashAPIKey(plaintext)
+	key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys[key.ID], k.hashes[key.Hash] = &key, &key
+	if err := k.save(); err != nil {
+		delete(k.keys, key.ID)
+		delete(k.hashes, key.Hash)
+		return "", APIKey{}, err
+	}
+	return plaintext, key, nil
+}
+
+// Revoke deletes the key with the ID.
+func (k *KeyStore) Revoke(id string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownAPIKey, id)
+	}
+	delete(k.keys, id)
+	delete(k.hashes, key.Hash)
+	if err := k.save(); err != nil {
+		k.keys[id], k.hashes[key.Hash] = key, key
+		return err
+	}
+	return nil
+}
+
+// List returns the keys ordered by creation, without their hashes.
+func (k *KeyStore) List() []APIKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	keys := []APIKey{}
+	for _, key := range k.keys {
+		listed := *key
+		listed.Hash = ""
+		keys = append(keys, listed)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Authenticate returns the key the plaintext belongs to.
+func (k *KeyStore) Authenticate(plaintext string) (*APIKey, bool) {
+	if k == nil || !strings.HasPrefix(plaintext, apiKeyPrefix) {
+		return nil, false
+	}
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	key, ok := k.hashes[hashAPIKey(plaintext)]
+	return key, ok
+}
+
+// save writes the keys to the file, replacing it atomically. The caller holds the lock.
+func (k *KeyStore) save() error {
+	if k.path == "" {
+		return nil
+	}
+	list := make([]*APIKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		list = append(list, key)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(k.path), filepath.Base(k.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
+
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyCtxKey is the request context key of the API key a claim was made with.
+type apiKeyCtxKey struct{}
+
+// apiKeyFrom returns the API key a claim was made with, or nil.
+func apiKeyFrom(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyCtxKey{}).(*APIKey)
+	return key
+}
+
+// apiKeyAuth authenticates the API key of a claim, if it carries one, and passes the key on
+// in the request context.
+type apiKeyAuth struct {
+	keys *KeyStore
+}
+
+func (a apiKeyAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	plaintext := r.Header.Get(APIKeyHeader)
+	if plaintext == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+	key, ok := a.keys.Authenticate(plaintext)
+	if !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "invalid api key")
+		return
+	}
+	log.WithField("apiKey", key.ID).Debug("Claim made with an API key")
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, key)))
+}
+
+// skipForAPIKey lets claims made with an API key bypass an anti-bot guard.
+func skipForAPIKey(guard Guard) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if apiKeyFrom(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		guard.ServeHTTP(w, r, next)
+	}
+}
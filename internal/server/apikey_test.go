@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/negroni"
+)
+
+// rejectAll is a guard that turns every claim away.
+type rejectAll struct{}
+
+func (rejectAll) Name() string        { return "reject" }
+func (rejectAll) Public() interface{} { return nil }
+func (rejectAll) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	http.Error(w, "rejected", http.StatusForbidden)
+}
+
+func TestKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	keys, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keys.Create(APIKey{}, nil); err == nil {
+		t.Error("Create() without a name succeeded")
+	}
+	plaintext, key, err := keys.Create(APIKey{Name: "ci", Assets: []string{"usdc"}, DailyClaims: 5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plaintext, apiKeyPrefix) || strings.Contains(key.Hash, plaintext) {
+		t.Errorf("Create() = %q with hash %q, want a prefixed key stored as a hash", plaintext, key.Hash)
+	}
+
+	reloaded, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reloaded.Authenticate(plaintext); !ok || got.ID != key.ID || got.DailyClaims != 5 {
+		t.Errorf("Authenticate() after reload = %+v, %v, want key %s", got, ok, key.ID)
+	}
+	if _, ok := reloaded.Authenticate(plaintext + "0"); ok {
+		t.Error("Authenticate() accepted a wrong key")
+	}
+	if listed := reloaded.List(); len(listed) != 1 || listed[0].Hash != "" {
+		t.Errorf("List() = %+v, want one key without its hash", listed)
+	}
+
+	if err := reloaded.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Revoke(key.ID); !errors.Is(err, ErrUnknownAPIKey) {
+		t.Errorf("Revoke() twice = %v, want %v", err, ErrUnknownAPIKey)
+	}
+	if err := keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys.Authenticate(plaintext); ok {
+		t.Error("Authenticate() accepted a revoked key")
+	}
+}
+
+func TestKeyDailyAmounts(t *testing.T) {
+	registry := newTestRegistry(newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86"))
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	keys, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		amounts map[string]Amount
+		wantErr bool
+	}{
+		{name: "within decimals", amounts: map[string]Amount{"USDC": "1.5"}},
+		{name: "too many decimals", amounts: map[string]Amount{"usdc": "1.0000001"}, wantErr: true},
+		{name: "not a number", amounts: map[string]Amount{"usdc": "lots"}, wantErr: true},
+		{name: "unknown asset", amounts: map[string]Amount{"dai": "1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, _, err := keys.Create(APIKey{Name: "ci", DailyAmounts: tt.amounts}, registry); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Create() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Without the registry, as offline, the amounts are not checked, and the faucet refuses the
+	// file when it loads it.
+	if _, _, err := keys.Create(APIKey{Name: "ci", DailyAmounts: map[string]Amount{"usdc": "1.0000001"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Prepare(registry); err == nil {
+		t.Error("Prepare() accepted a daily amount with too many decimals")
+	}
+
+	// A key that no longer fits the asset is refused rather than left without its quota.
+	key := &APIKey{ID: "bot", DailyAmounts: map[string]Amount{"usdc": "0.0000001"}}
+	if _, rejected := keyScopes(key, registry.Native(), big.NewInt(1)); rejected != nil {
+		t.Errorf("keyScopes() of another asset = %+v, want no rejection", rejected)
+	}
+	usdc, _ := registry.Resolve("usdc")
+	if _, rejected := keyScopes(key, usdc, big.NewInt(1)); rejected == nil || rejected.status != http.StatusForbidden {
+		t.Errorf("keyScopes() = %+v, want the claim rejected", rejected)
+	}
+}
+
+func TestAPIKeyClaims(t *testing.T) {
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	usdc.DailyCap = big.NewInt(10000000)
+	settings := &Settings{Registry: newTestRegistry(usdc)}
+
+	keys, err := NewKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, _, err := keys.Create(APIKey{Name: "ci", Assets: []string{"usdc"}, DailyClaims: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget, _, err := keys.Create(APIKey{Name: "bot", DailyAmounts: map[string]Amount{"usdc": "2"}}, settings.Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := NewLimiter(nil, nil, ClientIPConfig{}, func() *Settings { return settings })
+	handler := negroni.New(apiKeyAuth{keys: keys}, skipForAPIKey(rejectAll{}), limiter)
+	handler.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	const alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+	tests := []struct {
+		name   string
+		key    string
+		symbol string
+		want   int
+	}{
+		{name: "without key", symbol: "usdc", want: http.StatusForbidden},
+		{name: "invalid key", key: "fk_bogus", symbol: "usdc", want: http.StatusUnauthorized},
+		{name: "asset not allowed", key: limited, symbol: "xt", want: http.StatusForbidden},
+		{name: "first claim", key: limited, symbol: "usdc", want: http.StatusOK},
+		{name: "past address quota", key: limited, symbol: "usdc", want: http.StatusOK},
+		{name: "third claim", key: limited, symbol: "usdc", want: http.StatusOK},
+		{name: "daily claims", key: limited, symbol: "usdc", want: http.StatusTooManyRequests},
+		{name: "other key", key: budget, symbol: "usdc", want: http.StatusOK},
+		{name: "other key again", key: budget, symbol: "usdc", want: http.StatusOK},
+		{name: "daily amount", key: budget, symbol: "usdc", want: http.StatusTooManyRequests},
+		{name: "unrestricted asset", key: budget, symbol: "xt", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		form := url.Values{AddressKey: {alice}, SymbolKey: {tt.symbol}}
+		req := httptest.NewRequest("POST", "/api/claim", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.key != "" {
+			req.Header.Set(APIKeyHeader, tt.key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultAuditSize is how many admin actions an audit log keeps when none is configured.
+const defaultAuditSize = 1000
+
+// AuditEntry records an action taken through the admin API.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Operator is "token" for the admin token, or "cert:" and the common name of the client
+	// certificate the action was authorized with.
+	Operator string `json:"operator"`
+	ClientIP string `json:"clientIP,omitempty"`
+	Action   string `json:"action"`
+	Target   string `json:"target,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// AuditLog keeps the most recent admin actions in memory, and appends every action as a JSON
+// line to an optional writer.
+type AuditLog struct {
+	mutex    sync.RWMutex
+	entries  []AuditEntry
+	capacity int
+	out      io.Writer
+	now      func() time.Time
+}
+
+// NewAuditLog creates an audit log holding up to capacity actions. The writer may be nil.
+func NewAuditLog(capacity int, out io.Writer) *AuditLog {
+	return &AuditLog{capacity: capacity, out: out, now: time.Now}
+}
+
+// Record adds an action and returns it with its time.
+func (a *AuditLog) Record(entry AuditEntry) AuditEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	entry.Time = a.now()
+	a.entries = append(a.entries, entry)
+	if a.capacity > 0 && len(a.entries) > a.capacity {
+		a.entries = a.entries[1:]
+	}
+	log.WithFields(log.Fields{
+		"operator": entry.Operator,
+		"clientIP": entry.ClientIP,
+		"target":   entry.Target,
+		"detail":   entry.Detail,
+	}).Infof("Admin action %s", entry.Action)
+	if a.out != nil {
+		data, _ := json.Marshal(entry)
+		if _, err := a.out.Write(append(data, '\n')); err != nil {
+			log.WithError(err).Error("Failed to write admin audit log")
+		}
+	}
+	return entry
+}
+
+// List returns up to limit actions, newest first. A limit of zero returns all of them.
+func (a *AuditLog) List(limit int) []AuditEntry {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	entries := []AuditEntry{}
+	for i := len(a.entries) - 1; i >= 0; i-- {
+		entries = append(entries, a.entries[i])
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+	}
+	return entries
+}
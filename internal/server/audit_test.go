@@ -0,0 +1,43 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var out bytes.Buffer
+	audit := NewAuditLog(2, &out)
+	for _, action := range []string{"pause", "update asset", "resume"} {
+		audit.Record(AuditEntry{Operator: "token", Action: action, Target: "xt"})
+	}
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{limit: 0, want: []string{"resume", "update asset"}},
+		{limit: 1, want: []string{"resume"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, entry := range audit.List(tt.limit) {
+			got = append(got, entry.Action)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("List(%d) = %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+
+	// The writer gets every action, including the ones no longer kept in memory.
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("audit log has %d lines, want 3", len(lines))
+	}
+	var first AuditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.Action != "pause" || first.Time.IsZero() {
+		t.Errorf("first line = %s, %v, want the pause with its time", lines[0], err)
+	}
+}
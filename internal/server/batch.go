@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// Statuses of a batch job, derived from the statuses of its claims.
+const (
+	BatchQueued    = "queued"
+	BatchCompleted = "completed"
+	BatchPartial   = "partial"
+	BatchFailed    = "failed"
+)
+
+// batchRetention is how long a finished batch job can still be looked up.
+const batchRetention = 24 * time.Hour
+
+// batchJob is a list of claims made in one batch request, paid out together.
+type batchJob struct {
+	id      string
+	key     string
+	created time.Time
+	claims  []claim
+}
+
+// batchJobs keeps the batch jobs of the last batchRetention so they can be looked up by ID.
+type batchJobs struct {
+	mutex sync.Mutex
+	jobs  map[string]*batchJob
+}
+
+func (b *batchJobs) add(job *batchJob) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.jobs == nil {
+		b.jobs = make(map[string]*batchJob)
+	}
+	for id, old := range b.jobs {
+		if job.created.Sub(old.created) > batchRetention {
+			delete(b.jobs, id)
+		}
+	}
+	b.jobs[job.id] = job
+}
+
+func (b *batchJobs) get(id string) (*batchJob, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job, ok := b.jobs[id]
+	return job, ok
+}
+
+// maxBatchItemBody caps the size of a batch request body per item it may hold, which leaves
+// plenty of room for an address, an asset and an amount.
+const maxBatchItemBody = 1 << 10
+
+// batchItem is one claim of a batch request, and its outcome in the response.
+type batchItem struct {
+	Address string `json:"address"`
+	Asset   string `json:"asset"`
+	Amount  string `json:"amount,omitempty"`
+	ClaimID string `json:"claimId,omitempty"`
+	Status  string `json:"status,omitempty"`
+	TxHash  string `json:"txHash,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type batchStatus struct {
+	ID     string      `json:"id"`
+	Status string      `json:"status"`
+	Items  []batchItem `json:"items"`
+}
+
+// handleBatch accepts a batch of claims with a POST to /api/batch, and returns the progress
+// of a batch job with a GET of /api/batch/{id}. Both need the API key the batch is made with.
+func (s *Server) handleBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFrom(r.Context())
+		if key == nil {
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "an API key is required for batch claims")
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/api/batch":
+			s.submitBatch(w, r, key)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/batch/"):
+			job, ok := s.batches.get(strings.TrimPrefix(r.URL.Path, "/api/batch/"))
+			if !ok || job.key != key.ID {
+				writeError(w, r, http.StatusNotFound, CodeNotFound, "unknown batch")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.batchStatus(job))
+		default:
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "batches are submitted with a POST to /api/batch")
+		}
+	}
+}
+
+// submitBatch validates every item of a batch and, if all of them are valid and within the
+// rate limits, enqueues them as one job.
+func (s *Server) submitBatch(w http.ResponseWriter, r *http.Request, key *APIKey) {
+	var body struct {
+		Items []batchItem `json:"items"`
+	}
+	// One more item makes room for the object around the items.
+	limit := int64(s.cfg.batch.MaxItems+1) * maxBatchItemBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(&body); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "request body must be a JSON object with items")
+		return
+	}
+	if len(body.Items) == 0 || len(body.Items) > s.cfg.batch.MaxItems {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("a batch needs between 1 and %d items", s.cfg.batch.MaxItems))
+		return
+	}
+
+	if rejected := pausedError(s.current(), nil); rejected != nil {
+		writeClaimError(w, r, rejected)
+		return
+	}
+
+	clientIP := s.cfg.clientIP.ClientIP(r)
+	claims := make([]claim, len(body.Items))
+	var invalid []batchItem
+	for i, item := range body.Items {
+		c, err := s.batchClaim(item, key, clientIP)
+		if err != nil {
+			item.Status, item.Error = ClaimFailed, err.Error()
+			invalid = append(invalid, item)
+			continue
+		}
+		claims[i] = c
+	}
+	if len(invalid) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string][]batchItem{"errors": invalid})
+		return
+	}
+
+	now := time.Now()
+	reservations, rejected, err := s.limiter.reserveBatch(r.Context(), key, clientIP, claims, now)
+	if err != nil {
+		log.WithError(err).Error("Failed to check the rate limits of a batch")
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "rate limits are unavailable, please try again later")
+		return
+	}
+	if rejected != nil {
+		writeClaimError(w, r, rejected)
+		return
+	}
+
+	job := &batchJob{id: newClaimID(), key: key.ID, created: now, claims: claims}
+	for i := range job.claims {
+		job.claims[i] = s.record(r.Context(), job.claims[i], clientIP, job.id)
+	}
+	select {
+	case s.jobs <- job:
+	default:
+		log.Warn("Max queue capacity reached")
+		for _, c := range job.claims {
+			s.settle(c, common.Hash{}, fmt.Errorf("queue is full"))
+		}
+		if err := s.limiter.store.Release(r.Context(), reservations, now); err != nil {
+			log.WithError(err).Error("Failed to refund the rate limits of a dropped batch")
+		}
+		writeClaimError(w, r, &claimError{status: http.StatusServiceUnavailable, code: CodeQueueFull, message: "Faucet queue is too long, please try again later"})
+		return
+	}
+	s.batches.add(job)
+	log.WithFields(log.Fields{
+		"batch":  job.id,
+		"apiKey": key.ID,
+		"items":  len(claims),
+	}).Info("Added batch to queue successfully")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(s.batchStatus(job))
+}
+
+// batchClaim checks one item of a batch made with the API key.
+func (s *Server) batchClaim(item batchItem, key *APIKey, clientIP string) (claim, error) {
+	if !chain.IsValidAddress(item.Address, true) {
+		return claim{}, fmt.Errorf("invalid address")
+	}
+	if s.cfg.access.Denied(item.Address, clientIP) {
+		return claim{}, fmt.Errorf("address is not allowed to use the faucet")
+	}
+	c, err := s.newClaim(item.Address, item.Asset, item.Amount)
+	if err != nil {
+		return claim{}, err
+	}
+	if !key.allows(c.asset.Symbol) {
+		return claim{}, fmt.Errorf("this API key may not claim %s", c.asset.Symbol)
+	}
+	if c.asset.Paused {
+		return claim{}, fmt.Errorf("%s claims are paused", c.asset.Symbol)
+	}
+	return c, nil
+}
+
+// batchStatus reports the progress of a job from the ledger records of its claims.
+func (s *Server) batchStatus(job *batchJob) batchStatus {
+	status := batchStatus{ID: job.id, Items: make([]batchItem, len(job.claims))}
+	var sent, failed int
+	for i, c := range job.claims {
+		item := batchItem{
+			Address: c.address,
+			Asset:   c.asset.Symbol,
+			Amount:  chain.FormatUnits(c.amount, c.asset.Decimals),
+			ClaimID: c.id,
+		}
+		if record, ok := s.cfg.ledger.Get(c.id); ok {
+			item.Status, item.TxHash, item.Error = record.Status, record.TxHash, record.Error
+		}
+		switch item.Status {
+		case ClaimSent, ClaimMined:
+			sent++
+		case ClaimFailed:
+			failed++
+		}
+		status.Items[i] = item
+	}
+	switch {
+	case sent+failed < len(job.claims):
+		status.Status = BatchQueued
+	case failed == 0:
+		status.Status = BatchCompleted
+	case sent == 0:
+		status.Status = BatchFailed
+	default:
+		status.Status = BatchPartial
+	}
+	return status
+}
+
+// payBatch pays out the claims of a job. With a multisend contract, the claims of each asset
+// are paid with one transaction, otherwise one by one.
+func (s *Server) payBatch(ctx context.Context, job *batchJob) {
+	multisend := s.cfg.batch.MultiSend
+	if multisend == nil {
+		for _, c := range job.claims {
+			txHash, err := s.transfer(ctx, c)
+			s.settle(c, txHash, err)
+		}
+		return
+	}
+
+	groups := make(map[string][]claim)
+	var symbols []string
+	for _, c := range job.claims {
+		if _, ok := groups[c.asset.Symbol]; !ok {
+			symbols = append(symbols, c.asset.Symbol)
+		}
+		groups[c.asset.Symbol] = append(groups[c.asset.Symbol], c)
+	}
+	for _, symbol := range symbols {
+		group := groups[symbol]
+		asset := group[0].asset
+		recipients := make([]common.Address, len(group))
+		values := make([]*big.Int, len(group))
+		for i, c := range group {
+			recipients[i], values[i] = common.HexToAddress(c.address), c.amount
+		}
+
+		var (
+			txHash common.Hash
+			err    error
+		)
+		if asset.IsNative() {
+			txHash, err = multisend.DisperseEther(ctx, recipients, values)
+		} else {
+			txHash, err = multisend.DisperseToken(ctx, *asset.Contract, recipients, values)
+		}
+		if err != nil {
+			log.WithError(err).WithField("batch", job.id).Error("Failed to multisend batch")
+		}
+		for _, c := range group {
+			s.settle(c, txHash, err)
+		}
+	}
+}
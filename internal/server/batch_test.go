@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// fakeMultiSend records the recipients of every multisend by token, with the zero address
+// standing for the native asset.
+type fakeMultiSend struct {
+	sent map[common.Address][]common.Address
+}
+
+func (f *fakeMultiSend) DisperseEther(_ context.Context, recipients []common.Address, _ []*big.Int) (common.Hash, error) {
+	return f.disperse(common.Address{}, recipients)
+}
+
+func (f *fakeMultiSend) DisperseToken(_ context.Context, token common.Address, recipients []common.Address, _ []*big.Int) (common.Hash, error) {
+	return f.disperse(token, recipients)
+}
+
+func (f *fakeMultiSend) disperse(token common.Address, recipients []common.Address) (common.Hash, error) {
+	f.sent[token] = append(f.sent[token], recipients...)
+	return common.BytesToHash(token.Bytes()), nil
+}
+
+func TestBatch(t *testing.T) {
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	keys, err := NewKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, _, err := keys.Create(APIKey{Name: "ci", DailyClaims: 4}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multisend := &fakeMultiSend{sent: map[common.Address][]common.Address{}}
+	s := NewServer(nil, &Settings{Registry: newTestRegistry(usdc)}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, keys, nil,
+		BatchConfig{MaxItems: 3, MultiSend: multisend}, AdminConfig{}))
+	router := s.setupRouter()
+
+	request := func(method, target, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+		carol = "0x6eBE9511781cE5a000D29C1963158838278e274E"
+	)
+	batch := `{"items": [{"address": "` + alice + `", "asset": "xt"}, {"address": "` + bob + `", "asset": "xt"}, {"address": "` + carol + `", "asset": "usdc"}]}`
+	tests := []struct {
+		name string
+		key  string
+		body string
+		want int
+		// code is the error code of a request rejected as a whole.
+		code string
+	}{
+		{name: "without key", body: batch, want: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "invalid key", key: "fk_bogus", body: batch, want: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "invalid body", key: plaintext, body: `[]`, want: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "body too large", key: plaintext, body: `{"items": [{"address": "` + strings.Repeat("0", 5*maxBatchItemBody) + `"}]}`, want: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "empty batch", key: plaintext, body: `{"items": []}`, want: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "too many items", key: plaintext, body: `{"items": [{}, {}, {}, {}]}`, want: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "invalid item", key: plaintext, body: `{"items": [{"address": "` + alice + `", "asset": "doge"}]}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := request("POST", "/api/batch", tt.key, tt.body)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if tt.code == "" {
+			continue
+		}
+		var body struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error.Code != tt.code {
+			t.Errorf("%s: error = %+v, %v, want code %s", tt.name, body.Error, err, tt.code)
+		}
+	}
+
+	rec := request("POST", "/api/batch", plaintext, batch)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("submit: status = %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	var submitted batchStatus
+	if err := json.NewDecoder(rec.Body).Decode(&submitted); err != nil {
+		t.Fatal(err)
+	}
+	if submitted.Status != BatchQueued || len(submitted.Items) != 3 || submitted.Items[0].ClaimID == "" {
+		t.Errorf("submitted = %+v, want three queued items", submitted)
+	}
+	if rec := request("POST", "/api/batch", plaintext, batch); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("over daily claims: status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	s.consumeQueue()
+	if len(multisend.sent[common.Address{}]) != 2 || len(multisend.sent[*usdc.Contract]) != 1 {
+		t.Errorf("multisend recipients = %v, want 2 xt and 1 usdc", multisend.sent)
+	}
+
+	var done batchStatus
+	if err := json.NewDecoder(request("GET", "/api/batch/"+submitted.ID, plaintext, "").Body).Decode(&done); err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != BatchCompleted || done.Items[0].TxHash == "" || done.Items[0].TxHash != done.Items[1].TxHash {
+		t.Errorf("done = %+v, want completed items sharing one xt transaction", done)
+	}
+	if rec := request("GET", "/api/batch/"+submitted.ID, "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("lookup without key: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CaptchaKey is the form field holding the CAPTCHA response token of a claim.
+const CaptchaKey = "captcha"
+
+// Supported CAPTCHA providers. They all share the same siteverify protocol and differ in their
+// endpoint and, for reCAPTCHA v3, in returning a score instead of a challenge result.
+const (
+	HCaptcha    = "hcaptcha"
+	ReCaptcha   = "recaptcha"
+	ReCaptchaV3 = "recaptchav3"
+	Turnstile   = "turnstile"
+)
+
+var captchaVerifyURLs = map[string]string{
+	HCaptcha:    "https://api.hcaptcha.com/siteverify",
+	ReCaptcha:   "https://www.google.com/recaptcha/api/siteverify",
+	ReCaptchaV3: "https://www.google.com/recaptcha/api/siteverify",
+	Turnstile:   "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// captchaAction is the reCAPTCHA v3 action the frontend executes before a claim.
+const captchaAction = "claim"
+
+// errCaptchaRejected is returned when the provider does not accept a response token.
+var errCaptchaRejected = errors.New("captcha verification failed, please try again")
+
+type CaptchaConfig struct {
+	Provider string
+	SiteKey  string
+	Secret   string
+	// VerifyURL overrides the provider's siteverify endpoint, for example with a local stub.
+	VerifyURL string
+	// MinScore is the lowest reCAPTCHA v3 score accepted, between 0 and 1.
+	MinScore float64
+}
+
+// Captcha is a negroni middleware that verifies the CAPTCHA response posted with each claim
+// on the server side before the claim reaches the rate limiter.
+type Captcha struct {
+	cfg      CaptchaConfig
+	clientIP ClientIPConfig
+	client   *http.Client
+}
+
+func NewCaptcha(cfg CaptchaConfig, clientIP ClientIPConfig) (*Captcha, error) {
+	defaultURL, ok := captchaVerifyURLs[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown captcha provider %q", cfg.Provider)
+	}
+	if cfg.SiteKey == "" || cfg.Secret == "" {
+		return nil, fmt.Errorf("captcha provider %s needs both a site key and a secret", cfg.Provider)
+	}
+	if cfg.VerifyURL == "" {
+		cfg.VerifyURL = defaultURL
+	}
+	if cfg.MinScore < 0 || cfg.MinScore > 1 {
+		return nil, fmt.Errorf("captcha min score must be between 0 and 1, got %v", cfg.MinScore)
+	}
+	return &Captcha{
+		cfg:      cfg,
+		clientIP: clientIP,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (c *Captcha) Name() string {
+	return "captcha"
+}
+
+// Public returns the provider and site key the frontend renders its widget with.
+func (c *Captcha) Public() interface{} {
+	return map[string]string{
+		"provider": c.cfg.Provider,
+		"siteKey":  c.cfg.SiteKey,
+	}
+}
+
+func (c *Captcha) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	token := r.PostFormValue(CaptchaKey)
+	if token == "" {
+		writeError(w, r, http.StatusBadRequest, CodeVerificationRequired, "captcha is required")
+		return
+	}
+
+	clientIP := c.clientIP.ClientIP(r)
+	err := c.verify(r.Context(), token, clientIP)
+	if errors.Is(err, errCaptchaRejected) {
+		log.WithFields(log.Fields{
+			"clientIP": clientIP,
+			"provider": c.cfg.Provider,
+		}).WithError(err).Info("Rejected claim with an invalid captcha")
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, errCaptchaRejected.Error())
+		return
+	} else if err != nil {
+		log.WithError(err).Error("Failed to verify captcha")
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "captcha verification is unavailable, please try again later")
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+type siteVerifyResponse struct {
+	Success    bool     `json:"success"`
+	Score      float64  `json:"score"`
+	Action     string   `json:"action"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// verify checks a response token with the provider. It returns an error wrapping
+// errCaptchaRejected if the provider turned the token down.
+func (c *Captcha) verify(ctx context.Context, token, clientIP string) error {
+	form := url.Values{
+		"secret":   {c.cfg.Secret},
+		"response": {token},
+		"sitekey":  {c.cfg.SiteKey},
+	}
+	if clientIP != "" {
+		form.Set("remoteip", clientIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha verify endpoint returned %s", resp.Status)
+	}
+
+	var result siteVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid captcha verify response: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", errCaptchaRejected, strings.Join(result.ErrorCodes, ", "))
+	}
+	if c.cfg.Provider == ReCaptchaV3 {
+		if result.Action != captchaAction {
+			return fmt.Errorf("%w: unexpected action %q", errCaptchaRejected, result.Action)
+		}
+		if result.Score < c.cfg.MinScore {
+			return fmt.Errorf("%w: score %v below %v", errCaptchaRejected, result.Score, c.cfg.MinScore)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/urfave/negroni"
+)
+
+func TestCaptcha(t *testing.T) {
+	verify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") != "shh" {
+			t.Errorf("secret = %q, want shh", r.PostFormValue("secret"))
+		}
+		if r.PostFormValue("remoteip") != "192.0.2.1" {
+			t.Errorf("remoteip = %q, want 192.0.2.1", r.PostFormValue("remoteip"))
+		}
+		result := siteVerifyResponse{Action: captchaAction}
+		switch r.PostFormValue("response") {
+		case "down":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "human":
+			result.Success, result.Score = true, 0.9
+		case "bot":
+			result.Success, result.Score = true, 0.1
+		case "elsewhere":
+			result.Success, result.Score, result.Action = true, 0.9, "login"
+		default:
+			result.ErrorCodes = []string{"invalid-input-response"}
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer verify.Close()
+
+	tests := []struct {
+		name     string
+		provider string
+		token    string
+		want     int
+	}{
+		{name: "missing token", provider: HCaptcha, want: http.StatusBadRequest},
+		{name: "solved", provider: HCaptcha, token: "human", want: http.StatusOK},
+		{name: "invalid token", provider: Turnstile, token: "forged", want: http.StatusForbidden},
+		{name: "v2 ignores score", provider: ReCaptcha, token: "bot", want: http.StatusOK},
+		{name: "v3 high score", provider: ReCaptchaV3, token: "human", want: http.StatusOK},
+		{name: "v3 low score", provider: ReCaptchaV3, token: "bot", want: http.StatusForbidden},
+		{name: "v3 other action", provider: ReCaptchaV3, token: "elsewhere", want: http.StatusForbidden},
+		{name: "verify endpoint down", provider: HCaptcha, token: "down", want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		captcha, err := NewCaptcha(CaptchaConfig{
+			Provider:  tt.provider,
+			SiteKey:   "site",
+			Secret:    "shh",
+			VerifyURL: verify.URL,
+			MinScore:  0.5,
+		}, ClientIPConfig{})
+		if err != nil {
+			t.Fatalf("NewCaptcha() error = %v", err)
+		}
+		handler := negroni.New(captcha, negroni.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})))
+
+		form := url.Values{AddressKey: {"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"}, CaptchaKey: {tt.token}}
+		req := httptest.NewRequest("POST", "/api/claim", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestNewCaptchaConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  CaptchaConfig
+	}{
+		{name: "unknown provider", cfg: CaptchaConfig{Provider: "geetest", SiteKey: "site", Secret: "shh"}},
+		{name: "missing secret", cfg: CaptchaConfig{Provider: HCaptcha, SiteKey: "site"}},
+		{name: "score out of range", cfg: CaptchaConfig{Provider: ReCaptchaV3, SiteKey: "site", Secret: "shh", MinScore: 2}},
+	}
+	for _, tt := range tests {
+		if _, err := NewCaptcha(tt.cfg, ClientIPConfig{}); err == nil {
+			t.Errorf("%s: NewCaptcha() error = nil, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPConfig controls how the client IP of a request is determined and bucketed for rate
+// limiting.
+type ClientIPConfig struct {
+	// TrustedProxies are the networks of reverse proxies whose forwarding headers are honored.
+	TrustedProxies []*net.IPNet
+	// ProxyHeader is the forwarding header the trusted proxies set, one of X-Forwarded-For,
+	// Forwarded and X-Real-Ip, X-Forwarded-For if empty. The others are ignored, since a proxy
+	// passes on whatever a client sends in headers it doesn't set itself.
+	ProxyHeader string
+	// ProxyCount is the legacy way to trust forwarding headers, by counting the proxies in
+	// front of the server. It is only used when no trusted proxies are configured.
+	ProxyCount int
+	// IPv6Prefix is the prefix length IPv6 clients are grouped by, since a single client
+	// usually controls a whole /64 or more.
+	IPv6Prefix int
+	// ProxyProtocol makes the listener expect a PROXY protocol header on every connection.
+	ProxyProtocol bool
+}
+
+// ParseCIDRs parses a comma separated list of networks. Plain IP addresses are treated as
+// single host networks.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ParseProxyHeader returns the canonical name of a forwarding header a proxy may set, or an
+// error if the client IP can't be read from it.
+func ParseProxyHeader(name string) (string, error) {
+	switch header := http.CanonicalHeaderKey(strings.TrimSpace(name)); header {
+	case "":
+		return "X-Forwarded-For", nil
+	case "X-Forwarded-For", "Forwarded", "X-Real-Ip":
+		return header, nil
+	default:
+		return "", fmt.Errorf("unsupported proxy header %q", name)
+	}
+}
+
+func (c ClientIPConfig) trusted(ip net.IP) bool {
+	for _, network := range c.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that sent the request. The proxy header is
+// only read when the connection comes from a trusted proxy, and the forwarding chain is walked
+// from the right past every trusted hop, so a client cannot spoof its address by prepending
+// entries. A hop that is not an IP address can't be trusted either, so the peer is used then.
+func (c ClientIPConfig) ClientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if len(c.TrustedProxies) == 0 {
+		return getClientIPFromRequest(c.ProxyCount, r)
+	}
+
+	peer := net.ParseIP(remoteIP)
+	if peer == nil || !c.trusted(peer) {
+		return remoteIP
+	}
+
+	var hops []string
+	switch header, _ := ParseProxyHeader(c.ProxyHeader); header {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values(header))
+	default:
+		for _, value := range r.Header.Values(header) {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return remoteIP
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			return remoteIP
+		}
+		if !c.trusted(ip) {
+			return ip.String()
+		}
+	}
+	return hops[0]
+}
+
+// Bucket maps a client IP onto the key its rate limits are counted under. IPv6 addresses are
+// truncated to the configured prefix, IPv4 addresses are used as they are.
+func (c ClientIPConfig) Bucket(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil || ip.To4() != nil || c.IPv6Prefix <= 0 || c.IPv6Prefix >= 128 {
+		return clientIP
+	}
+	mask := net.CIDRMask(c.IPv6Prefix, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// forwardedFor extracts the for= parameters of RFC 7239 Forwarded headers, in order. Ports
+// and the brackets around IPv6 addresses are stripped.
+func forwardedFor(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 || !strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+					continue
+				}
+				hops = append(hops, parseForwardedNode(strings.TrimSpace(pair[eq+1:])))
+			}
+		}
+	}
+	return hops
+}
+
+func parseForwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return node[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
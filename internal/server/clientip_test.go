@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8, 2001:db8:ffff::/48, 192.0.2.10")
+	if err != nil {
+		t.Fatalf("ParseCIDRs() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		header  string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "direct", remote: "198.51.100.7:1234", want: "198.51.100.7"},
+		{name: "untrusted peer", remote: "198.51.100.7:1234", headers: map[string]string{"X-Forwarded-For": "203.0.113.1"}, want: "198.51.100.7"},
+		{name: "trusted peer", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "203.0.113.1"}, want: "203.0.113.1"},
+		{name: "spoofed prefix", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.1, 10.0.0.2"}, want: "203.0.113.1"},
+		{name: "single host proxy", remote: "192.0.2.10:1234", headers: map[string]string{"X-Forwarded-For": "203.0.113.1"}, want: "203.0.113.1"},
+		{name: "all trusted", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "not an ip", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "1.1.1.1, bogus, 10.0.0.2"}, want: "10.0.0.1"},
+		{
+			name:    "other headers ignored",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": "for=1.1.1.1", "X-Real-Ip": "1.1.1.2", "X-Forwarded-For": "203.0.113.1"},
+			want:    "203.0.113.1",
+		},
+		{name: "real ip without header", remote: "10.0.0.1:1234", headers: map[string]string{"X-Real-Ip": "203.0.113.9"}, want: "10.0.0.1"},
+		{name: "real ip", header: "x-real-ip", remote: "10.0.0.1:1234", headers: map[string]string{"X-Real-Ip": "203.0.113.9", "X-Forwarded-For": "1.1.1.1"}, want: "203.0.113.9"},
+		{
+			name:    "forwarded",
+			header:  "Forwarded",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": `for=1.1.1.1, for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2`, "X-Forwarded-For": "203.0.113.1"},
+			want:    "2001:db8:cafe::17",
+		},
+		{name: "forwarded ipv4 port", header: "Forwarded", remote: "[2001:db8:ffff::1]:443", headers: map[string]string{"Forwarded": `for="203.0.113.5:8080"`}, want: "203.0.113.5"},
+		{name: "forwarded obfuscated", header: "Forwarded", remote: "10.0.0.1:1234", headers: map[string]string{"Forwarded": "for=_hidden"}, want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ClientIPConfig{TrustedProxies: trusted, ProxyHeader: tt.header}
+			req := httptest.NewRequest("POST", "/api/claim", nil)
+			req.RemoteAddr = tt.remote
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if got := cfg.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "", want: "X-Forwarded-For"},
+		{name: "forwarded", want: "Forwarded"},
+		{name: "X-Real-IP", want: "X-Real-Ip"},
+		{name: "CF-Connecting-IP", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseProxyHeader(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseProxyHeader(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestClientIPLegacyProxyCount(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/claim", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.1")
+	if got := (ClientIPConfig{ProxyCount: 1}).ClientIP(req); got != "203.0.113.1" {
+		t.Errorf("ClientIP() = %v, want 203.0.113.1", got)
+	}
+}
+
+func TestClientIPBucket(t *testing.T) {
+	cfg := ClientIPConfig{IPv6Prefix: 56}
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "203.0.113.1", want: "203.0.113.1"},
+		{ip: "2001:db8:abcd:12ff::1", want: "2001:db8:abcd:1200::/56"},
+		{ip: "unknown", want: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := cfg.Bucket(tt.ip); got != tt.want {
+			t.Errorf("Bucket(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -1,31 +1,206 @@
 package server
 
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/urfave/negroni"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
 type Config struct {
-	network    string
-	httpPort   int
-	interval   int
-	payout     int
-	proxyCount int
-	queueCap   int
+	network  string
+	explorer string
+	httpPort int
+	queueCap int
+	clientIP ClientIPConfig
+	store    LimiterStore
+	access   *AccessControl
+	keys     *KeyStore
+	ledger   *Ledger
+	batch    BatchConfig
+	admin    AdminConfig
+	guards   []Guard
+}
+
+// BatchConfig configures the batch funding endpoint.
+type BatchConfig struct {
+	// MaxItems caps the number of claims in one batch.
+	MaxItems int
+	// MultiSend pays the claims of each asset in a batch with one transaction. Claims are
+	// paid one by one if it is nil.
+	MultiSend chain.MultiSender
+}
+
+// AdminConfig configures the admin API.
+type AdminConfig struct {
+	// Token is the bearer token operators authenticate with.
+	Token string
+	// Port serves the admin API on a listener of its own. It is served on the public listener
+	// if zero.
+	Port int
+	// TLS serves the admin listener over TLS. Operators may authenticate with a client
+	// certificate instead of the token if it verifies client certificates.
+	TLS *tls.Config
+	// Audit records every action taken through the admin API.
+	Audit *AuditLog
+}
+
+// enabled reports whether operators have a way to authenticate.
+func (c AdminConfig) enabled() bool {
+	return c.Token != "" || c.clientCerts()
+}
+
+// clientCerts reports whether operators may authenticate with a client certificate.
+func (c AdminConfig) clientCerts() bool {
+	return c.Port != 0 && c.TLS != nil && c.TLS.ClientCAs != nil
+}
+
+// Guard is an anti-bot check that every claim has to pass before it is counted against the
+// rate limits. The settings a frontend needs to satisfy it are advertised in /api/info under
+// the guard's name.
+type Guard interface {
+	negroni.Handler
+	Name() string
+	Public() interface{}
+}
+
+// queueAware is implemented by guards that adapt to the length of the claim queue.
+type queueAware interface {
+	watchQueue(length func() int)
 }
 
-func NewConfig(network string, httpPort, interval, payout, proxyCount, queueCap int) *Config {
+// guardRoutes is implemented by guards that serve endpoints of their own.
+type guardRoutes interface {
+	routes(router *http.ServeMux)
+}
+
+func NewConfig(network, explorer string, httpPort, queueCap int, clientIP ClientIPConfig, store LimiterStore, access *AccessControl, keys *KeyStore, ledger *Ledger, batch BatchConfig, admin AdminConfig, guards ...Guard) *Config {
+	if ledger == nil {
+		ledger = NewLedger(defaultLedgerSize, nil)
+	}
+	if admin.Audit == nil {
+		admin.Audit = NewAuditLog(defaultAuditSize, nil)
+	}
 	return &Config{
-		network:    network,
-		httpPort:   httpPort,
-		interval:   interval,
-		payout:     payout,
-		proxyCount: proxyCount,
-		queueCap:   queueCap,
+		network:  network,
+		explorer: explorer,
+		httpPort: httpPort,
+		queueCap: queueCap,
+		clientIP: clientIP,
+		store:    store,
+		access:   access,
+		keys:     keys,
+		ledger:   ledger,
+		batch:    batch,
+		admin:    admin,
+		guards:   guards,
 	}
 }
 
+// NativeAsset describes the chain's native coin, which is paid out with plain value transfers
+// rather than through a token contract.
+type NativeAsset struct {
+	Symbol    string
+	Name      string
+	Decimals  int
+	Payout    Amount
+	MinAmount Amount
+	MaxAmount Amount
+	Quota     Amount
+
+	IPQuota     Amount
+	SubnetQuota Amount
+}
+
+// Amount is a decimal amount of an asset such as "0.05". In JSON it may be written either as
+// a string or as a number, which is kept verbatim to avoid floating point rounding.
+type Amount string
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*a = Amount(text)
+		return nil
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("amount must be a decimal string or number: %s", data)
+	}
+	*a = Amount(number.String())
+	return nil
+}
+
+// RuntimeConfig is the optional JSON settings file that can be edited while the faucet runs.
+// Fields left out fall back to the command-line flags.
+type RuntimeConfig struct {
+	Payout          Amount `json:"amount,omitempty"`
+	Interval        *int   `json:"minutes,omitempty"`
+	NativePayout    Amount `json:"native_amount,omitempty"`
+	NativeMinAmount Amount `json:"native_min_amount,omitempty"`
+	NativeMaxAmount Amount `json:"native_max_amount,omitempty"`
+	NativeQuota     Amount `json:"native_quota,omitempty"`
+	DailyClaims     *int   `json:"daily_claims,omitempty"`
+}
+
+// LoadRuntimeConfig reads the runtime settings file.
+func LoadRuntimeConfig(path string) (*RuntimeConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg RuntimeConfig
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
 type Erc20Token struct {
 	ContractAddress string `json:"contract_address"`
 	Decimal         int    `json:"decimal,omitempty"`
 	Symbol          string `json:"symbol"`
+	Name            string `json:"name,omitempty"`
+	LogoURI         string `json:"logo_uri,omitempty"`
+	Payout          Amount `json:"payout,omitempty"`
+	Minutes         *int   `json:"minutes,omitempty"`
+	DailyCap        Amount `json:"daily_cap,omitempty"`
+	MinAmount       Amount `json:"min_amount,omitempty"`
+	MaxAmount       Amount `json:"max_amount,omitempty"`
+	Quota           Amount `json:"quota,omitempty"`
+	IPQuota         Amount `json:"ip_quota,omitempty"`
+	SubnetQuota     Amount `json:"subnet_quota,omitempty"`
 }
 
-type Erc20Tokens struct {
-	Tokens []Erc20Tokens `json:"tokens,omitempty"`
+// TokenList is the standard token list schema, see https://tokenlists.org.
+type TokenList struct {
+	Name   string          `json:"name"`
+	Tokens []TokenListItem `json:"tokens"`
+}
+
+type TokenListItem struct {
+	ChainID  int64  `json:"chainId"`
+	Address  string `json:"address"`
+	Name     string `json:"name"`
+	Symbol   string `json:"symbol"`
+	Decimals int    `json:"decimals"`
+	LogoURI  string `json:"logoURI,omitempty"`
+
+	Extensions struct {
+		FaucetPayout   Amount `json:"faucetPayout,omitempty"`
+		FaucetMinutes  *int   `json:"faucetMinutes,omitempty"`
+		FaucetDailyCap Amount `json:"faucetDailyCap,omitempty"`
+		FaucetMin      Amount `json:"faucetMinAmount,omitempty"`
+		FaucetMax      Amount `json:"faucetMaxAmount,omitempty"`
+		FaucetQuota    Amount `json:"faucetQuota,omitempty"`
+
+		FaucetIPQuota     Amount `json:"faucetIpQuota,omitempty"`
+		FaucetSubnetQuota Amount `json:"faucetSubnetQuota,omitempty"`
+	} `json:"extensions,omitempty"`
 }
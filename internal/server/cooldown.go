@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// assetCooldown tells whether a client can claim the payout of an asset now.
+type assetCooldown struct {
+	Symbol  string `json:"symbol"`
+	Allowed bool   `json:"allowed"`
+	// RetryAfter is the number of seconds until the payout can be claimed, if waiting helps.
+	RetryAfter int64  `json:"retryAfter,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// cooldownStatus is the reply of a cooldown lookup.
+type cooldownStatus struct {
+	Address string          `json:"address,omitempty"`
+	Assets  []assetCooldown `json:"assets"`
+}
+
+// handleCooldown looks up the cooldowns of the address in the query, and of the client IP of
+// the request, without claiming anything. Without an address only the quotas of the client IP,
+// its subnet and the faucet apply. The quotas of an API key sent in its header are looked up
+// instead of the per-client ones, as they would be for its claims.
+func (s *Server) handleCooldown() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), jsonAPIKey{}, true))
+		if r.Method != "GET" {
+			writeError(w, r, http.StatusMethodNotAllowed, CodeInvalidRequest, "cooldowns must be fetched with GET")
+			return
+		}
+		address := r.URL.Query().Get(AddressKey)
+		if address != "" && !chain.IsValidAddress(address, true) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidAddress, "invalid address")
+			return
+		}
+		var key *APIKey
+		if plaintext := r.Header.Get(APIKeyHeader); plaintext != "" {
+			var ok bool
+			if key, ok = s.cfg.keys.Authenticate(plaintext); !ok {
+				writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "invalid api key")
+				return
+			}
+		}
+
+		cooldowns, err := s.limiter.cooldowns(r.Context(), address, s.cfg.clientIP.ClientIP(r), key)
+		if err != nil {
+			log.WithError(err).Error("Failed to look up the rate limits")
+			writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "rate limits are unavailable, please try again later")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(cooldownStatus{Address: address, Assets: cooldowns})
+	}
+}
+
+// cooldowns checks a claim of the payout of every asset by the client against the rate limits,
+// without counting it. A claim held up by several quotas waits for the one that frees up last.
+func (l *Limiter) cooldowns(ctx context.Context, address, clientIP string, key *APIKey) ([]assetCooldown, error) {
+	settings := l.settings()
+	c := claimant{
+		address:  address,
+		clientIP: clientIP,
+		allowed:  l.access.Allowed(address, clientIP),
+		key:      key,
+	}
+	denied := l.access.Denied(address, clientIP)
+	now := l.now()
+
+	var cooldowns []assetCooldown
+	for _, asset := range settings.Registry.Assets() {
+		item := assetCooldown{Symbol: asset.Symbol}
+		switch {
+		case denied:
+			item.Message = "This address or IP is not allowed to use the faucet"
+		case key != nil && !key.allows(asset.Symbol):
+			item.Message = fmt.Sprintf("This API key may not claim %s", asset.Symbol)
+		case settings.Paused || asset.Paused:
+			item.Message = pausedError(settings, asset).message
+		default:
+			scopes, rejected := l.scopes(settings, asset, c, asset.Payout)
+			if rejected != nil {
+				item.Message = rejected.message
+				break
+			}
+			rejections, err := l.store.Check(ctx, reserve(scopes, ""), now)
+			if err != nil {
+				return nil, err
+			}
+			item.Allowed = len(rejections) == 0
+			var longest *claimError
+			for _, rejection := range rejections {
+				if e := scopes[rejection.Index].rejected(rejection); longest == nil || e.wait > longest.wait {
+					longest = e
+				}
+			}
+			if longest != nil {
+				item.RetryAfter, item.Message = longest.retryAfter(), longest.message
+			}
+		}
+		cooldowns = append(cooldowns, item)
+	}
+	return cooldowns, nil
+}
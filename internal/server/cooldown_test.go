@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+func TestCooldown(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	stores := map[string]func() LimiterStore{
+		"memory": func() LimiterStore { return NewMemoryStore() },
+		"redis": func() LimiterStore {
+			return NewRedisStore(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), "test:")
+		},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testCooldown(t, store())
+		})
+	}
+}
+
+func testCooldown(t *testing.T, store LimiterStore) {
+	registry := newTestRegistry(newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86"))
+	registry.Native().IPQuota = chain.EtherToWei(1)
+	s := NewServer(&fakeTxBuilder{}, &Settings{Registry: registry}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, store, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	router := s.setupRouter()
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+	)
+	if got := postClaimFrom(router, "198.51.100.1:1", alice, "xt", ""); got != http.StatusOK {
+		t.Fatalf("claim status = %d, want 200", got)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		remote string
+		want   map[string]bool
+	}{
+		{name: "claimed address", query: "?address=" + alice, remote: "203.0.113.1:1", want: map[string]bool{"xt": false, "usdc": true}},
+		{name: "claimed ip", query: "?address=" + bob, remote: "198.51.100.1:2", want: map[string]bool{"xt": false, "usdc": true}},
+		{name: "ip only", remote: "198.51.100.1:3", want: map[string]bool{"xt": false, "usdc": true}},
+		{name: "fresh client", query: "?address=" + bob, remote: "203.0.113.1:1", want: map[string]bool{"xt": true, "usdc": true}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/cooldown"+tt.query, nil)
+		req.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200: %s", tt.name, rec.Code, rec.Body)
+		}
+		var status cooldownStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if len(status.Assets) != len(tt.want) {
+			t.Fatalf("%s: assets = %+v, want %d of them", tt.name, status.Assets, len(tt.want))
+		}
+		for _, asset := range status.Assets {
+			if asset.Allowed != tt.want[asset.Symbol] {
+				t.Errorf("%s: %s allowed = %v, want %v", tt.name, asset.Symbol, asset.Allowed, tt.want[asset.Symbol])
+			}
+			if !asset.Allowed && (asset.RetryAfter <= 0 || asset.RetryAfter > 3600 || asset.Message == "") {
+				t.Errorf("%s: %s = %+v, want the wait of up to an hour", tt.name, asset.Symbol, asset)
+			}
+		}
+	}
+
+	// Looking up the cooldown doesn't count anything.
+	if got := postClaimFrom(router, "203.0.113.1:1", bob, "xt", ""); got != http.StatusOK {
+		t.Errorf("claim after lookups: status = %d, want 200", got)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v2/cooldown?address=0x1", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid address: status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of the events pushed to the clients that follow a claim.
+const (
+	EventQueued    = "queued"
+	EventBroadcast = "broadcast"
+	EventMined     = "mined"
+	EventFailed    = "failed"
+)
+
+const (
+	// receiptTimeout is how long a sent transaction is watched for its receipt.
+	receiptTimeout = 30 * time.Minute
+	// heartbeatInterval is how often an idle event stream is kept alive.
+	heartbeatInterval = 15 * time.Second
+)
+
+// claimEvent is a state transition of a claim.
+type claimEvent struct {
+	Type    string `json:"type"`
+	ClaimID string `json:"claimId"`
+	// Position is the place of a queued claim in the queue, starting at 1 for the next one.
+	Position int    `json:"position,omitempty"`
+	TxHash   string `json:"txHash,omitempty"`
+	Block    uint64 `json:"block,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// claimFeed keeps the order of the queued claims and fans out the events of claims to the
+// clients that follow them.
+type claimFeed struct {
+	mutex     sync.Mutex
+	queue     []string
+	followers map[string][]chan claimEvent
+}
+
+// follow returns a channel that receives the events of the claim with the ID until stop is
+// called.
+func (f *claimFeed) follow(id string) (events <-chan claimEvent, stop func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.followers == nil {
+		f.followers = make(map[string][]chan claimEvent)
+	}
+	ch := make(chan claimEvent, 8)
+	f.followers[id] = append(f.followers[id], ch)
+	return ch, func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		followers := f.followers[id]
+		for i, follower := range followers {
+			if follower == ch {
+				followers = append(followers[:i], followers[i+1:]...)
+				break
+			}
+		}
+		if len(followers) == 0 {
+			delete(f.followers, id)
+		} else {
+			f.followers[id] = followers
+		}
+	}
+}
+
+// publish sends the event to the followers of its claim.
+func (f *claimFeed) publish(e claimEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.send(e)
+}
+
+// send delivers the event without blocking. The caller holds the lock, so it is the only
+// sender, and a follower that falls behind loses its oldest event rather than the latest.
+func (f *claimFeed) send(e claimEvent) {
+	for _, ch := range f.followers[e.ClaimID] {
+		select {
+		case ch <- e:
+		default:
+			<-ch
+			ch <- e
+		}
+	}
+}
+
+// enqueue appends the claim to the queue with push, which reports false if the queue is full,
+// and publishes its position. Both happen under the lock, so the order kept here is the order
+// of the queue.
+func (f *claimFeed) enqueue(id string, push func() bool) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !push() {
+		return false
+	}
+	f.queue = append(f.queue, id)
+	f.send(claimEvent{Type: EventQueued, ClaimID: id, Position: len(f.queue)})
+	return true
+}
+
+// dequeue removes the claim from the queue and publishes the new positions of the claims after
+// it.
+func (f *claimFeed) dequeue(id string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, queued := range f.queue {
+		if queued != id {
+			continue
+		}
+		f.queue = append(f.queue[:i], f.queue[i+1:]...)
+		for j := i; j < len(f.queue); j++ {
+			f.send(claimEvent{Type: EventQueued, ClaimID: f.queue[j], Position: j + 1})
+		}
+		return
+	}
+}
+
+// filter replaces the order of the queue with the IDs rebuild leaves in it, and publishes the
+// new positions. rebuild runs under the lock, so no claim is enqueued meanwhile.
+func (f *claimFeed) filter(rebuild func() []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.queue = rebuild()
+	for i, id := range f.queue {
+		f.send(claimEvent{Type: EventQueued, ClaimID: id, Position: i + 1})
+	}
+}
+
+// queued returns the IDs of the queued claims in order.
+func (f *claimFeed) queued() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.queue...)
+}
+
+// position returns the place of the claim in the queue, or 0 if it is not queued.
+func (f *claimFeed) position(id string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, queued := range f.queue {
+		if queued == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// sentTx is a transaction waiting to be mined, and the claims it pays out.
+type sentTx struct {
+	claims []string
+	since  time.Time
+}
+
+// pendingTxs are the sent transactions whose receipts are watched.
+type pendingTxs struct {
+	mutex sync.Mutex
+	txs   map[common.Hash]*sentTx
+}
+
+func (p *pendingTxs) add(txHash common.Hash, id string, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.txs == nil {
+		p.txs = make(map[common.Hash]*sentTx)
+	}
+	if tx, ok := p.txs[txHash]; ok {
+		tx.claims = append(tx.claims, id)
+		return
+	}
+	p.txs[txHash] = &sentTx{claims: []string{id}, since: now}
+}
+
+func (p *pendingTxs) snapshot() map[common.Hash]sentTx {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	txs := make(map[common.Hash]sentTx, len(p.txs))
+	for txHash, tx := range p.txs {
+		txs[txHash] = *tx
+	}
+	return txs
+}
+
+func (p *pendingTxs) remove(txHash common.Hash) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.txs, txHash)
+}
+
+// watchReceipts looks up the receipts of sent transactions every interval until the context is
+// done, and marks their claims as mined or failed. Claims whose transaction is not mined within
+// receiptTimeout are marked as failed too, so they are settled and their followers let go.
+func (s *Server) watchReceipts(ctx context.Context, interval time.Duration) {
+	if s.receipts == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkReceipts(ctx)
+		}
+	}
+}
+
+func (s *Server) checkReceipts(ctx context.Context) {
+	for txHash, tx := range s.pending.snapshot() {
+		receipt, err := s.receipts.TransactionReceipt(ctx, txHash)
+		if errors.Is(err, ethereum.NotFound) {
+			if time.Since(tx.since) > receiptTimeout {
+				log.WithField("txHash", txHash).Warn("Gave up waiting for a transaction to be mined")
+				s.pending.remove(txHash)
+				s.failSent(txHash, tx.claims, fmt.Sprintf("transaction not mined within %s, it may still be", receiptTimeout))
+			}
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("txHash", txHash).Debug("Failed to look up transaction receipt")
+			continue
+		}
+		s.pending.remove(txHash)
+		for _, id := range tx.claims {
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				s.failSent(txHash, []string{id}, "transaction reverted")
+				continue
+			}
+			block := receipt.BlockNumber.Uint64()
+			s.cfg.ledger.Update(id, func(entry *ClaimRecord) {
+				entry.Status, entry.Block = ClaimMined, block
+			})
+			s.feed.publish(claimEvent{Type: EventMined, ClaimID: id, TxHash: txHash.Hex(), Block: block})
+		}
+	}
+}
+
+// failSent marks the sent claims of the transaction as failed and publishes why.
+func (s *Server) failSent(txHash common.Hash, claims []string, reason string) {
+	for _, id := range claims {
+		s.cfg.ledger.Update(id, func(entry *ClaimRecord) {
+			entry.Status, entry.Error = ClaimFailed, reason
+		})
+		s.feed.publish(claimEvent{Type: EventFailed, ClaimID: id, TxHash: txHash.Hex(), Error: reason})
+	}
+}
+
+// settled reports whether a claim won't change anymore. A sent claim is settled only if
+// receipts are not watched.
+func (s *Server) settled(record ClaimRecord) bool {
+	switch record.Status {
+	case ClaimMined, ClaimFailed:
+		return true
+	case ClaimSent:
+		return s.receipts == nil
+	}
+	return false
+}
+
+// currentEvent describes the state of a recorded claim as an event.
+func (s *Server) currentEvent(record ClaimRecord) claimEvent {
+	e := claimEvent{ClaimID: record.ID, TxHash: record.TxHash, Block: record.Block, Error: record.Error}
+	switch record.Status {
+	case ClaimQueued:
+		e.Type, e.Position = EventQueued, s.feed.position(record.ID)
+	case ClaimSent:
+		e.Type = EventBroadcast
+	case ClaimMined:
+		e.Type = EventMined
+	default:
+		e.Type = EventFailed
+	}
+	return e
+}
+
+// handleClaimEvents streams the events of a claim as server-sent events, starting with its
+// current state, until it is settled or the client goes away.
+func (s *Server) handleClaimEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, CodeUnavailable, "streaming is not supported")
+		return
+	}
+	// Follow before the first lookup, so no event in between is missed.
+	events, stop := s.feed.follow(id)
+	defer stop()
+	record, ok := s.cfg.ledger.Get(id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "unknown claim")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	writeEvent(w, s.currentEvent(record))
+	flusher.Flush()
+	if s.settled(record) {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e := <-events:
+			writeEvent(w, e)
+			if e.Type == EventMined || e.Type == EventFailed || (e.Type == EventBroadcast && s.receipts == nil) {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e claimEvent) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// fakeReceipts is a transaction builder whose transactions are pending until they are mined.
+type fakeReceipts struct {
+	fakeTxBuilder
+	mutex    sync.Mutex
+	receipts map[common.Hash]*types.Receipt
+}
+
+func (f *fakeReceipts) Transfer(_ context.Context, to string, _ *big.Int) (common.Hash, error) {
+	return common.BytesToHash(common.HexToAddress(to).Bytes()), nil
+}
+
+func (f *fakeReceipts) TransactionReceipt(_ context.Context, txHash common.Hash) (*types.Receipt, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	receipt, ok := f.receipts[txHash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return receipt, nil
+}
+
+func (f *fakeReceipts) mine(txHash common.Hash, status uint64, block int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.receipts[txHash] = &types.Receipt{Status: status, BlockNumber: big.NewInt(block)}
+}
+
+func TestClaimFeed(t *testing.T) {
+	var feed claimFeed
+	push := func() bool { return true }
+	feed.enqueue("a", push)
+	feed.enqueue("b", push)
+	if feed.enqueue("full", func() bool { return false }) || feed.position("full") != 0 {
+		t.Error("a claim that did not fit in the queue was added to it")
+	}
+
+	events, stop := feed.follow("b")
+	defer stop()
+	feed.enqueue("c", push)
+	feed.dequeue("a")
+	if e := <-events; e.Type != EventQueued || e.Position != 1 {
+		t.Errorf("event after dequeue = %+v, want position 1", e)
+	}
+	if got := feed.position("c"); got != 2 {
+		t.Errorf("position(c) = %d, want 2", got)
+	}
+
+	// A follower that falls behind loses its oldest events.
+	for i := 0; i < cap(events)+2; i++ {
+		feed.publish(claimEvent{Type: EventQueued, ClaimID: "b", Position: i})
+	}
+	feed.publish(claimEvent{Type: EventMined, ClaimID: "b", Block: 7})
+	var last claimEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	if last.Type != EventMined {
+		t.Errorf("last event = %+v, want the mined event", last)
+	}
+}
+
+// readEvents returns the events of a server-sent event stream until it ends.
+func readEvents(t *testing.T, resp *http.Response, each func(claimEvent)) {
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data := strings.TrimPrefix(scanner.Text(), "data: ")
+		if data == scanner.Text() {
+			continue
+		}
+		var e claimEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Errorf("invalid event %s: %v", data, err)
+			return
+		}
+		each(e)
+	}
+}
+
+func TestClaimEvents(t *testing.T) {
+	tx := &fakeReceipts{receipts: make(map[common.Hash]*types.Receipt)}
+	s := NewServer(tx, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+	)
+	tests := []struct {
+		address string
+		status  uint64
+		want    []string
+	}{
+		{address: alice, status: types.ReceiptStatusSuccessful, want: []string{EventQueued, EventBroadcast, EventMined}},
+		{address: bob, status: types.ReceiptStatusFailed, want: []string{EventQueued, EventBroadcast, EventFailed}},
+	}
+	for _, tt := range tests {
+		// Hold the faucet busy so the claim is queued.
+		s.mutex.Lock()
+		resp, err := ts.Client().PostForm(ts.URL+"/api/claim", url.Values{AddressKey: {tt.address}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		id := resp.Header.Get("X-Claim-Id")
+
+		stream, err := ts.Client().Get(ts.URL + "/api/v2/claims/" + id + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stream.Header.Get("Content-Type"); got != "text/event-stream" {
+			t.Fatalf("%s: content type = %q, want an event stream", tt.address, got)
+		}
+		var got []claimEvent
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			readEvents(t, stream, func(e claimEvent) {
+				got = append(got, e)
+				switch e.Type {
+				case EventQueued:
+					s.mutex.Unlock()
+					s.consumeQueue()
+				case EventBroadcast:
+					tx.mine(common.HexToHash(e.TxHash), tt.status, 7)
+					s.checkReceipts(context.Background())
+				}
+			})
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: stream did not end, got %+v", tt.address, got)
+		}
+		stream.Body.Close()
+
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: events = %+v, want %v", tt.address, got, tt.want)
+		}
+		for i, e := range got {
+			if e.Type != tt.want[i] || e.ClaimID != id {
+				t.Errorf("%s: event %d = %+v, want %s of %s", tt.address, i, e, tt.want[i], id)
+			}
+		}
+		if got[0].Position != 1 || got[1].TxHash == "" {
+			t.Errorf("%s: events = %+v, want position 1 and a tx hash", tt.address, got)
+		}
+		record, _ := s.cfg.ledger.Get(id)
+		if tt.status == types.ReceiptStatusSuccessful && (record.Status != ClaimMined || record.Block != 7 || got[2].Block != 7) {
+			t.Errorf("%s: record = %+v, want mined in block 7", tt.address, record)
+		}
+		if tt.status == types.ReceiptStatusFailed && record.Status != ClaimFailed {
+			t.Errorf("%s: record = %+v, want failed", tt.address, record)
+		}
+
+		// A settled claim is streamed as its final event.
+		replay, err := ts.Client().Get(ts.URL + "/api/v2/claims/" + id + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var final []claimEvent
+		readEvents(t, replay, func(e claimEvent) { final = append(final, e) })
+		replay.Body.Close()
+		if len(final) != 1 || final[0].Type != tt.want[2] {
+			t.Errorf("%s: replay = %+v, want only %s", tt.address, final, tt.want[2])
+		}
+	}
+
+	resp, err := ts.Client().Get(ts.URL + "/api/v2/claims/bogus/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("events of an unknown claim: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestReceiptTimeout(t *testing.T) {
+	tx := &fakeReceipts{receipts: make(map[common.Hash]*types.Receipt)}
+	s := NewServer(tx, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	txHash := common.HexToHash("0x01")
+	record := s.cfg.ledger.Add(ClaimRecord{Address: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", Symbol: "xt", Status: ClaimSent, TxHash: txHash.Hex()})
+	events, stop := s.feed.follow(record.ID)
+	defer stop()
+
+	s.pending.add(txHash, record.ID, time.Now().Add(-receiptTimeout/2))
+	s.checkReceipts(context.Background())
+	if got, _ := s.cfg.ledger.Get(record.ID); got.Status != ClaimSent || len(events) != 0 {
+		t.Fatalf("record = %+v, want still sent before the timeout", got)
+	}
+
+	s.pending.remove(txHash)
+	s.pending.add(txHash, record.ID, time.Now().Add(-receiptTimeout-time.Minute))
+	s.checkReceipts(context.Background())
+	got, _ := s.cfg.ledger.Get(record.ID)
+	if got.Status != ClaimFailed || got.Error == "" || !s.settled(got) {
+		t.Errorf("record = %+v, want failed and settled after the timeout", got)
+	}
+	select {
+	case e := <-events:
+		if e.Type != EventFailed || e.TxHash != txHash.Hex() {
+			t.Errorf("event = %+v, want %s of %s", e, EventFailed, txHash.Hex())
+		}
+	default:
+		t.Error("no event was published after the timeout")
+	}
+	if len(s.pending.snapshot()) != 0 {
+		t.Error("transaction is still watched after the timeout")
+	}
+}
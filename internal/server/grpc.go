@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/chainflag/eth-faucet/api/faucetpb"
+)
+
+// grpcErrorDomain is the domain of the ErrorInfo details of a gRPC error, whose reason is one of
+// the error codes of the JSON API.
+const grpcErrorDomain = "eth-faucet"
+
+// grpcCodes maps the error codes of the JSON API to gRPC status codes.
+var grpcCodes = map[string]codes.Code{
+	CodeInvalidRequest:       codes.InvalidArgument,
+	CodeInvalidAddress:       codes.InvalidArgument,
+	CodeInvalidAmount:        codes.InvalidArgument,
+	CodeUnknownAsset:         codes.InvalidArgument,
+	CodeUnauthorized:         codes.Unauthenticated,
+	CodeForbidden:            codes.PermissionDenied,
+	CodeVerificationRequired: codes.Unauthenticated,
+	CodeVerificationFailed:   codes.PermissionDenied,
+	CodeRateLimited:          codes.ResourceExhausted,
+	CodeQueueFull:            codes.Unavailable,
+	CodeInsufficientFunds:    codes.FailedPrecondition,
+	CodeTransferFailed:       codes.Internal,
+	CodeUnavailable:          codes.Unavailable,
+	CodeNotFound:             codes.NotFound,
+	CodeConflict:             codes.Aborted,
+	CodePaused:               codes.Unavailable,
+}
+
+// grpcError turns a rejected claim into a gRPC status, with the error code as the reason of its
+// ErrorInfo and the wait of a rate limited claim as its RetryInfo.
+func grpcError(e *claimError) error {
+	st := status.New(grpcCodes[e.code], e.message)
+	if withInfo, err := st.WithDetails(&errdetails.ErrorInfo{Reason: e.code, Domain: grpcErrorDomain}); err == nil {
+		st = withInfo
+	}
+	if e.wait > 0 {
+		retry := &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(e.retryAfter()) * time.Second)}
+		if withRetry, err := st.WithDetails(retry); err == nil {
+			st = withRetry
+		}
+	}
+	return st.Err()
+}
+
+// GRPCServer returns a gRPC server of the faucet service. Its interceptors authenticate API keys
+// sent in the x-api-key metadata and count claims against the rate limits, as the middleware of
+// the HTTP API does. The anti-bot guards can only be passed in a browser, so a faucet that runs
+// any of them takes gRPC claims only with an API key.
+func (s *Server) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(s.grpcAuth, s.grpcLimit))
+	srv := grpc.NewServer(opts...)
+	faucetpb.RegisterFaucetServer(srv, grpcFaucet{s: s})
+	return srv
+}
+
+// RunGRPC serves the gRPC service on the port.
+func (s *Server) RunGRPC(port int) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Starting grpc server %d", port)
+	log.Fatal(s.GRPCServer().Serve(listener))
+}
+
+// grpcAuth authenticates the API key of a call, if it carries one, and passes the key on in the
+// context.
+func (s *Server) grpcAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(strings.ToLower(APIKeyHeader))
+	if len(values) == 0 {
+		return handler(ctx, req)
+	}
+	key, ok := s.cfg.keys.Authenticate(values[0])
+	if !ok {
+		return nil, grpcError(&claimError{code: CodeUnauthorized, message: "invalid api key"})
+	}
+	log.WithField("apiKey", key.ID).Debug("Claim made with an API key")
+	return handler(context.WithValue(ctx, apiKeyCtxKey{}, key), req)
+}
+
+// grpcLimit counts claims against the rate limits, and refunds them if the claim fails.
+func (s *Server) grpcLimit(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	in, ok := req.(*faucetpb.ClaimRequest)
+	if !ok {
+		return handler(ctx, req)
+	}
+	if len(s.cfg.guards) > 0 && apiKeyFrom(ctx) == nil {
+		return nil, grpcError(&claimError{code: CodeUnauthorized, message: "an API key is required to claim over gRPC"})
+	}
+	a, rejected := s.limiter.admit(ctx, in.Address, in.Asset, in.Amount, peerIP(ctx))
+	if rejected != nil {
+		return nil, grpcError(rejected)
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		a.refund(ctx)
+		return nil, err
+	}
+	a.accept()
+	return resp, nil
+}
+
+// peerIP returns the IP address of the client of a call. Proxy headers are not trusted, so the
+// gRPC port should be reached directly.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcFaucet implements the faucet service on top of the server.
+type grpcFaucet struct {
+	faucetpb.UnimplementedFaucetServer
+	s *Server
+}
+
+func (g grpcFaucet) Claim(ctx context.Context, in *faucetpb.ClaimRequest) (*faucetpb.Claim, error) {
+	c, err := g.s.newClaim(in.Address, in.Asset, in.Amount)
+	if err != nil {
+		return nil, grpcError(&claimError{code: claimErrorCode(err), message: err.Error()})
+	}
+	c = g.s.record(ctx, c, peerIP(ctx), "")
+	if _, _, rejected := g.s.pay(ctx, c); rejected != nil {
+		return nil, grpcError(rejected)
+	}
+	record, _ := g.s.cfg.ledger.Get(c.id)
+	return g.s.claimProto(record), nil
+}
+
+func (g grpcFaucet) GetClaim(_ context.Context, in *faucetpb.GetClaimRequest) (*faucetpb.Claim, error) {
+	record, ok := g.s.cfg.ledger.Get(in.Id)
+	if !ok {
+		return nil, grpcError(&claimError{code: CodeNotFound, message: "unknown claim"})
+	}
+	return g.s.claimProto(record), nil
+}
+
+func (g grpcFaucet) StreamClaimUpdates(in *faucetpb.GetClaimRequest, stream faucetpb.Faucet_StreamClaimUpdatesServer) error {
+	// Follow before the first lookup, so no event in between is missed.
+	events, stop := g.s.feed.follow(in.Id)
+	defer stop()
+	record, ok := g.s.cfg.ledger.Get(in.Id)
+	if !ok {
+		return grpcError(&claimError{code: CodeNotFound, message: "unknown claim"})
+	}
+	for {
+		if err := stream.Send(g.s.claimProto(record)); err != nil {
+			return err
+		}
+		if g.s.settled(record) {
+			return nil
+		}
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-events:
+			if record, ok = g.s.cfg.ledger.Get(in.Id); !ok {
+				return grpcError(&claimError{code: CodeNotFound, message: "unknown claim"})
+			}
+		}
+	}
+}
+
+func (g grpcFaucet) GetInfo(context.Context, *faucetpb.GetInfoRequest) (*faucetpb.Info, error) {
+	info := g.s.info()
+	out := &faucetpb.Info{
+		Account:     info.Account,
+		Network:     info.Network,
+		Payout:      info.Payout,
+		Symbol:      info.Symbol,
+		Name:        info.Name,
+		Queue:       int32(info.Queue),
+		ExplorerUrl: info.Explorer,
+	}
+	for _, asset := range info.Assets {
+		out.Assets = append(out.Assets, &faucetpb.Asset{
+			Symbol:      asset.Symbol,
+			Name:        asset.Name,
+			Decimals:    int32(asset.Decimals),
+			Address:     asset.Address,
+			LogoUri:     asset.LogoURI,
+			Payout:      asset.Payout,
+			Cooldown:    asset.Cooldown,
+			DailyCap:    asset.DailyCap,
+			MinAmount:   asset.Min,
+			MaxAmount:   asset.Max,
+			Quota:       asset.Quota,
+			IpQuota:     asset.IPQuota,
+			SubnetQuota: asset.Subnet,
+			Enabled:     asset.Enabled,
+			Balance:     asset.Balance,
+		})
+	}
+	for name, settings := range info.AntiBot {
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if out.AntiBot == nil {
+			out.AntiBot = make(map[string]string)
+		}
+		out.AntiBot[name] = string(data)
+	}
+	return out, nil
+}
+
+var claimStatuses = map[string]faucetpb.ClaimStatus{
+	ClaimQueued: faucetpb.ClaimStatus_CLAIM_STATUS_QUEUED,
+	ClaimSent:   faucetpb.ClaimStatus_CLAIM_STATUS_SENT,
+	ClaimMined:  faucetpb.ClaimStatus_CLAIM_STATUS_MINED,
+	ClaimFailed: faucetpb.ClaimStatus_CLAIM_STATUS_FAILED,
+}
+
+func (s *Server) claimProto(record ClaimRecord) *faucetpb.Claim {
+	result := s.claimResult(record)
+	return &faucetpb.Claim{
+		Id:            result.ID,
+		Status:        claimStatuses[result.Status],
+		Address:       result.Address,
+		Asset:         result.Asset,
+		Amount:        result.Amount,
+		TxHash:        result.TxHash,
+		Error:         result.Error,
+		CreatedAt:     timestamppb.New(result.CreatedAt),
+		UpdatedAt:     timestamppb.New(result.UpdatedAt),
+		Block:         result.Block,
+		QueuePosition: int32(result.Position),
+	}
+}
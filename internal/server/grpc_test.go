@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/chainflag/eth-faucet/api/faucetpb"
+)
+
+func newTestGRPC(t *testing.T, s *Server) faucetpb.FaucetClient {
+	listener := bufconn.Listen(1 << 20)
+	srv := s.GRPCServer()
+	go srv.Serve(listener)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+	})
+	return faucetpb.NewFaucetClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	keys, err := NewKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, _, err := keys.Create(APIKey{Name: "ci", DailyClaims: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(&fakeTxBuilder{}, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, keys, nil, BatchConfig{}, AdminConfig{}, rejectAll{}))
+	client := newTestGRPC(t, s)
+
+	const alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+	anonymous := context.Background()
+	withKey := metadata.AppendToOutgoingContext(anonymous, "x-api-key", plaintext)
+	badKey := metadata.AppendToOutgoingContext(anonymous, "x-api-key", "fk_bogus")
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		address   string
+		asset     string
+		want      codes.Code
+		wantCode  string
+		wantRetry bool
+	}{
+		{name: "no api key", ctx: anonymous, address: alice, want: codes.Unauthenticated, wantCode: CodeUnauthorized},
+		{name: "invalid api key", ctx: badKey, address: alice, want: codes.Unauthenticated, wantCode: CodeUnauthorized},
+		{name: "invalid address", ctx: withKey, address: "0x1", want: codes.InvalidArgument, wantCode: CodeInvalidAddress},
+		{name: "unknown asset", ctx: withKey, address: alice, asset: "doge", want: codes.InvalidArgument, wantCode: CodeUnknownAsset},
+		{name: "sent", ctx: withKey, address: alice, asset: "xt", want: codes.OK},
+		{name: "rate limited", ctx: withKey, address: alice, want: codes.ResourceExhausted, wantCode: CodeRateLimited, wantRetry: true},
+	}
+	for _, tt := range tests {
+		claim, err := client.Claim(tt.ctx, &faucetpb.ClaimRequest{Address: tt.address, Asset: tt.asset})
+		st := status.Convert(err)
+		if st.Code() != tt.want {
+			t.Errorf("%s: code = %v, want %v: %v", tt.name, st.Code(), tt.want, err)
+			continue
+		}
+		if tt.want == codes.OK {
+			if claim.Status != faucetpb.ClaimStatus_CLAIM_STATUS_SENT || claim.TxHash == "" || claim.Amount != "1" {
+				t.Errorf("%s: claim = %v, want a sent claim of 1 xt", tt.name, claim)
+			}
+			got, err := client.GetClaim(anonymous, &faucetpb.GetClaimRequest{Id: claim.Id})
+			if err != nil || got.TxHash != claim.TxHash {
+				t.Errorf("%s: GetClaim() = %v, %v, want %s", tt.name, got, err, claim.TxHash)
+			}
+			continue
+		}
+		var reason string
+		var retry bool
+		for _, detail := range st.Details() {
+			switch detail := detail.(type) {
+			case *errdetails.ErrorInfo:
+				reason = detail.Reason
+			case *errdetails.RetryInfo:
+				retry = detail.RetryDelay.AsDuration() > 0
+			}
+		}
+		if reason != tt.wantCode || retry != tt.wantRetry {
+			t.Errorf("%s: reason = %q, retry = %v, want %q, %v", tt.name, reason, retry, tt.wantCode, tt.wantRetry)
+		}
+	}
+
+	if _, err := client.GetClaim(anonymous, &faucetpb.GetClaimRequest{Id: "bogus"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetClaim(bogus) error = %v, want NotFound", err)
+	}
+	info, err := client.GetInfo(anonymous, &faucetpb.GetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Network != "testnet" || len(info.Assets) != 1 || info.Assets[0].Symbol != "xt" || info.AntiBot["reject"] != "null" {
+		t.Errorf("GetInfo() = %v, want the xt asset and the reject guard", info)
+	}
+}
+
+func TestGRPCStreamClaimUpdates(t *testing.T) {
+	s := NewServer(&fakeTxBuilder{}, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	client := newTestGRPC(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Hold the faucet busy so the claim is queued.
+	s.mutex.Lock()
+	claim, err := client.Claim(ctx, &faucetpb.ClaimRequest{Address: "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.StreamClaimUpdates(ctx, &faucetpb.GetClaimRequest{Id: claim.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.Status != faucetpb.ClaimStatus_CLAIM_STATUS_QUEUED {
+		t.Fatalf("first update = %v, %v, want the queued claim", first, err)
+	}
+	s.mutex.Unlock()
+	s.consumeQueue()
+
+	last, err := stream.Recv()
+	if err != nil || last.Status != faucetpb.ClaimStatus_CLAIM_STATUS_SENT || last.TxHash == "" {
+		t.Fatalf("last update = %v, %v, want the sent claim", last, err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("stream after the claim was sent: %v, want EOF", err)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/negroni"
+)
+
+// IdempotencyKeyHeader is the request header that makes a claim safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// idempotencyTTL is how long the claim made under an idempotency key is remembered.
+	idempotencyTTL = 24 * time.Hour
+	// maxIdempotencyKey caps the length of an idempotency key.
+	maxIdempotencyKey = 255
+)
+
+// idempotentClaim is the claim made under an idempotency key, as it is kept in the limiter
+// store. The result is nil until the claim has been accepted.
+type idempotentClaim struct {
+	Request string       `json:"request"`
+	Result  *claimResult `json:"result,omitempty"`
+}
+
+// idempotencyKeys remembers which claim was made under each idempotency key, so that a
+// retried request is answered with the original claim instead of being claimed again. They
+// are kept in the limiter store, so a retry that reaches another replica is answered too.
+type idempotencyKeys struct {
+	store LimiterStore
+}
+
+// begin returns the claim made under the key, or reserves the key for the request and reports
+// true if there is none yet.
+func (k idempotencyKeys) begin(ctx context.Context, key, request string) (idempotentClaim, bool, error) {
+	value, _ := json.Marshal(idempotentClaim{Request: request})
+	stored, fresh, err := k.store.Remember(ctx, "idempotency:"+key, string(value), idempotencyTTL)
+	if err != nil || fresh {
+		return idempotentClaim{}, fresh, err
+	}
+	var original idempotentClaim
+	if err := json.Unmarshal([]byte(stored), &original); err != nil {
+		return idempotentClaim{}, false, fmt.Errorf("malformed idempotency key %s: %w", key, err)
+	}
+	return original, false, nil
+}
+
+// finish records the claim accepted under a reserved key.
+func (k idempotencyKeys) finish(ctx context.Context, key, request string, result claimResult) error {
+	value, _ := json.Marshal(idempotentClaim{Request: request, Result: &result})
+	return k.store.Overwrite(ctx, "idempotency:"+key, string(value), idempotencyTTL)
+}
+
+// forget releases a reserved key whose claim was not accepted, so it can be retried.
+func (k idempotencyKeys) forget(ctx context.Context, key string) error {
+	return k.store.Forget(ctx, "idempotency:"+key)
+}
+
+// idempotent answers a claim retried with the Idempotency-Key of an accepted claim with that
+// claim, before it reaches the guards and the rate limits. Keys are scoped to the API key the
+// claim is made with, or else to the client IP, and may not be reused for a different claim.
+// Claims that are not accepted, such as rate limited ones, release their key.
+func (s *Server) idempotent(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("the %s header is too long", IdempotencyKeyHeader))
+		return
+	}
+	if apiKey := apiKeyFrom(r.Context()); apiKey != nil {
+		key = "key:" + apiKey.ID + ":" + key
+	} else {
+		key = "ip:" + s.cfg.clientIP.ClientIP(r) + ":" + key
+	}
+	request := strings.Join([]string{r.PostFormValue(AddressKey), r.PostFormValue(SymbolKey), r.PostFormValue(AmountKey)}, "\n")
+
+	ctx := r.Context()
+	original, fresh, err := s.replays.begin(ctx, key, request)
+	switch {
+	case err != nil:
+		log.WithError(err).Error("Failed to look up an idempotency key")
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "idempotency keys are unavailable, please try again later")
+	case fresh:
+		next.ServeHTTP(w, r)
+		if id := w.Header().Get("X-Claim-Id"); id != "" && w.(negroni.ResponseWriter).Status() == http.StatusOK {
+			record, _ := s.cfg.ledger.Get(id)
+			if err := s.replays.finish(ctx, key, request, s.claimResult(record)); err != nil {
+				log.WithError(err).WithField("claim", id).Error("Failed to record the claim of an idempotency key")
+			}
+			return
+		}
+		if err := s.replays.forget(ctx, key); err != nil {
+			log.WithError(err).Error("Failed to release an idempotency key")
+		}
+	case original.Request != request:
+		writeError(w, r, http.StatusUnprocessableEntity, CodeInvalidRequest, fmt.Sprintf("this %s was used for a different claim", IdempotencyKeyHeader))
+	case original.Result == nil:
+		writeError(w, r, http.StatusConflict, CodeConflict, fmt.Sprintf("a claim with this %s is in progress", IdempotencyKeyHeader))
+	default:
+		// The claim is described as this replica knows it now, or as it was accepted if it was
+		// made by another one.
+		result := *original.Result
+		if record, ok := s.cfg.ledger.Get(result.ID); ok {
+			result = s.claimResult(record)
+		}
+		w.Header().Set("X-Claim-Id", result.ID)
+		w.Header().Set("Idempotent-Replayed", "true")
+		if !wantsJSON(r) {
+			if result.TxHash == "" {
+				fmt.Fprintf(w, "Added %s to the queue", result.Address)
+			} else {
+				fmt.Fprintf(w, "Txhash: %s", result.TxHash)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
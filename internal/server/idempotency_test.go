@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	tx := &fakeTxBuilder{}
+	s := NewServer(tx, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	router := s.setupRouter()
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+	)
+	claim := func(key, address string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v2/claim", strings.NewReader(`{"address": "`+address+`"}`))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := claim("run-1", alice)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first claim: status = %d, want 200: %s", first.Code, first.Body)
+	}
+	id := first.Header().Get("X-Claim-Id")
+
+	tests := []struct {
+		name     string
+		key      string
+		address  string
+		txErr    error
+		want     int
+		wantCode string
+		replayed bool
+	}{
+		{name: "retried", key: "run-1", address: alice, want: http.StatusOK, replayed: true},
+		{name: "without a key", address: alice, want: http.StatusTooManyRequests, wantCode: CodeRateLimited},
+		{name: "other claim", key: "run-1", address: bob, want: http.StatusUnprocessableEntity, wantCode: CodeInvalidRequest},
+		{name: "too long", key: strings.Repeat("k", maxIdempotencyKey+1), address: bob, want: http.StatusBadRequest, wantCode: CodeInvalidRequest},
+		{name: "failed transfer", key: "run-2", address: bob, txErr: errors.New("nonce too low"), want: http.StatusInternalServerError, wantCode: CodeTransferFailed},
+		// A claim that was not accepted doesn't hold on to its key.
+		{name: "retried after a failure", key: "run-2", address: bob, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tx.err = tt.txErr
+		rec := claim(tt.key, tt.address)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+			continue
+		}
+		if tt.wantCode != "" {
+			var body struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error.Code != tt.wantCode {
+				t.Errorf("%s: error = %+v, %v, want code %s", tt.name, body.Error, err, tt.wantCode)
+			}
+			continue
+		}
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("%s: replayed = %v, want %v", tt.name, replayed, tt.replayed)
+		}
+		if tt.replayed && (rec.Header().Get("X-Claim-Id") != id || rec.Body.String() != first.Body.String()) {
+			t.Errorf("%s: reply = %s, want the original claim %s", tt.name, rec.Body, first.Body)
+		}
+	}
+
+	// A retry while the original claim is still being handled has to wait for it.
+	if _, fresh, _ := s.replays.begin(context.Background(), "ip:192.0.2.1:run-3", alice+"\n\n"); !fresh {
+		t.Fatal("begin() of a new key = false, want true")
+	}
+	if rec := claim("run-3", alice); rec.Code != http.StatusConflict {
+		t.Errorf("claim in progress: status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestIdempotencyKeySharedBetweenReplicas(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	var routers []http.Handler
+	var builders []*countingTxBuilder
+	for i := 0; i < 2; i++ {
+		store := NewRedisStore(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), "test:")
+		tx := &countingTxBuilder{}
+		s := NewServer(tx, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, store, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+		routers, builders = append(routers, s.setupRouter()), append(builders, tx)
+	}
+	claim := func(router http.Handler, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v2/claim", strings.NewReader(`{"address": "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"}`))
+		req.RemoteAddr = remote
+		req.Header.Set(IdempotencyKeyHeader, "run-1")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := claim(routers[0], "198.51.100.1:1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first claim: status = %d, want 200: %s", first.Code, first.Body)
+	}
+	retry := claim(routers[1], "198.51.100.1:1")
+	if retry.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("X-Claim-Id") != first.Header().Get("X-Claim-Id") {
+		t.Errorf("retry on another replica: status = %d, headers = %v, want the original claim", retry.Code, retry.Header())
+	}
+	if builders[1].transfers != 0 {
+		t.Errorf("retry on another replica paid out %d times, want 0", builders[1].transfers)
+	}
+
+	// Another client can't replay the claim with the same key.
+	if rec := claim(routers[1], "198.51.100.2:1"); rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("claim of another client was replayed: %v", rec.Header())
+	}
+}
+
+// countingTxBuilder counts the transfers it makes.
+type countingTxBuilder struct {
+	fakeTxBuilder
+	transfers int
+}
+
+func (c *countingTxBuilder) Transfer(ctx context.Context, to string, value *big.Int) (common.Hash, error) {
+	c.transfers++
+	return c.fakeTxBuilder.Transfer(ctx, to, value)
+}
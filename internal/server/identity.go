@@ -0,0 +1,408 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Identity providers a claimant can log in with.
+const (
+	OIDCProvider   = "oidc"
+	GitHubProvider = "github"
+)
+
+const (
+	sessionCookie = "faucet_session"
+	stateCookie   = "faucet_oauth_state"
+)
+
+var githubEndpoints = struct{ auth, token, userInfo string }{
+	auth:     "https://github.com/login/oauth/authorize",
+	token:    "https://github.com/login/oauth/access_token",
+	userInfo: "https://api.github.com/user",
+}
+
+type IdentityConfig struct {
+	Provider     string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// Issuer is the OIDC issuer whose discovery document lists the provider's endpoints.
+	Issuer string
+	// AuthURL, TokenURL and UserInfoURL override the endpoints of the provider.
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	// MinAccountAge rejects logins of accounts created more recently, read from the
+	// CreatedClaim field of the user info. Zero disables the check.
+	MinAccountAge time.Duration
+	CreatedClaim  string
+	// SessionSecret signs session cookies. Replicas behind one load balancer need the same secret.
+	SessionSecret []byte
+	SessionTTL    time.Duration
+}
+
+// Identity is a guard that requires claimants to log in with an OAuth or OIDC provider. The
+// limiter then also applies each asset's quota per identity, so one account can't claim to
+// many addresses from many IPs.
+type Identity struct {
+	cfg         IdentityConfig
+	oauth       *oauth2.Config
+	userInfoURL string
+	now         func() time.Time
+}
+
+// NewIdentity creates the guard, looking up the endpoints of an OIDC provider from its
+// discovery document unless they are configured.
+func NewIdentity(ctx context.Context, cfg IdentityConfig) (*Identity, error) {
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("login needs a client id and a redirect url")
+	}
+	switch cfg.Provider {
+	case GitHubProvider:
+		if cfg.AuthURL == "" {
+			cfg.AuthURL = githubEndpoints.auth
+		}
+		if cfg.TokenURL == "" {
+			cfg.TokenURL = githubEndpoints.token
+		}
+		if cfg.UserInfoURL == "" {
+			cfg.UserInfoURL = githubEndpoints.userInfo
+		}
+		if cfg.Scopes == nil {
+			cfg.Scopes = []string{"read:user"}
+		}
+	case OIDCProvider:
+		if cfg.AuthURL == "" || cfg.TokenURL == "" || cfg.UserInfoURL == "" {
+			if err := discoverOIDC(ctx, &cfg); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.Scopes == nil {
+			cfg.Scopes = []string{"openid", "profile"}
+		}
+	default:
+		return nil, fmt.Errorf("unknown login provider %q", cfg.Provider)
+	}
+	if cfg.CreatedClaim == "" {
+		cfg.CreatedClaim = "created_at"
+	}
+	if cfg.SessionTTL <= 0 {
+		return nil, fmt.Errorf("login session ttl must be positive, got %s", cfg.SessionTTL)
+	}
+	if len(cfg.SessionSecret) == 0 {
+		cfg.SessionSecret = make([]byte, 32)
+		if _, err := rand.Read(cfg.SessionSecret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Identity{
+		cfg: cfg,
+		oauth: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     oauth2.Endpoint{AuthURL: cfg.AuthURL, TokenURL: cfg.TokenURL},
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+		},
+		userInfoURL: cfg.UserInfoURL,
+		now:         time.Now,
+	}, nil
+}
+
+// discoverOIDC fills in the endpoints the configuration leaves out from the issuer's
+// discovery document.
+func discoverOIDC(ctx context.Context, cfg *IdentityConfig) error {
+	if cfg.Issuer == "" {
+		return fmt.Errorf("oidc login needs an issuer or all of its endpoints")
+	}
+	url := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc discovery at %s returned %s", url, resp.Status)
+	}
+
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("invalid oidc discovery document: %w", err)
+	}
+	for _, endpoint := range []struct {
+		value      *string
+		discovered string
+	}{
+		{&cfg.AuthURL, doc.AuthorizationEndpoint},
+		{&cfg.TokenURL, doc.TokenEndpoint},
+		{&cfg.UserInfoURL, doc.UserInfoEndpoint},
+	} {
+		if *endpoint.value == "" {
+			*endpoint.value = endpoint.discovered
+		}
+	}
+	if cfg.AuthURL == "" || cfg.TokenURL == "" || cfg.UserInfoURL == "" {
+		return fmt.Errorf("oidc discovery document at %s lacks endpoints", url)
+	}
+	return nil
+}
+
+func (i *Identity) Name() string {
+	return "login"
+}
+
+// Public returns the provider and the endpoints the frontend logs in with.
+func (i *Identity) Public() interface{} {
+	return map[string]string{
+		"provider":  i.cfg.Provider,
+		"loginURL":  "/api/login",
+		"logoutURL": "/api/logout",
+		"meURL":     "/api/me",
+	}
+}
+
+func (i *Identity) routes(router *http.ServeMux) {
+	router.Handle("/api/login", i.handleLogin())
+	router.Handle("/api/login/callback", i.handleCallback())
+	router.Handle("/api/logout", i.handleLogout())
+	router.Handle("/api/me", i.handleMe())
+}
+
+// identityKey is the request context key of the logged in identity.
+type identityKey struct{}
+
+// identityFrom returns the identity a claim was made with, or "" without a login.
+func identityFrom(ctx context.Context) string {
+	subject, _ := ctx.Value(identityKey{}).(string)
+	return subject
+}
+
+func (i *Identity) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	session, ok := i.session(r)
+	if !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "please log in to claim")
+		return
+	}
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, session.Subject)))
+}
+
+func (i *Identity) handleLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := make([]byte, 16)
+		if _, err := rand.Read(state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encoded := hex.EncodeToString(state)
+		http.SetCookie(w, i.cookie(stateCookie, encoded, 10*time.Minute))
+		http.Redirect(w, r, i.oauth.AuthCodeURL(encoded), http.StatusFound)
+	}
+}
+
+func (i *Identity) handleCallback() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, err := r.Cookie(stateCookie)
+		if err != nil || state.Value == "" || r.URL.Query().Get("state") != state.Value {
+			http.Error(w, "login state mismatch, please try again", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, i.cookie(stateCookie, "", -1))
+		if reason := r.URL.Query().Get("error"); reason != "" {
+			http.Error(w, "login failed: "+reason, http.StatusForbidden)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		token, err := i.oauth.Exchange(ctx, r.URL.Query().Get("code"))
+		if err != nil {
+			log.WithError(err).Warn("Failed to exchange login code")
+			http.Error(w, "login failed, please try again", http.StatusForbidden)
+			return
+		}
+		user, err := i.userInfo(ctx, token)
+		if err != nil {
+			log.WithError(err).Error("Failed to fetch user info")
+			http.Error(w, "login failed, please try again", http.StatusBadGateway)
+			return
+		}
+		if i.cfg.MinAccountAge > 0 {
+			if user.created.IsZero() || i.now().Sub(user.created) < i.cfg.MinAccountAge {
+				log.WithField("identity", user.Subject).Info("Rejected login of a new account")
+				http.Error(w, fmt.Sprintf("your account must be at least %s old to claim", i.cfg.MinAccountAge), http.StatusForbidden)
+				return
+			}
+		}
+
+		user.Expires = i.now().Add(i.cfg.SessionTTL).Unix()
+		http.SetCookie(w, i.cookie(sessionCookie, i.encodeSession(user), i.cfg.SessionTTL))
+		log.WithField("identity", user.Subject).Info("Logged in")
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+func (i *Identity) handleLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		http.SetCookie(w, i.cookie(sessionCookie, "", -1))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (i *Identity) handleMe() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := i.session(r)
+		if !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+	}
+}
+
+// identitySession is the content of a session cookie.
+type identitySession struct {
+	Subject string `json:"subject"`
+	Name    string `json:"name"`
+	Expires int64  `json:"expires"`
+
+	created time.Time
+}
+
+// userInfo fetches the logged in user from the provider. Subjects are prefixed with the
+// provider so that identities of different providers never share quotas.
+func (i *Identity) userInfo(ctx context.Context, token *oauth2.Token) (identitySession, error) {
+	resp, err := i.oauth.Client(ctx, token).Get(i.userInfoURL)
+	if err != nil {
+		return identitySession{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return identitySession{}, fmt.Errorf("user info endpoint returned %s", resp.Status)
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return identitySession{}, fmt.Errorf("invalid user info: %w", err)
+	}
+
+	subjectClaim := "sub"
+	if i.cfg.Provider == GitHubProvider {
+		subjectClaim = "id"
+	}
+	subject := claimString(claims[subjectClaim])
+	if subject == "" {
+		return identitySession{}, fmt.Errorf("user info lacks %q", subjectClaim)
+	}
+	user := identitySession{Subject: i.cfg.Provider + ":" + subject}
+	for _, name := range []string{"preferred_username", "login", "name", "email"} {
+		if user.Name = claimString(claims[name]); user.Name != "" {
+			break
+		}
+	}
+	user.created = claimTime(claims[i.cfg.CreatedClaim])
+	return user, nil
+}
+
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// claimTime reads a time given either as an RFC 3339 string or as unix seconds.
+func claimTime(value interface{}) time.Time {
+	switch v := value.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t
+		}
+	case json.Number:
+		if seconds, err := v.Int64(); err == nil {
+			return time.Unix(seconds, 0)
+		}
+	}
+	return time.Time{}
+}
+
+func (i *Identity) encodeSession(session identitySession) string {
+	data, _ := json.Marshal(session)
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return encoded + "." + i.sign(encoded)
+}
+
+// session returns the unexpired session the request's cookie holds.
+func (i *Identity) session(r *http.Request) (identitySession, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return identitySession{}, false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(i.sign(parts[0]))) {
+		return identitySession{}, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return identitySession{}, false
+	}
+	var session identitySession
+	if err := json.Unmarshal(data, &session); err != nil || session.Subject == "" {
+		return identitySession{}, false
+	}
+	return session, i.now().Unix() < session.Expires
+}
+
+func (i *Identity) sign(encoded string) string {
+	mac := hmac.New(sha256.New, i.cfg.SessionSecret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookie builds a cookie scoped to the faucet. A negative ttl deletes the cookie.
+func (i *Identity) cookie(name, value string, ttl time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(i.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(ttl / time.Second),
+	}
+	if ttl < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/negroni"
+)
+
+// newMockIdentityProvider serves OIDC discovery, a token endpoint accepting any code and a
+// user info endpoint returning the user the code was issued for.
+func newMockIdentityProvider(users map[string]map[string]interface{}) *httptest.Server {
+	var provider *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+			"userinfo_endpoint":      provider.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PostFormValue("code")
+		if _, ok := users[code]; !ok {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token-" + code, "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		code := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer token-")
+		user, ok := users[code]
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	})
+	provider = httptest.NewServer(mux)
+	return provider
+}
+
+func TestIdentity(t *testing.T) {
+	provider := newMockIdentityProvider(map[string]map[string]interface{}{
+		"alice": {"sub": "1001", "preferred_username": "alice", "created_at": "2015-01-01T00:00:00Z"},
+		"bob":   {"sub": "1002", "preferred_username": "bob", "created_at": time.Now().Add(-24 * time.Hour).Unix()},
+	})
+	defer provider.Close()
+
+	identity, err := NewIdentity(context.Background(), IdentityConfig{
+		Provider:      OIDCProvider,
+		Issuer:        provider.URL,
+		ClientID:      "faucet",
+		ClientSecret:  "shh",
+		RedirectURL:   "http://faucet.test/api/login/callback",
+		MinAccountAge: 30 * 24 * time.Hour,
+		SessionTTL:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewIdentity() error = %v", err)
+	}
+	router := http.NewServeMux()
+	identity.routes(router)
+
+	login := func(code string) (*http.Cookie, int) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/login", nil))
+		location, _ := url.Parse(rec.Header().Get("Location"))
+		if !strings.HasPrefix(location.String(), provider.URL+"/authorize") {
+			t.Fatalf("login redirects to %s", location)
+		}
+		state := location.Query().Get("state")
+
+		req := httptest.NewRequest("GET", "/api/login/callback?code="+code+"&state="+state, nil)
+		for _, cookie := range rec.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == sessionCookie && cookie.Value != "" {
+				return cookie, rec.Code
+			}
+		}
+		return nil, rec.Code
+	}
+
+	if _, code := login("bob"); code != http.StatusForbidden {
+		t.Errorf("new account: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if _, code := login("mallory"); code != http.StatusForbidden {
+		t.Errorf("invalid code: status = %d, want %d", code, http.StatusForbidden)
+	}
+	session, code := login("alice")
+	if session == nil || code != http.StatusFound {
+		t.Fatalf("login: status = %d, session %v", code, session)
+	}
+
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.AddCookie(session)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"subject":"oidc:1001"`) {
+		t.Errorf("/api/me = %s, want the oidc:1001 subject", rec.Body)
+	}
+
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	settings := &Settings{Registry: newTestRegistry(usdc)}
+	limiter := NewLimiter(nil, nil, ClientIPConfig{}, func() *Settings { return settings })
+	handler := negroni.New(identity, limiter, negroni.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	claim := func(address string, cookie *http.Cookie) int {
+		form := url.Values{AddressKey: {address}, SymbolKey: {"usdc"}}
+		req := httptest.NewRequest("POST", "/api/claim", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	forged := *session
+	forged.Value = strings.Replace(forged.Value, ".", "x.", 1)
+	tests := []struct {
+		name    string
+		address string
+		cookie  *http.Cookie
+		want    int
+	}{
+		{name: "logged out", address: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", want: http.StatusUnauthorized},
+		{name: "forged session", address: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", cookie: &forged, want: http.StatusUnauthorized},
+		{name: "logged in", address: "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", cookie: session, want: http.StatusOK},
+		{name: "identity quota", address: "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8", cookie: session, want: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if got := claim(tt.address, tt.cookie); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	identity.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if got := claim("0x6eBE9511781cE5a000D29C1963158838278e274E", session); got != http.StatusUnauthorized {
+		t.Errorf("expired session: status = %d, want %d", got, http.StatusUnauthorized)
+	}
+}
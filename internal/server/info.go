@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/jellydator/ttlcache/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+const (
+	// balanceTTL is how long the faucet's balances are cached between on-chain reads.
+	balanceTTL = 15 * time.Second
+	// balanceTimeout bounds an on-chain balance read, so a slow node doesn't hold up the info.
+	balanceTimeout = 3 * time.Second
+)
+
+// assetInfo describes an asset the faucet pays out.
+type assetInfo struct {
+	Symbol   string `json:"symbol"`
+	Name     string `json:"name"`
+	Decimals int    `json:"decimals"`
+	Address  string `json:"address,omitempty"`
+	LogoURI  string `json:"logoURI,omitempty"`
+	Payout   string `json:"payout"`
+	Cooldown int64  `json:"cooldown"`
+	DailyCap string `json:"dailyCap,omitempty"`
+	Min      string `json:"minAmount"`
+	Max      string `json:"maxAmount"`
+	Quota    string `json:"quota"`
+	IPQuota  string `json:"ipQuota,omitempty"`
+	Subnet   string `json:"subnetQuota,omitempty"`
+	// Enabled tells whether the asset can be claimed. Tokens that failed validation, paused
+	// assets and assets the faucet holds too little of are listed but disabled.
+	Enabled bool   `json:"enabled"`
+	Paused  bool   `json:"paused,omitempty"`
+	Balance string `json:"balance,omitempty"`
+}
+
+// faucetInfo describes the faucet, its assets and the settings of its anti-bot checks.
+type faucetInfo struct {
+	Account string      `json:"account"`
+	Network string      `json:"network"`
+	Payout  string      `json:"payout"`
+	Symbol  string      `json:"symbol"`
+	Name    string      `json:"name"`
+	Assets  []assetInfo `json:"assets"`
+	// Queue is the number of claims waiting to be paid out.
+	Queue int `json:"queue"`
+	// Paused tells whether an operator paused the faucet. No asset can be claimed meanwhile.
+	Paused bool `json:"paused,omitempty"`
+	// Explorer is the block explorer URL of a transaction, with {tx} in place of its hash.
+	Explorer string                 `json:"explorerURL,omitempty"`
+	AntiBot  map[string]interface{} `json:"antiBot,omitempty"`
+}
+
+func (s *Server) handleInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.info())
+	}
+}
+
+// info describes the faucet with the running settings and its cached balances.
+func (s *Server) info() faucetInfo {
+	settings := s.current()
+	registry := settings.Registry
+	var assets []assetInfo
+	for _, asset := range registry.Assets() {
+		item := assetInfo{
+			Symbol:   asset.Symbol,
+			Name:     asset.Name,
+			Decimals: asset.Decimals,
+			LogoURI:  asset.LogoURI,
+			Payout:   chain.FormatUnits(asset.Payout, asset.Decimals),
+			Cooldown: int64(asset.Cooldown / time.Second),
+			Min:      chain.FormatUnits(asset.MinAmount, asset.Decimals),
+			Max:      chain.FormatUnits(asset.MaxAmount, asset.Decimals),
+			Quota:    chain.FormatUnits(asset.Quota, asset.Decimals),
+			Enabled:  !settings.Paused && !asset.Paused,
+			Paused:   asset.Paused,
+		}
+		if !asset.IsNative() {
+			item.Address = asset.Contract.Hex()
+		}
+		if asset.DailyCap != nil {
+			item.DailyCap = chain.FormatUnits(asset.DailyCap, asset.Decimals)
+		}
+		if asset.IPQuota != nil {
+			item.IPQuota = chain.FormatUnits(asset.IPQuota, asset.Decimals)
+		}
+		if asset.SubnetQuota != nil {
+			item.Subnet = chain.FormatUnits(asset.SubnetQuota, asset.Decimals)
+		}
+		if balance, ok := s.balances.get(asset.Symbol); ok {
+			item.Balance = chain.FormatUnits(balance, asset.Decimals)
+			item.Enabled = item.Enabled && balance.Cmp(asset.MinAmount) >= 0
+		}
+		assets = append(assets, item)
+	}
+	for _, asset := range registry.Disabled() {
+		assets = append(assets, assetInfo{
+			Symbol:   asset.Symbol,
+			Name:     asset.Name,
+			Decimals: asset.Decimals,
+			Address:  asset.Contract.Hex(),
+			LogoURI:  asset.LogoURI,
+		})
+	}
+
+	var antiBot map[string]interface{}
+	for _, guard := range s.cfg.guards {
+		if antiBot == nil {
+			antiBot = make(map[string]interface{})
+		}
+		antiBot[guard.Name()] = guard.Public()
+	}
+
+	native := registry.Native()
+	return faucetInfo{
+		Account:  s.tx.Sender().String(),
+		Network:  s.cfg.network,
+		Payout:   chain.FormatUnits(native.Payout, native.Decimals),
+		Symbol:   native.Symbol,
+		Name:     native.Name,
+		Assets:   assets,
+		Queue:    len(s.queue),
+		Paused:   settings.Paused,
+		Explorer: s.cfg.explorer,
+		AntiBot:  antiBot,
+	}
+}
+
+// errNoBalance is returned for an asset whose balance can't be read.
+var errNoBalance = errors.New("balance is unavailable")
+
+// balanceCache caches the faucet account's balance of each asset for balanceTTL, so that
+// frequent info requests don't each hit the chain.
+type balanceCache struct {
+	cache *ttlcache.Cache
+}
+
+// newBalanceCache creates a cache that reads a missing balance by symbol with read.
+func newBalanceCache(read func(ctx context.Context, symbol string) (*big.Int, error)) *balanceCache {
+	cache := ttlcache.NewCache()
+	cache.SkipTTLExtensionOnHit(true)
+	cache.SetLoaderFunction(func(symbol string) (interface{}, time.Duration, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), balanceTimeout)
+		defer cancel()
+		balance, err := read(ctx, symbol)
+		if err != nil {
+			return nil, 0, err
+		}
+		return balance, balanceTTL, nil
+	})
+	return &balanceCache{cache: cache}
+}
+
+// get returns the balance of the asset, or false if it can't be read.
+func (b *balanceCache) get(symbol string) (*big.Int, bool) {
+	value, err := b.cache.Get(symbol)
+	if err != nil {
+		if !errors.Is(err, errNoBalance) {
+			log.WithError(err).WithField("symbol", symbol).Warn("Failed to read the faucet balance")
+		}
+		return nil, false
+	}
+	return value.(*big.Int), true
+}
+
+// readBalance reads the faucet account's balance of the asset from the chain.
+func (s *Server) readBalance(ctx context.Context, symbol string) (*big.Int, error) {
+	asset, err := s.resolve(symbol)
+	if err != nil {
+		return nil, err
+	}
+	if asset.IsNative() {
+		reader, ok := s.tx.(chain.BalanceReader)
+		if !ok {
+			return nil, errNoBalance
+		}
+		return reader.Balance(ctx)
+	}
+	if asset.builder == nil {
+		return nil, errNoBalance
+	}
+	return asset.builder.BalanceOf(ctx, asset.builder.Sender())
+}
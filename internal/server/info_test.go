@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// fakeBalance is a transaction builder that counts how often its balance is read.
+type fakeBalance struct {
+	fakeTxBuilder
+	balance *big.Int
+	reads   int
+}
+
+func (f *fakeBalance) Balance(context.Context) (*big.Int, error) {
+	f.reads++
+	return f.balance, nil
+}
+
+func TestInfo(t *testing.T) {
+	const (
+		usdc = "0x30e78E4B291f69f540fd52b000e761F7378BEb86"
+		busd = "0x430EE2c2C8F97B17D8b6769156d156333062096E"
+		link = "0x2CaBf400FD6dD1897E3141535BAB50f9e575bDF1"
+	)
+	state := map[string]*fakeToken{
+		usdc: {hasCode: true, symbol: "USDC", decimals: 6, balance: big.NewInt(100)},
+		busd: {hasCode: false},
+		link: {hasCode: true, symbol: "LINK", decimals: 18, balance: chain.EtherToWei(5)},
+	}
+	configs := []Erc20Token{
+		{ContractAddress: usdc, Symbol: "usdc", Decimal: 6},
+		{ContractAddress: busd, Symbol: "busd", Name: "Binance USD", Decimal: 18},
+		{ContractAddress: link, Symbol: "link"},
+	}
+	registry, err := BuildRegistry(context.Background(), testNative, configs, testDefaults, fakeDialer(state), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &fakeBalance{balance: chain.EtherToWei(2)}
+	s := NewServer(tx, &Settings{Registry: registry}, NewConfig("testnet", "https://explorer.example/tx/{tx}", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	s.queue <- claim{}
+
+	info := s.info()
+	if info.Queue != 1 || info.Explorer != "https://explorer.example/tx/{tx}" {
+		t.Errorf("info = %+v, want a queue of 1 and the explorer", info)
+	}
+	want := []struct {
+		symbol  string
+		enabled bool
+		balance string
+	}{
+		{symbol: "xt", enabled: true, balance: "2"},
+		{symbol: "link", enabled: true, balance: "5"},
+		// The faucet holds less than a payout.
+		{symbol: "usdc", enabled: false, balance: "0.0001"},
+		// Failed validation.
+		{symbol: "busd", enabled: false},
+	}
+	if len(info.Assets) != len(want) {
+		t.Fatalf("assets = %+v, want %d of them", info.Assets, len(want))
+	}
+	for i, w := range want {
+		got := info.Assets[i]
+		if got.Symbol != w.symbol || got.Enabled != w.enabled || got.Balance != w.balance {
+			t.Errorf("asset %d = %+v, want %s enabled=%v balance=%q", i, got, w.symbol, w.enabled, w.balance)
+		}
+	}
+	if busdInfo := info.Assets[3]; busdInfo.Name != "Binance USD" || busdInfo.Address != busd || busdInfo.Payout != "" {
+		t.Errorf("disabled token = %+v, want its config only", busdInfo)
+	}
+
+	// Balances are read from the chain once per balanceTTL.
+	s.info()
+	if tx.reads != 1 {
+		t.Errorf("native balance read %d times, want once", tx.reads)
+	}
+}
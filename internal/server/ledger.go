@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultLedgerSize is how many claims a ledger keeps when none is configured.
+const defaultLedgerSize = 10000
+
+// Claim statuses recorded in the ledger. A sent claim is mined once the receipt of its
+// transaction is seen.
+const (
+	ClaimQueued = "queued"
+	ClaimSent   = "sent"
+	ClaimMined  = "mined"
+	ClaimFailed = "failed"
+)
+
+// ClaimRecord is the ledger entry of an accepted claim.
+type ClaimRecord struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	Symbol    string    `json:"symbol"`
+	Amount    string    `json:"amount"`
+	Status    string    `json:"status"`
+	TxHash    string    `json:"txHash,omitempty"`
+	Block     uint64    `json:"block,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ClientIP  string    `json:"clientIP,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	APIKey    string    `json:"apiKey,omitempty"`
+	Batch     string    `json:"batch,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Ledger keeps the most recent claims in memory so they can be looked up by ID, and appends
+// every change as a JSON line to an optional audit log.
+type Ledger struct {
+	mutex    sync.RWMutex
+	records  map[string]*ClaimRecord
+	order    []string
+	capacity int
+	audit    io.Writer
+	now      func() time.Time
+}
+
+// NewLedger creates a ledger holding up to capacity claims. The audit writer may be nil.
+func NewLedger(capacity int, audit io.Writer) *Ledger {
+	return &Ledger{
+		records:  make(map[string]*ClaimRecord),
+		capacity: capacity,
+		audit:    audit,
+		now:      time.Now,
+	}
+}
+
+// Add records a new claim under a fresh ID and returns the record.
+func (l *Ledger) Add(record ClaimRecord) ClaimRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record.ID = newClaimID()
+	record.CreatedAt = l.now()
+	record.UpdatedAt = record.CreatedAt
+	l.records[record.ID] = &record
+	l.order = append(l.order, record.ID)
+	if l.capacity > 0 && len(l.order) > l.capacity {
+		delete(l.records, l.order[0])
+		l.order = l.order[1:]
+	}
+	l.write(record)
+	return record
+}
+
+// Update changes a recorded claim and returns the result. It reports false if the claim is
+// unknown or has been evicted.
+func (l *Ledger) Update(id string, update func(*ClaimRecord)) (ClaimRecord, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record, ok := l.records[id]
+	if !ok {
+		return ClaimRecord{}, false
+	}
+	update(record)
+	record.UpdatedAt = l.now()
+	l.write(*record)
+	return *record, true
+}
+
+// Get returns the claim with the ID.
+func (l *Ledger) Get(id string) (ClaimRecord, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	record, ok := l.records[id]
+	if !ok {
+		return ClaimRecord{}, false
+	}
+	return *record, true
+}
+
+// List returns up to limit claims that match the filter, newest first. A limit of zero
+// returns all of them.
+func (l *Ledger) List(match func(ClaimRecord) bool, limit int) []ClaimRecord {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	records := []ClaimRecord{}
+	for i := len(l.order) - 1; i >= 0; i-- {
+		record := *l.records[l.order[i]]
+		if match != nil && !match(record) {
+			continue
+		}
+		records = append(records, record)
+		if limit > 0 && len(records) == limit {
+			break
+		}
+	}
+	return records
+}
+
+func (l *Ledger) write(record ClaimRecord) {
+	if l.audit == nil {
+		return
+	}
+	data, _ := json.Marshal(record)
+	if _, err := l.audit.Write(append(data, '\n')); err != nil {
+		log.WithError(err).Error("Failed to write claim ledger")
+	}
+}
+
+func newClaimID() string {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLedger(t *testing.T) {
+	var audit bytes.Buffer
+	ledger := NewLedger(2, &audit)
+
+	first := ledger.Add(ClaimRecord{Address: "0x1", Symbol: "xt", Status: ClaimQueued})
+	second := ledger.Add(ClaimRecord{Address: "0x2", Symbol: "usdc", Status: ClaimQueued, APIKey: "ci"})
+	if first.ID == "" || first.ID == second.ID {
+		t.Fatalf("Add() IDs = %q, %q, want distinct IDs", first.ID, second.ID)
+	}
+	if updated, ok := ledger.Update(second.ID, func(r *ClaimRecord) { r.Status = ClaimSent }); !ok || updated.Status != ClaimSent {
+		t.Errorf("Update() = %+v, %v, want a sent claim", updated, ok)
+	}
+	third := ledger.Add(ClaimRecord{Address: "0x1", Symbol: "xt", Status: ClaimQueued})
+
+	if _, ok := ledger.Get(first.ID); ok {
+		t.Error("Get() found a claim beyond the capacity")
+	}
+	if _, ok := ledger.Update(first.ID, func(r *ClaimRecord) {}); ok {
+		t.Error("Update() changed an evicted claim")
+	}
+	tests := []struct {
+		name  string
+		match func(ClaimRecord) bool
+		limit int
+		want  []string
+	}{
+		{name: "all", want: []string{third.ID, second.ID}},
+		{name: "limit", limit: 1, want: []string{third.ID}},
+		{name: "api key", match: func(r ClaimRecord) bool { return r.APIKey == "ci" }, want: []string{second.ID}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, record := range ledger.List(tt.match, tt.limit) {
+			got = append(got, record.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: List() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("audit log has %d lines, want 4", len(lines))
+	}
+	var last ClaimRecord
+	if err := json.Unmarshal([]byte(lines[2]), &last); err != nil || last.ID != second.ID || last.Status != ClaimSent {
+		t.Errorf("audit line = %s, want the update of %s", lines[2], second.ID)
+	}
+}
+
+func TestServerRecordsClaims(t *testing.T) {
+	s := NewServer(nil, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	c, err := s.newClaim("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "xt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = s.record(context.Background(), c, "192.0.2.1", "")
+	s.settle(c, common.Hash{}, errors.New("nonce too low"))
+
+	record, ok := s.cfg.ledger.Get(c.id)
+	if !ok || record.Status != ClaimFailed || record.Error != "nonce too low" || record.Amount != "1" || record.ClientIP != "192.0.2.1" {
+		t.Errorf("ledger record = %+v, want a failed claim of 1 xt from 192.0.2.1", record)
+	}
+}
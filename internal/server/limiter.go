@@ -1,82 +1,366 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"math/big"
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/jellydator/ttlcache/v2"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/negroni"
 
 	"github.com/chainflag/eth-faucet/internal/chain"
 )
 
+const dailyWindow = 24 * time.Hour
+
 type Limiter struct {
-	mutex      sync.Mutex
-	cache      *ttlcache.Cache
-	proxyCount int
-	ttl        time.Duration
+	store    LimiterStore
+	access   *AccessControl
+	clientIP ClientIPConfig
+	settings func() *Settings
+	now      func() time.Time
 }
 
-func NewLimiter(proxyCount int, ttl time.Duration) *Limiter {
-	cache := ttlcache.NewCache()
-	cache.SkipTTLExtensionOnHit(true)
+// NewLimiter creates a limiter that applies the quotas of the claimed asset per address, per
+// client IP and subnet and faucet-wide, each over a rolling window. The settings function
+// returns the running settings, whose registry normalizes the submitted asset so that aliases
+// of the same asset share one rate limit entry. Usage is kept in the store, or in memory if the
+// store is nil. Clients on the denylist are turned away before any quota is checked, and clients
+// on the allowlist get elevated per-client quotas.
+func NewLimiter(store LimiterStore, access *AccessControl, clientIP ClientIPConfig, settings func() *Settings) *Limiter {
+	if store == nil {
+		store = NewMemoryStore()
+	}
 	return &Limiter{
-		cache:      cache,
-		proxyCount: proxyCount,
-		ttl:        ttl,
+		store:    store,
+		access:   access,
+		clientIP: clientIP,
+		settings: settings,
+		now:      time.Now,
 	}
 }
 
-func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	address := r.PostFormValue(AddressKey)
-	symbol := r.PostFormValue(SymbolKey)
+// quotaScope is one budget a claim is counted against.
+type quotaScope struct {
+	key    string
+	limit  *big.Int
+	window time.Duration
+	amount *big.Int
+	reason func(left *big.Int, wait time.Duration) string
+}
 
-	key := address + ":" + symbol
-	if !chain.IsValidAddress(address, true) {
-		http.Error(w, "invalid address", http.StatusBadRequest)
-		return
+// rejected describes a claim that went over the scope.
+func (scope quotaScope) rejected(rejection Rejection) *claimError {
+	left := new(big.Int).Sub(scope.limit, rejection.Used)
+	if left.Sign() < 0 {
+		left.SetInt64(0)
 	}
-	if l.ttl <= 0 {
-		next.ServeHTTP(w, r)
-		return
+	return &claimError{
+		status:    http.StatusTooManyRequests,
+		code:      CodeRateLimited,
+		message:   scope.reason(left, rejection.Wait),
+		wait:      rejection.Wait,
+		limit:     scope.limit,
+		remaining: left,
 	}
+}
 
-	//clintIP := getClientIPFromRequest(l.proxyCount, r)
-	l.mutex.Lock()
-	//if l.limitByKey(w, key) || l.limitByKey(w, clintIP) {
-	if l.limitByKey(w, key) {
-		l.mutex.Unlock()
+func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	a, rejected := l.admit(r.Context(), r.PostFormValue(AddressKey), r.PostFormValue(SymbolKey), r.PostFormValue(AmountKey), l.clientIP.ClientIP(r))
+	if rejected != nil {
+		writeClaimError(w, r, rejected)
 		return
 	}
-	l.cache.SetWithTTL(key, true, l.ttl)
-	//l.cache.SetWithTTL(clintIP, true, l.ttl)
-	l.mutex.Unlock()
 
 	next.ServeHTTP(w, r)
 	if w.(negroni.ResponseWriter).Status() != http.StatusOK {
-		l.cache.Remove(key)
-		//l.cache.Remove(clintIP)
+		a.refund(r.Context())
 		return
 	}
-	log.WithFields(log.Fields{
-		"address": address,
-		"symbol":  symbol,
-		//"clientIP": clintIP,
-	}).Info("Maximum request limit has been reached")
+	a.accept()
+}
+
+// admission is a claim counted against the rate limits, which are refunded if the claim is not
+// accepted after all.
+type admission struct {
+	limiter      *Limiter
+	reservations []Reservation
+	at           time.Time
+	fields       log.Fields
+}
+
+// refund releases the quotas of a claim that was rejected after it was admitted.
+func (a *admission) refund(ctx context.Context) {
+	if err := a.limiter.store.Release(ctx, a.reservations, a.at); err != nil {
+		log.WithError(err).Error("Failed to refund the rate limits of a rejected claim")
+	}
+}
+
+func (a *admission) accept() {
+	log.WithFields(a.fields).Info("Claim counted against the rate limits")
+}
+
+// admit checks a claim of the asset by the client and counts it against the rate limits. The
+// API key and login identity of the claim are taken from the context.
+func (l *Limiter) admit(ctx context.Context, address, symbol, amount, clientIP string) (*admission, *claimError) {
+	if !chain.IsValidAddress(address, true) {
+		return nil, &claimError{status: http.StatusBadRequest, code: CodeInvalidAddress, message: "invalid address"}
+	}
+	if l.access.Denied(address, clientIP) {
+		log.WithFields(log.Fields{
+			"address":  address,
+			"clientIP": clientIP,
+		}).Warn("Rejected claim from the denylist")
+		return nil, &claimError{status: http.StatusForbidden, code: CodeForbidden, message: "This address or IP is not allowed to use the faucet"}
+	}
+	settings := l.settings()
+	asset, err := settings.Registry.Resolve(symbol)
+	if err != nil {
+		return nil, &claimError{status: http.StatusBadRequest, code: CodeUnknownAsset, message: err.Error()}
+	}
+	if rejected := pausedError(settings, asset); rejected != nil {
+		return nil, rejected
+	}
+	value, err := asset.ClaimAmount(amount)
+	if err != nil {
+		return nil, &claimError{status: http.StatusBadRequest, code: CodeInvalidAmount, message: err.Error()}
+	}
+
+	key := apiKeyFrom(ctx)
+	if key != nil && !key.allows(asset.Symbol) {
+		return nil, &claimError{status: http.StatusForbidden, code: CodeForbidden, message: fmt.Sprintf("This API key may not claim %s", asset.Symbol)}
+	}
+
+	c := claimant{
+		address:  address,
+		clientIP: clientIP,
+		identity: identityFrom(ctx),
+		allowed:  l.access.Allowed(address, clientIP),
+		key:      key,
+	}
+	scopes, rejected := l.scopes(settings, asset, c, value)
+	if rejected != nil {
+		return nil, rejected
+	}
+
+	reservations := reserve(scopes, newReservationID())
+	now := l.now()
+	rejection, err := l.store.Reserve(ctx, reservations, now)
+	if err != nil {
+		log.WithError(err).Error("Failed to check the rate limits")
+		return nil, &claimError{status: http.StatusServiceUnavailable, code: CodeUnavailable, message: "rate limits are unavailable, please try again later"}
+	}
+	if rejection != nil {
+		return nil, scopes[rejection.Index].rejected(*rejection)
+	}
+
+	fields := log.Fields{
+		"address":  address,
+		"symbol":   asset.Symbol,
+		"amount":   chain.FormatUnits(value, asset.Decimals),
+		"clientIP": clientIP,
+		"allowed":  c.allowed,
+		"identity": c.identity,
+	}
+	if key != nil {
+		fields["apiKey"] = key.ID
+	}
+	return &admission{limiter: l, reservations: reservations, at: now, fields: fields}, nil
+}
+
+// reserveBatch counts the claims of a batch made with the API key against the rate limits
+// at once, so either all of them are accepted or none. Claims sharing a scope are summed up
+// before they are checked. It returns the reservations to release if the batch is dropped, or
+// why the batch was rejected.
+func (l *Limiter) reserveBatch(ctx context.Context, key *APIKey, clientIP string, claims []claim, now time.Time) ([]Reservation, *claimError, error) {
+	settings := l.settings()
+	totals := make(map[string]int)
+	var scopes []quotaScope
+	for _, c := range claims {
+		claimScopes, rejected := l.scopes(settings, c.asset, claimant{address: c.address, clientIP: clientIP, key: key}, c.amount)
+		if rejected != nil {
+			return nil, rejected, nil
+		}
+		for _, scope := range claimScopes {
+			if i, ok := totals[scope.key]; ok {
+				scopes[i].amount = new(big.Int).Add(scopes[i].amount, scope.amount)
+				continue
+			}
+			totals[scope.key] = len(scopes)
+			scopes = append(scopes, scope)
+		}
+	}
+
+	reservations := reserve(scopes, newReservationID())
+	rejection, err := l.store.Reserve(ctx, reservations, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rejection != nil {
+		return nil, scopes[rejection.Index].rejected(*rejection), nil
+	}
+	return reservations, nil, nil
+}
+
+// claimant is who a claim is made by.
+type claimant struct {
+	address  string
+	clientIP string
+	identity string
+	allowed  bool
+	key      *APIKey
+}
+
+// scopes lists the budgets a claim of the asset is counted against. Scopes without a limit
+// or with a zero window are not enforced. Claims made after logging in are also counted against
+// the quota of the identity, and the quota of the address is left out without an address, as
+// when the cooldown of a client IP is looked up. Allowlisted clients get elevated per-client
+// quotas, and claims made with an API key are counted against the key's own quotas instead of
+// the per-client ones, while the asset's daily cap and the faucet-wide claims still apply to
+// them. A claim made with an API key whose quotas can't be applied is rejected.
+func (l *Limiter) scopes(settings *Settings, asset *Asset, c claimant, amount *big.Int) ([]quotaScope, *claimError) {
+	retry := func(wait time.Duration) string {
+		return fmt.Sprintf("You have exceeded the rate limit. Please wait %s before you try again", wait.Round(time.Second))
+	}
+	quotaReason := func(left *big.Int, wait time.Duration) string {
+		if left.Cmp(asset.MinAmount) >= 0 {
+			return fmt.Sprintf("You can claim up to %s %s more now, or wait %s for your quota to reset",
+				chain.FormatUnits(left, asset.Decimals), asset.Symbol, wait.Round(time.Second))
+		}
+		return retry(wait)
+	}
+	budgetReason := func(left *big.Int, wait time.Duration) string {
+		return fmt.Sprintf("The daily limit for %s has been reached. Please wait %s before you try again", asset.Symbol, wait.Round(time.Second))
+	}
+
+	var candidates []quotaScope
+	if c.key != nil {
+		var rejected *claimError
+		if candidates, rejected = keyScopes(c.key, asset, amount); rejected != nil {
+			return nil, rejected
+		}
+	} else {
+		var perClient []quotaScope
+		if c.address != "" {
+			perClient = append(perClient, quotaScope{key: "addr:" + c.address + ":" + asset.Symbol, limit: asset.Quota})
+		}
+		perClient = append(perClient,
+			quotaScope{key: "ip:" + l.clientIP.Bucket(c.clientIP) + ":" + asset.Symbol, limit: asset.IPQuota},
+			quotaScope{key: "subnet:" + subnetOf(c.clientIP) + ":" + asset.Symbol, limit: asset.SubnetQuota},
+		)
+		if c.identity != "" {
+			perClient = append(perClient, quotaScope{key: "id:" + c.identity + ":" + asset.Symbol, limit: asset.Quota})
+		}
+		for _, scope := range perClient {
+			if c.allowed {
+				scope.limit = l.access.elevate(scope.limit)
+			}
+			scope.window, scope.amount, scope.reason = asset.Cooldown, amount, quotaReason
+			candidates = append(candidates, scope)
+		}
+	}
+	candidates = append(candidates, quotaScope{
+		key:    "cap:" + asset.Symbol,
+		limit:  asset.DailyCap,
+		window: dailyWindow,
+		amount: amount,
+		reason: budgetReason,
+	})
+	if settings.DailyClaims > 0 {
+		candidates = append(candidates, quotaScope{
+			key:    "claims",
+			limit:  big.NewInt(int64(settings.DailyClaims)),
+			window: dailyWindow,
+			amount: big.NewInt(1),
+			reason: func(*big.Int, time.Duration) string {
+				return "The faucet has handed out its daily budget of claims, please try again later"
+			},
+		})
+	}
+
+	var scopes []quotaScope
+	for _, scope := range candidates {
+		if scope.limit != nil && scope.window > 0 {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// keyScopes lists the daily quotas of an API key that apply to a claim of the asset. A daily
+// amount that doesn't fit the asset rejects the claim rather than lifting the quota.
+func keyScopes(key *APIKey, asset *Asset, amount *big.Int) ([]quotaScope, *claimError) {
+	var scopes []quotaScope
+	if key.DailyClaims > 0 {
+		scopes = append(scopes, quotaScope{
+			key:    "key:" + key.ID,
+			limit:  big.NewInt(int64(key.DailyClaims)),
+			window: dailyWindow,
+			amount: big.NewInt(1),
+			reason: func(_ *big.Int, wait time.Duration) string {
+				return fmt.Sprintf("This API key has used its %d daily claims. Please wait %s before you try again",
+					key.DailyClaims, wait.Round(time.Second))
+			},
+		})
+	}
+	for symbol, daily := range key.DailyAmounts {
+		if !strings.EqualFold(symbol, asset.Symbol) {
+			continue
+		}
+		limit, err := chain.ParseUnits(string(daily), asset.Decimals)
+		if err != nil {
+			log.WithError(err).WithField("apiKey", key.ID).Error("Rejected claim with an invalid daily amount of an API key")
+			return nil, &claimError{status: http.StatusForbidden, code: CodeForbidden, message: fmt.Sprintf("This API key has an invalid daily amount of %s", asset.Symbol)}
+		}
+		scopes = append(scopes, quotaScope{
+			key:    "key:" + key.ID + ":" + asset.Symbol,
+			limit:  limit,
+			window: dailyWindow,
+			amount: amount,
+			reason: func(left *big.Int, wait time.Duration) string {
+				return fmt.Sprintf("This API key can claim up to %s %s more now, or wait %s for its quota to reset",
+					chain.FormatUnits(left, asset.Decimals), asset.Symbol, wait.Round(time.Second))
+			},
+		})
+	}
+	return scopes, nil
+}
+
+// reserve lists the reservations of the scopes under one ID.
+func reserve(scopes []quotaScope, id string) []Reservation {
+	reservations := make([]Reservation, len(scopes))
+	for i, scope := range scopes {
+		reservations[i] = Reservation{ID: id, Key: scope.key, Limit: scope.limit, Window: scope.window, Amount: scope.amount}
+	}
+	return reservations
 }
 
-func (l *Limiter) limitByKey(w http.ResponseWriter, key string) bool {
-	if _, ttl, err := l.cache.GetWithTTL(key); err == nil {
-		errMsg := fmt.Sprintf("You have exceeded the rate limit. Please wait %s before you try again", ttl.Round(time.Second))
-		http.Error(w, errMsg, http.StatusTooManyRequests)
-		return true
+// newReservationID returns a random ID that tells the usage of one claim apart from others
+// recorded under the same key at the same time.
+func newReservationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// subnetOf returns the /24 network of an IPv4 address or the /48 network of an IPv6 address.
+func subnetOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
 	}
-	return false
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
 }
 
 func getClientIPFromRequest(proxyCount int, r *http.Request) string {
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jellydator/ttlcache/v2"
+)
+
+// LimiterStore records the usage counted against rate limit keys. A reservation is checked and
+// recorded atomically, so limiters sharing one store can't overspend a quota between them. It
+// also holds values that replicas share, such as the claims made under idempotency keys.
+type LimiterStore interface {
+	// Reserve counts every reservation under its key if each of them fits under its limit
+	// within its rolling window ending at now. Otherwise nothing is counted and the first
+	// reservation that doesn't fit is returned as a rejection.
+	Reserve(ctx context.Context, reservations []Reservation, now time.Time) (*Rejection, error)
+	// Check measures every reservation the way Reserve does without counting anything, and
+	// returns a rejection for each one that doesn't fit.
+	Check(ctx context.Context, reservations []Reservation, now time.Time) ([]Rejection, error)
+	// Release takes back the usage counted by an earlier reservation made at the given time.
+	Release(ctx context.Context, reservations []Reservation, at time.Time) error
+	// Clear forgets all usage counted under the keys.
+	Clear(ctx context.Context, keys []string) error
+	// Remember stores the value under the key for the TTL unless a value is stored already. It
+	// returns the value stored under the key, and true if that is the given one.
+	Remember(ctx context.Context, key, value string, ttl time.Duration) (string, bool, error)
+	// Overwrite stores the value under the key for the TTL, replacing any stored value.
+	Overwrite(ctx context.Context, key, value string, ttl time.Duration) error
+	// Forget deletes the value stored under the key.
+	Forget(ctx context.Context, key string) error
+}
+
+// Reservation is an amount to be counted under a key. All reservations of one claim share the
+// same ID, which identifies their usage when it is released.
+type Reservation struct {
+	ID     string
+	Key    string
+	Limit  *big.Int
+	Window time.Duration
+	Amount *big.Int
+}
+
+// Rejection reports the reservation that went over its limit, the amount already used under
+// its key and how long until enough of it expires for the reservation to fit.
+type Rejection struct {
+	Index int
+	Used  *big.Int
+	Wait  time.Duration
+}
+
+// reserveOnce records a one-time key, such as a challenge nonce, until the given time. It
+// reports false if the key was already recorded.
+func reserveOnce(ctx context.Context, store LimiterStore, key string, until, now time.Time) (bool, error) {
+	one := big.NewInt(1)
+	rejection, err := store.Reserve(ctx, []Reservation{{
+		ID:     key,
+		Key:    key,
+		Limit:  one,
+		Window: until.Sub(now),
+		Amount: one,
+	}}, now)
+	if err != nil {
+		return false, err
+	}
+	return rejection == nil, nil
+}
+
+// usageEntry records an amount counted under a key at a point in time.
+type usageEntry struct {
+	id     string
+	at     time.Time
+	amount *big.Int
+}
+
+// measure sums the usage within the window ending at now, and works out how long until enough
+// of it has expired for another amount to fit under the limit. Entries are oldest first.
+func measure(entries []usageEntry, window time.Duration, limit, amount *big.Int, now time.Time) (*big.Int, time.Duration) {
+	used := new(big.Int)
+	for _, entry := range entries {
+		used.Add(used, entry.amount)
+	}
+
+	var wait time.Duration
+	excess := new(big.Int).Sub(new(big.Int).Add(used, amount), limit)
+	for _, entry := range entries {
+		if excess.Sign() <= 0 {
+			break
+		}
+		excess.Sub(excess, entry.amount)
+		wait = entry.at.Add(window).Sub(now)
+	}
+	return used, wait
+}
+
+// MemoryStore keeps usage in a process-local cache. It is the default store and is only
+// suitable for a single faucet instance.
+type MemoryStore struct {
+	mutex  sync.Mutex
+	cache  *ttlcache.Cache
+	values *ttlcache.Cache
+}
+
+func NewMemoryStore() *MemoryStore {
+	cache := ttlcache.NewCache()
+	cache.SkipTTLExtensionOnHit(true)
+	values := ttlcache.NewCache()
+	values.SkipTTLExtensionOnHit(true)
+	return &MemoryStore{cache: cache, values: values}
+}
+
+func (m *MemoryStore) Reserve(_ context.Context, reservations []Reservation, now time.Time) (*Rejection, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, r := range reservations {
+		used, wait := m.usage(r.Key, r.Window, r.Limit, r.Amount, now)
+		if new(big.Int).Add(used, r.Amount).Cmp(r.Limit) > 0 {
+			return &Rejection{Index: i, Used: used, Wait: wait}, nil
+		}
+	}
+	for _, r := range reservations {
+		entries := append(m.entries(r.Key, r.Window, now), usageEntry{id: r.ID, at: now, amount: r.Amount})
+		m.cache.SetWithTTL(r.Key, entries, r.Window)
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) Check(_ context.Context, reservations []Reservation, now time.Time) ([]Rejection, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var rejections []Rejection
+	for i, r := range reservations {
+		used, wait := m.usage(r.Key, r.Window, r.Limit, r.Amount, now)
+		if new(big.Int).Add(used, r.Amount).Cmp(r.Limit) > 0 {
+			rejections = append(rejections, Rejection{Index: i, Used: used, Wait: wait})
+		}
+	}
+	return rejections, nil
+}
+
+func (m *MemoryStore) Release(_ context.Context, reservations []Reservation, at time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, r := range reservations {
+		value, err := m.cache.Get(r.Key)
+		if err != nil {
+			continue
+		}
+		var kept []usageEntry
+		for _, entry := range value.([]usageEntry) {
+			if entry.id != r.ID || !entry.at.Equal(at) {
+				kept = append(kept, entry)
+			}
+		}
+		m.cache.SetWithTTL(r.Key, kept, r.Window)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Clear(_ context.Context, keys []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, key := range keys {
+		m.cache.Remove(key)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Remember(_ context.Context, key, value string, ttl time.Duration) (string, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if stored, err := m.values.Get(key); err == nil {
+		return stored.(string), false, nil
+	}
+	m.values.SetWithTTL(key, value, ttl)
+	return value, true, nil
+}
+
+func (m *MemoryStore) Overwrite(_ context.Context, key, value string, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values.SetWithTTL(key, value, ttl)
+	return nil
+}
+
+func (m *MemoryStore) Forget(_ context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values.Remove(key)
+	return nil
+}
+
+// usage returns the amount counted under the key within the rolling window ending at now, and
+// how long until another amount fits under the limit.
+func (m *MemoryStore) usage(key string, window time.Duration, limit, amount *big.Int, now time.Time) (*big.Int, time.Duration) {
+	return measure(m.entries(key, window, now), window, limit, amount, now)
+}
+
+// entries returns the usage recorded under the key that is still inside the window.
+func (m *MemoryStore) entries(key string, window time.Duration, now time.Time) []usageEntry {
+	value, err := m.cache.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	var live []usageEntry
+	for _, entry := range value.([]usageEntry) {
+		if now.Sub(entry.at) < window {
+			live = append(live, entry)
+		}
+	}
+	return live
+}
+
+// redisReserveAttempts bounds how often a reservation is retried when other limiters keep
+// changing the same keys.
+const redisReserveAttempts = 10
+
+// errReserveConflict is returned when the usage changed between reading and recording it.
+var errReserveConflict = errors.New("rate limit usage changed concurrently")
+
+// redisCommitScript records a reservation only if no key changed since its usage was read.
+// Each key is a sorted set of "<unix nanos>:<amount>:<id>" members scored by unix millis, next
+// to a counter that is bumped on every change.
+//
+// KEYS: usage key, version key, for each reservation
+// ARGV: for each reservation the expected version, expiry score, score, member and TTL in ms
+var redisCommitScript = redis.NewScript(`
+for i = 1, #KEYS / 2 do
+	local version = redis.call('GET', KEYS[2 * i]) or '0'
+	if version ~= ARGV[5 * i - 4] then
+		return 0
+	end
+end
+for i = 1, #KEYS / 2 do
+	local key, versionKey, ttl = KEYS[2 * i - 1], KEYS[2 * i], ARGV[5 * i]
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', ARGV[5 * i - 3])
+	redis.call('ZADD', key, ARGV[5 * i - 2], ARGV[5 * i - 1])
+	redis.call('PEXPIRE', key, ttl)
+	redis.call('INCR', versionKey)
+	redis.call('PEXPIRE', versionKey, ttl)
+end
+return 1
+`)
+
+// redisReleaseScript removes the members of a reservation and bumps the version of each key.
+//
+// KEYS: usage key, version key, for each reservation
+// ARGV: member, for each reservation
+var redisReleaseScript = redis.NewScript(`
+for i = 1, #KEYS / 2 do
+	if redis.call('ZREM', KEYS[2 * i - 1], ARGV[i]) > 0 then
+		redis.call('INCR', KEYS[2 * i])
+	end
+end
+return 1
+`)
+
+// RedisStore keeps usage in Redis so that several faucet replicas share their rate limits.
+// Amounts are summed in Go, and a script commits a reservation only if the usage it was checked
+// against is unchanged, retrying otherwise.
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewRedisStore(client redis.UniversalClient, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+func (s *RedisStore) Reserve(ctx context.Context, reservations []Reservation, now time.Time) (*Rejection, error) {
+	if len(reservations) == 0 {
+		return nil, nil
+	}
+	for attempt := 0; attempt < redisReserveAttempts; attempt++ {
+		rejection, err := s.reserve(ctx, reservations, now)
+		if err != errReserveConflict {
+			return rejection, err
+		}
+	}
+	return nil, errReserveConflict
+}
+
+func (s *RedisStore) reserve(ctx context.Context, reservations []Reservation, now time.Time) (*Rejection, error) {
+	versions := make([]*redis.StringCmd, len(reservations))
+	members := make([]*redis.StringSliceCmd, len(reservations))
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, r := range reservations {
+			versions[i] = pipe.Get(ctx, s.versionKey(r.Key))
+			members[i] = pipe.ZRangeByScore(ctx, s.usageKey(r.Key), &redis.ZRangeBy{
+				Min: strconv.FormatInt(expiryScore(now, r.Window), 10),
+				Max: "+inf",
+			})
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, 2*len(reservations))
+	args := make([]interface{}, 0, 5*len(reservations))
+	for i, r := range reservations {
+		entries, err := parseRedisEntries(members[i].Val(), r.Window, now)
+		if err != nil {
+			return nil, err
+		}
+		used, wait := measure(entries, r.Window, r.Limit, r.Amount, now)
+		if new(big.Int).Add(used, r.Amount).Cmp(r.Limit) > 0 {
+			return &Rejection{Index: i, Used: used, Wait: wait}, nil
+		}
+
+		version := versions[i].Val()
+		if version == "" {
+			version = "0"
+		}
+		keys = append(keys, s.usageKey(r.Key), s.versionKey(r.Key))
+		args = append(args, version, expiryScore(now, r.Window), now.UnixNano()/int64(time.Millisecond),
+			redisMember(r, now), r.Window.Milliseconds())
+	}
+
+	committed, err := redisCommitScript.Run(ctx, s.client, keys, args...).Int()
+	if err != nil {
+		return nil, err
+	}
+	if committed == 0 {
+		return nil, errReserveConflict
+	}
+	return nil, nil
+}
+
+func (s *RedisStore) Check(ctx context.Context, reservations []Reservation, now time.Time) ([]Rejection, error) {
+	members := make([]*redis.StringSliceCmd, len(reservations))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, r := range reservations {
+			members[i] = pipe.ZRangeByScore(ctx, s.usageKey(r.Key), &redis.ZRangeBy{
+				Min: strconv.FormatInt(expiryScore(now, r.Window), 10),
+				Max: "+inf",
+			})
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	var rejections []Rejection
+	for i, r := range reservations {
+		entries, err := parseRedisEntries(members[i].Val(), r.Window, now)
+		if err != nil {
+			return nil, err
+		}
+		used, wait := measure(entries, r.Window, r.Limit, r.Amount, now)
+		if new(big.Int).Add(used, r.Amount).Cmp(r.Limit) > 0 {
+			rejections = append(rejections, Rejection{Index: i, Used: used, Wait: wait})
+		}
+	}
+	return rejections, nil
+}
+
+func (s *RedisStore) Release(ctx context.Context, reservations []Reservation, at time.Time) error {
+	if len(reservations) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 2*len(reservations))
+	args := make([]interface{}, 0, len(reservations))
+	for _, r := range reservations {
+		keys = append(keys, s.usageKey(r.Key), s.versionKey(r.Key))
+		args = append(args, redisMember(r, at))
+	}
+	return redisReleaseScript.Run(ctx, s.client, keys, args...).Err()
+}
+
+// Clear deletes the usage of the keys together with their versions, so a reservation that
+// read them before is retried.
+func (s *RedisStore) Clear(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	names := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		names = append(names, s.usageKey(key), s.versionKey(key))
+	}
+	return s.client.Del(ctx, names...).Err()
+}
+
+// Remember sets the value only if the key is free. A stored value that expires before it is
+// read frees the key, so the value is set again.
+func (s *RedisStore) Remember(ctx context.Context, key, value string, ttl time.Duration) (string, bool, error) {
+	for attempt := 0; attempt < redisReserveAttempts; attempt++ {
+		set, err := s.client.SetNX(ctx, s.valueKey(key), value, ttl).Result()
+		if err != nil {
+			return "", false, err
+		}
+		if set {
+			return value, true, nil
+		}
+		stored, err := s.client.Get(ctx, s.valueKey(key)).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return stored, false, nil
+	}
+	return "", false, fmt.Errorf("value of %s changed concurrently", key)
+}
+
+func (s *RedisStore) Overwrite(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.valueKey(key), value, ttl).Err()
+}
+
+func (s *RedisStore) Forget(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.valueKey(key)).Err()
+}
+
+func (s *RedisStore) usageKey(key string) string {
+	return s.prefix + "usage:" + key
+}
+
+func (s *RedisStore) versionKey(key string) string {
+	return s.prefix + "version:" + key
+}
+
+func (s *RedisStore) valueKey(key string) string {
+	return s.prefix + "value:" + key
+}
+
+// expiryScore is the score at or below which usage has left the window ending at now.
+func expiryScore(now time.Time, window time.Duration) int64 {
+	return now.Add(-window).UnixNano()/int64(time.Millisecond) - 1
+}
+
+func redisMember(r Reservation, at time.Time) string {
+	return fmt.Sprintf("%d:%s:%s", at.UnixNano(), r.Amount, r.ID)
+}
+
+// parseRedisEntries decodes sorted set members, keeping those still inside the window.
+func parseRedisEntries(members []string, window time.Duration, now time.Time) ([]usageEntry, error) {
+	var entries []usageEntry
+	for _, member := range members {
+		parts := strings.SplitN(member, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("malformed rate limit entry %q", member)
+		}
+		nanos, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed rate limit entry %q", member)
+		}
+		amount, ok := new(big.Int).SetString(parts[1], 10)
+		if !ok {
+			return nil, fmt.Errorf("malformed rate limit entry %q", member)
+		}
+		entry := usageEntry{id: parts[2], at: time.Unix(0, nanos), amount: amount}
+		if now.Sub(entry.at) < window {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/urfave/negroni"
+)
+
+func postClaim(handler http.Handler, address, symbol, amount string) int {
+	return postClaimFrom(handler, "192.0.2.1:1234", address, symbol, amount)
+}
+
+func postClaimFrom(handler http.Handler, remoteAddr, address, symbol, amount string) int {
+	form := url.Values{AddressKey: {address}, SymbolKey: {symbol}, AmountKey: {amount}}
+	req := httptest.NewRequest("POST", "/api/claim", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestLimiterPerAssetPolicy(t *testing.T) {
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	usdc.DailyCap = big.NewInt(2000000)
+	dai := newTestAsset("dai", "0xfECE6a24ea30226a75139085A88bad1740B4fF6C")
+	dai.Cooldown = 0
+	link := newTestAsset("link", "0x2CaBf400FD6dD1897E3141535BAB50f9e575bDF1")
+	if err := applyBounds(link, "0.1", "2", "3"); err != nil {
+		t.Fatal(err)
+	}
+	registry := newTestRegistry(usdc, dai, link)
+
+	limiter, handler, _ := newTestLimiter(&Settings{Registry: registry})
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+		carol = "0x6eBE9511781cE5a000D29C1963158838278e274E"
+	)
+	tests := []struct {
+		name    string
+		address string
+		symbol  string
+		amount  string
+		want    int
+	}{
+		{name: "first claim", address: alice, symbol: "usdc", want: http.StatusOK},
+		{name: "cooldown", address: alice, symbol: "USDC", want: http.StatusTooManyRequests},
+		{name: "other asset", address: alice, symbol: "xt", want: http.StatusOK},
+		{name: "no cooldown", address: alice, symbol: "dai", want: http.StatusOK},
+		{name: "no cooldown again", address: alice, symbol: "dai", want: http.StatusOK},
+		{name: "second address", address: bob, symbol: "usdc", want: http.StatusOK},
+		{name: "daily cap", address: carol, symbol: "usdc", want: http.StatusTooManyRequests},
+		{name: "unknown asset", address: carol, symbol: "doge", want: http.StatusBadRequest},
+		{name: "invalid address", address: "0x1", symbol: "usdc", want: http.StatusBadRequest},
+		{name: "amount above max", address: alice, symbol: "link", amount: "2.5", want: http.StatusBadRequest},
+		{name: "large claim", address: alice, symbol: "link", amount: "2", want: http.StatusOK},
+		{name: "small claim", address: alice, symbol: "link", amount: "0.5", want: http.StatusOK},
+		{name: "rest of quota", address: alice, symbol: "link", amount: "0.5", want: http.StatusOK},
+		{name: "quota exhausted", address: alice, symbol: "link", amount: "0.1", want: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if got := postClaim(handler, tt.address, tt.symbol, tt.amount); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if spent, _ := limiter.store.(*MemoryStore).usage("cap:usdc", dailyWindow, usdc.DailyCap, big.NewInt(0), time.Now()); spent.Cmp(usdc.DailyCap) != 0 {
+		t.Errorf("usage() = %v, want %v", spent, usdc.DailyCap)
+	}
+}
+
+// newTestLimiter wraps a handler that succeeds unless the returned flag is set.
+func newTestLimiter(settings *Settings) (*Limiter, http.Handler, *bool) {
+	return newTestLimiterWithStore(nil, nil, settings)
+}
+
+func newTestLimiterWithStore(store LimiterStore, access *AccessControl, settings *Settings) (*Limiter, http.Handler, *bool) {
+	fail := new(bool)
+	limiter := NewLimiter(store, access, ClientIPConfig{IPv6Prefix: 64}, func() *Settings { return settings })
+	handler := negroni.New(limiter, negroni.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *fail {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})))
+	return limiter, handler, fail
+}
+
+func TestLimiterClientQuotas(t *testing.T) {
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	usdc.IPQuota = big.NewInt(2000000)
+	usdc.SubnetQuota = big.NewInt(3000000)
+	_, handler, _ := newTestLimiter(&Settings{Registry: newTestRegistry(usdc)})
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+		carol = "0x6eBE9511781cE5a000D29C1963158838278e274E"
+		dave  = "0x7A9772Dda42b938aE9d8f19b7d14AA1f0dae939e"
+	)
+	tests := []struct {
+		name    string
+		remote  string
+		address string
+		want    int
+	}{
+		{name: "first ip", remote: "198.51.100.1:1", address: alice, want: http.StatusOK},
+		{name: "same ip", remote: "198.51.100.1:2", address: bob, want: http.StatusOK},
+		{name: "ip quota", remote: "198.51.100.1:3", address: carol, want: http.StatusTooManyRequests},
+		{name: "same subnet", remote: "198.51.100.2:1", address: carol, want: http.StatusOK},
+		{name: "subnet quota", remote: "198.51.100.3:1", address: dave, want: http.StatusTooManyRequests},
+		{name: "other subnet", remote: "203.0.113.1:1", address: dave, want: http.StatusOK},
+		{name: "ipv6 subnet", remote: "[2001:db8::1]:1", address: "0xa63999E7Ee4483d4FcEA0EB411787FB5b41d3cB5", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := postClaimFrom(handler, tt.remote, tt.address, "usdc", ""); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLimiterRollingWindow(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	stores := map[string]func() LimiterStore{
+		"memory": func() LimiterStore { return NewMemoryStore() },
+		"redis": func() LimiterStore {
+			return NewRedisStore(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), "test:")
+		},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testLimiterRollingWindow(t, store())
+		})
+	}
+}
+
+func testLimiterRollingWindow(t *testing.T, store LimiterStore) {
+	link := newTestAsset("link", "0x2CaBf400FD6dD1897E3141535BAB50f9e575bDF1")
+	if err := applyBounds(link, "1", "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	limiter, handler, fail := newTestLimiterWithStore(store, nil, &Settings{Registry: newTestRegistry(link), DailyClaims: 3})
+	now := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	const address = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+	steps := []struct {
+		name    string
+		advance time.Duration
+		fail    bool
+		want    int
+	}{
+		{name: "first", want: http.StatusOK},
+		{name: "failed claim is refunded", advance: 10 * time.Minute, fail: true, want: http.StatusInternalServerError},
+		{name: "second", advance: 20 * time.Minute, want: http.StatusOK},
+		{name: "quota used", advance: 20 * time.Minute, want: http.StatusTooManyRequests},
+		{name: "first expired", advance: 21 * time.Minute, want: http.StatusOK},
+		{name: "daily claims", advance: 2 * time.Hour, want: http.StatusTooManyRequests},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		*fail = step.fail
+		if got := postClaim(handler, address, "link", ""); got != step.want {
+			t.Errorf("%s: status = %d, want %d", step.name, got, step.want)
+		}
+	}
+}
+
+func TestRedisStoreSharedBetweenReplicas(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	usdc.DailyCap = big.NewInt(5000000)
+	settings := &Settings{Registry: newTestRegistry(usdc)}
+
+	var handlers []http.Handler
+	for i := 0; i < 2; i++ {
+		store := NewRedisStore(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), "test:")
+		_, handler, _ := newTestLimiterWithStore(store, nil, settings)
+		handlers = append(handlers, handler)
+	}
+
+	addresses := []string{
+		"0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B",
+		"0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8",
+		"0x6eBE9511781cE5a000D29C1963158838278e274E",
+		"0x7A9772Dda42b938aE9d8f19b7d14AA1f0dae939e",
+		"0xa63999E7Ee4483d4FcEA0EB411787FB5b41d3cB5",
+	}
+	var (
+		wg       sync.WaitGroup
+		accepted int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			remote := fmt.Sprintf("198.51.100.%d:1", i)
+			if postClaimFrom(handlers[i%2], remote, addresses[i%len(addresses)], "usdc", "") == http.StatusOK {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if accepted != 5 {
+		t.Errorf("accepted %d claims across replicas, want 5", accepted)
+	}
+}
+
+func TestLimiterAccessLists(t *testing.T) {
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	usdc.IPQuota = big.NewInt(1000000)
+	usdc.DailyCap = big.NewInt(3000000)
+
+	const (
+		alice = "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+		bob   = "0x7EF5A6135f1FD6a02593eEdC869c6D41D934aef8"
+		ci    = "0x6eBE9511781cE5a000D29C1963158838278e274E"
+	)
+	access, err := NewAccessControl("", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{ci, "10.1.0.0/16"} {
+		if err := access.Add(AllowList, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := access.Add(DenyList, strings.ToLower(bob)); err != nil {
+		t.Fatal(err)
+	}
+	if err := access.Add(DenyList, "203.0.113.66"); err != nil {
+		t.Fatal(err)
+	}
+	_, handler, _ := newTestLimiterWithStore(nil, access, &Settings{Registry: newTestRegistry(usdc)})
+
+	tests := []struct {
+		name    string
+		remote  string
+		address string
+		want    int
+	}{
+		{name: "denied address", remote: "198.51.100.1:1", address: bob, want: http.StatusForbidden},
+		{name: "denied ip", remote: "203.0.113.66:1", address: alice, want: http.StatusForbidden},
+		{name: "allowed address", remote: "198.51.100.2:1", address: ci, want: http.StatusOK},
+		{name: "elevated quota", remote: "198.51.100.3:1", address: ci, want: http.StatusOK},
+		{name: "elevated quota used", remote: "198.51.100.4:1", address: ci, want: http.StatusTooManyRequests},
+		{name: "allowed ip range", remote: "10.1.2.3:1", address: alice, want: http.StatusOK},
+		{name: "daily cap still applies", remote: "10.1.2.3:1", address: "0x7A9772Dda42b938aE9d8f19b7d14AA1f0dae939e", want: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if got := postClaimFrom(handler, tt.remote, tt.address, "usdc", ""); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
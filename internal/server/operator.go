@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// errPurged marks the claims an operator took out of the queue.
+var errPurged = errors.New("removed from the queue by an operator")
+
+// pausedError rejects claims while the faucet or the asset is paused. The asset may be nil.
+func pausedError(settings *Settings, asset *Asset) *claimError {
+	switch {
+	case settings.Paused:
+		return &claimError{status: http.StatusServiceUnavailable, code: CodePaused, message: "The faucet is paused, please try again later"}
+	case asset != nil && asset.Paused:
+		return &claimError{status: http.StatusServiceUnavailable, code: CodePaused, message: fmt.Sprintf("%s claims are paused, please try again later", asset.Symbol)}
+	}
+	return nil
+}
+
+// assetOverride is what operators changed about an asset through the admin API.
+type assetOverride struct {
+	Paused bool `json:"paused,omitempty"`
+	// Payout replaces the configured payout, as a decimal string.
+	Payout Amount `json:"payout,omitempty"`
+	// Minutes replaces the configured cooldown.
+	Minutes *int `json:"minutes,omitempty"`
+}
+
+// apply returns a copy of the asset with the override. A fixed claim amount and the quotas
+// that matched it follow the new payout, while a range of claim amounts has to contain it.
+func (o assetOverride) apply(asset *Asset) (*Asset, error) {
+	next := *asset
+	next.Paused = o.Paused
+	if o.Minutes != nil {
+		next.Cooldown = time.Duration(*o.Minutes) * time.Minute
+	}
+	if o.Payout == "" {
+		return &next, nil
+	}
+
+	payout, err := parsePayout(string(o.Payout), asset.Decimals)
+	if err != nil {
+		return nil, fmt.Errorf("payout: %w", err)
+	}
+	next.Payout = payout
+	if asset.MinAmount.Cmp(asset.Payout) == 0 && asset.MaxAmount.Cmp(asset.Payout) == 0 {
+		next.MinAmount, next.MaxAmount = payout, payout
+		next.Quota = follow(asset.Quota, asset.Payout, payout)
+		next.IPQuota = follow(asset.IPQuota, asset.Payout, payout)
+		next.SubnetQuota = follow(asset.SubnetQuota, asset.Payout, payout)
+	}
+	if next.MinAmount.Cmp(payout) > 0 || next.MaxAmount.Cmp(payout) < 0 {
+		return nil, errors.New("payout must lie between the min and max amount")
+	}
+	if next.Quota.Cmp(next.MaxAmount) < 0 {
+		return nil, errors.New("quota is smaller than the max amount")
+	}
+	if next.DailyCap != nil && next.DailyCap.Cmp(payout) < 0 {
+		return nil, errors.New("daily cap is smaller than a single payout")
+	}
+	return &next, nil
+}
+
+// follow returns the new payout in place of a limit that equals the old one.
+func follow(limit, prev, next *big.Int) *big.Int {
+	if limit != nil && limit.Cmp(prev) == 0 {
+		return next
+	}
+	return limit
+}
+
+// operatorState holds the changes operators made through the admin API. They are kept in
+// memory and applied on top of every config reload until the faucet restarts.
+type operatorState struct {
+	paused bool
+	assets map[string]assetOverride
+}
+
+func (o operatorState) clone() operatorState {
+	assets := make(map[string]assetOverride, len(o.assets))
+	for symbol, override := range o.assets {
+		assets[symbol] = override
+	}
+	return operatorState{paused: o.paused, assets: assets}
+}
+
+// apply derives the running settings from the loaded ones, which are used as they are if
+// operators changed nothing. Overrides of assets that are no longer configured are kept for
+// when they come back.
+func (o operatorState) apply(loaded *Settings) (*Settings, error) {
+	if !o.paused && len(o.assets) == 0 {
+		return loaded, nil
+	}
+	next := *loaded
+	next.Paused = o.paused
+	if len(o.assets) == 0 {
+		return &next, nil
+	}
+
+	var native *Asset
+	var tokens []*Asset
+	for _, asset := range loaded.Registry.Assets() {
+		if override, ok := o.assets[asset.Symbol]; ok {
+			overridden, err := override.apply(asset)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", asset.Symbol, err)
+			}
+			asset = overridden
+		}
+		if asset.IsNative() {
+			native = asset
+		} else {
+			tokens = append(tokens, asset)
+		}
+	}
+	next.Registry = NewRegistry(native, tokens)
+	next.Registry.disabled = loaded.Registry.disabled
+	return &next, nil
+}
+
+// operate changes the operator state and swaps in the running settings derived from it. The
+// change is dropped if the loaded settings don't fit it. It returns what changed in the
+// running settings.
+func (s *Server) operate(change func(state *operatorState)) ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	state := s.operator.clone()
+	change(&state)
+	for symbol, override := range state.assets {
+		if override == (assetOverride{}) {
+			delete(state.assets, symbol)
+		}
+	}
+	next, err := state.apply(s.loaded)
+	if err != nil {
+		return nil, err
+	}
+	changes := diffSettings(s.current(), next)
+	s.operator = state
+	s.settings.Store(next)
+	return changes, nil
+}
+
+// overrides returns the changes operators made to the asset.
+func (s *Server) overrides(symbol string) assetOverride {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.operator.assets[symbol]
+}
+
+// resetCooldown forgets the usage counted against the quotas of the address for the assets,
+// so it can claim them again right away.
+func (l *Limiter) resetCooldown(ctx context.Context, address string, assets []*Asset) error {
+	keys := make([]string, len(assets))
+	for i, asset := range assets {
+		keys[i] = "addr:" + address + ":" + asset.Symbol
+	}
+	return l.store.Clear(ctx, keys)
+}
+
+// queued returns the ledger records of the queued claims in the order they will be paid.
+func (s *Server) queued() []ClaimRecord {
+	var records []ClaimRecord
+	for _, id := range s.feed.queued() {
+		if record, ok := s.cfg.ledger.Get(id); ok {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// purgeQueue takes the queued claims that match out of the queue and marks them as failed.
+// The rest keep their order. Claims are received without blocking, since the queue may be
+// consumed meanwhile.
+func (s *Server) purgeQueue(match func(claim) bool) []claim {
+	var purged []claim
+	s.feed.filter(func() []string {
+		var kept []claim
+	drain:
+		for n := len(s.queue); n > 0; n-- {
+			select {
+			case c := <-s.queue:
+				if match(c) {
+					purged = append(purged, c)
+				} else {
+					kept = append(kept, c)
+				}
+			default:
+				break drain
+			}
+		}
+		ids := make([]string, len(kept))
+		for i, c := range kept {
+			s.queue <- c
+			ids[i] = c.id
+		}
+		return ids
+	})
+	for _, c := range purged {
+		s.settle(c, common.Hash{}, errPurged)
+	}
+	return purged
+}
+
+// retryClaim pays out a failed claim again under the same ID. It is not counted against the
+// rate limits again.
+func (s *Server) retryClaim(ctx context.Context, id string) (ClaimRecord, *claimError) {
+	record, ok := s.cfg.ledger.Get(id)
+	if !ok {
+		return ClaimRecord{}, &claimError{status: http.StatusNotFound, code: CodeNotFound, message: "unknown claim"}
+	}
+	asset, err := s.resolve(record.Symbol)
+	if err != nil {
+		return record, &claimError{status: http.StatusConflict, code: CodeUnknownAsset, message: err.Error()}
+	}
+	amount, err := chain.ParseUnits(record.Amount, asset.Decimals)
+	if err != nil {
+		return record, &claimError{status: http.StatusConflict, code: CodeInvalidAmount, message: err.Error()}
+	}
+
+	// Only one of concurrent retries finds the claim failed.
+	retried := false
+	record, _ = s.cfg.ledger.Update(id, func(entry *ClaimRecord) {
+		if entry.Status == ClaimFailed {
+			entry.Status, entry.TxHash, entry.Block, entry.Error = ClaimQueued, "", 0, ""
+			retried = true
+		}
+	})
+	if !retried {
+		return record, &claimError{status: http.StatusConflict, code: CodeConflict, message: "only failed claims can be retried"}
+	}
+	if _, _, rejected := s.pay(ctx, claim{id: id, address: record.Address, asset: asset, amount: amount}); rejected != nil {
+		return record, rejected
+	}
+	record, _ = s.cfg.ledger.Get(id)
+	return record, nil
+}
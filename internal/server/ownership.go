@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// Form fields of a claim carrying a signed ownership proof.
+const (
+	MessageKey   = "message"
+	SignatureKey = "signature"
+)
+
+// Message formats a claimant can be asked to sign.
+const (
+	// SIWEFormat is a Sign-In with Ethereum (EIP-4361) message.
+	SIWEFormat = "siwe"
+	// PersonalFormat is a plain text message.
+	PersonalFormat = "personal"
+)
+
+type OwnershipConfig struct {
+	Format    string
+	ChainID   int64
+	Statement string
+	// Secret signs nonces. Replicas behind one load balancer need the same secret.
+	Secret []byte
+	// TTL is how long an issued message can be signed and submitted.
+	TTL time.Duration
+}
+
+// Ownership is a guard that makes claimants prove they hold the key of the claim address. A
+// client fetches a message from /api/nonce, signs it with personal_sign (EIP-191), and posts
+// the message and signature with the claim. The nonce in the message is signed by the server
+// and bound to the address, so no state is kept until a message is used, and each message can
+// be used once.
+type Ownership struct {
+	cfg   OwnershipConfig
+	store LimiterStore
+	now   func() time.Time
+}
+
+// NewOwnership creates the guard. Used nonces are recorded in the store, so it can be shared
+// with the rate limiter to stop a signed message being replayed on another replica.
+func NewOwnership(cfg OwnershipConfig, store LimiterStore) (*Ownership, error) {
+	if cfg.Format != SIWEFormat && cfg.Format != PersonalFormat {
+		return nil, fmt.Errorf("unknown signed message format %q", cfg.Format)
+	}
+	if cfg.TTL <= 0 {
+		return nil, fmt.Errorf("signed message ttl must be positive, got %s", cfg.TTL)
+	}
+	if len(cfg.Secret) == 0 {
+		cfg.Secret = make([]byte, 32)
+		if _, err := rand.Read(cfg.Secret); err != nil {
+			return nil, err
+		}
+	}
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Ownership{cfg: cfg, store: store, now: time.Now}, nil
+}
+
+func (o *Ownership) Name() string {
+	return "signature"
+}
+
+// Public returns the message format and where to fetch a message to sign.
+func (o *Ownership) Public() interface{} {
+	return map[string]string{
+		"format":   o.cfg.Format,
+		"nonceURL": "/api/nonce",
+	}
+}
+
+func (o *Ownership) routes(router *http.ServeMux) {
+	router.Handle("/api/nonce", o.handleNonce())
+}
+
+// handleNonce issues a message for the address in the query to sign.
+func (o *Ownership) handleNonce() http.HandlerFunc {
+	type nonce struct {
+		Message string `json:"message"`
+		Nonce   string `json:"nonce"`
+		Expires int64  `json:"expires"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		address := r.URL.Query().Get(AddressKey)
+		if !chain.IsValidAddress(address, false) {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+
+		issued := o.now().Truncate(time.Second)
+		expires := issued.Add(o.cfg.TTL)
+		token, err := o.issue(common.HexToAddress(address), issued, expires)
+		if err != nil {
+			log.WithError(err).Error("Failed to issue nonce")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(nonce{
+			Message: o.message(r.Host, common.HexToAddress(address), token, issued, expires),
+			Nonce:   token,
+			Expires: expires.Unix(),
+		})
+	}
+}
+
+func (o *Ownership) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	address := r.PostFormValue(AddressKey)
+	if !chain.IsValidAddress(address, true) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidAddress, "invalid address")
+		return
+	}
+	message, signature := r.PostFormValue(MessageKey), r.PostFormValue(SignatureKey)
+	if message == "" || signature == "" {
+		writeError(w, r, http.StatusBadRequest, CodeVerificationRequired, "a signed message is required to prove you own the address")
+		return
+	}
+
+	now := o.now()
+	claimant := common.HexToAddress(address)
+	token, issued, expires, err := o.parse(message, claimant)
+	if err != nil || !now.Before(expires) {
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, "message is invalid or expired, please request a new one")
+		return
+	}
+	if message != o.message(r.Host, claimant, token, issued, expires) {
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, "message does not match the one issued for this address")
+		return
+	}
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeVerificationFailed, "signature must be hex encoded")
+		return
+	}
+	if signer, err := chain.RecoverPersonalSigner([]byte(message), sig); err != nil || signer != claimant {
+		log.WithField("address", address).Info("Rejected claim with a signature of another key")
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, "signature was not made by the claim address")
+		return
+	}
+
+	fresh, err := reserveOnce(r.Context(), o.store, "sig:"+token, expires, now)
+	if err != nil {
+		log.WithError(err).Error("Failed to record signed message nonce")
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "signature verification is unavailable, please try again later")
+		return
+	}
+	if !fresh {
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, "message has already been used, please request a new one")
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// message renders the text the claimant signs.
+func (o *Ownership) message(host string, address common.Address, token string, issued, expires time.Time) string {
+	if o.cfg.Format == SIWEFormat {
+		return fmt.Sprintf("%s wants you to sign in with your Ethereum account:\n%s\n\n%s\n\n"+
+			"URI: https://%s\nVersion: 1\nChain ID: %d\nNonce: %s\nIssued At: %s\nExpiration Time: %s",
+			host, address.Hex(), o.cfg.Statement, host, o.cfg.ChainID, token,
+			issued.UTC().Format(time.RFC3339), expires.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s\n\nAddress: %s\nChain ID: %d\nNonce: %s\nExpires: %s",
+		o.cfg.Statement, address.Hex(), o.cfg.ChainID, token, expires.UTC().Format(time.RFC3339))
+}
+
+// issue signs a random nonce bound to the address and validity period. The nonce is hex so
+// that it is alphanumeric as EIP-4361 requires.
+func (o *Ownership) issue(address common.Address, issued, expires time.Time) (string, error) {
+	payload := make([]byte, 16+8+8)
+	if _, err := rand.Read(payload[:16]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(payload[16:24], uint64(issued.Unix()))
+	binary.BigEndian.PutUint64(payload[24:32], uint64(expires.Unix()))
+	return hex.EncodeToString(payload) + hex.EncodeToString(o.sign(payload, address)), nil
+}
+
+func (o *Ownership) sign(payload []byte, address common.Address) []byte {
+	mac := hmac.New(sha256.New, o.cfg.Secret)
+	mac.Write(payload)
+	mac.Write(address.Bytes())
+	return mac.Sum(nil)[:16]
+}
+
+// parse finds the nonce in a message and checks that it was issued for the address. It
+// returns the nonce and the validity period it was issued with.
+func (o *Ownership) parse(message string, address common.Address) (string, time.Time, time.Time, error) {
+	var token string
+	for _, line := range strings.Split(message, "\n") {
+		if strings.HasPrefix(line, "Nonce: ") {
+			token = strings.TrimPrefix(line, "Nonce: ")
+			break
+		}
+	}
+	raw, err := hex.DecodeString(token)
+	if err != nil || len(raw) != 32+16 {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("malformed nonce")
+	}
+	payload, mac := raw[:32], raw[32:]
+	if !hmac.Equal(mac, o.sign(payload, address)) {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("nonce was not issued for %s", address.Hex())
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(payload[16:24])), 0)
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[24:32])), 0)
+	return token, issued, expires, nil
+}
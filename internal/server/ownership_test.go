@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/urfave/negroni"
+)
+
+func TestOwnership(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+
+	for _, format := range []string{SIWEFormat, PersonalFormat} {
+		t.Run(format, func(t *testing.T) {
+			ownership, err := NewOwnership(OwnershipConfig{
+				Format:    format,
+				ChainID:   5,
+				Statement: "Claim testnet funds from the faucet.",
+				TTL:       10 * time.Minute,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			ownership.now = func() time.Time { return now }
+
+			router := http.NewServeMux()
+			ownership.routes(router)
+			handler := negroni.New(ownership, negroni.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			})))
+
+			fetch := func(address string) string {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/nonce?address="+address, nil))
+				var body struct {
+					Message string `json:"message"`
+				}
+				json.NewDecoder(rec.Body).Decode(&body)
+				return body.Message
+			}
+			sign := func(message string, signer *ecdsa.PrivateKey) string {
+				sig, err := crypto.Sign(accounts.TextHash([]byte(message)), signer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sig[64] += 27
+				return hexutil.Encode(sig)
+			}
+			submit := func(address, message, signature string) int {
+				form := url.Values{AddressKey: {address}, MessageKey: {message}, SignatureKey: {signature}}
+				req := httptest.NewRequest("POST", "/api/claim", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				return rec.Code
+			}
+
+			message := fetch(strings.ToLower(address))
+			if format == SIWEFormat && !strings.HasPrefix(message, "example.com wants you to sign in with your Ethereum account:\n"+address+"\n") {
+				t.Errorf("message = %q, want a SIWE message for %s", message, address)
+			}
+			if got := submit(address, message, ""); got != http.StatusBadRequest {
+				t.Errorf("unsigned: status = %d, want %d", got, http.StatusBadRequest)
+			}
+			if got := submit(address, message, sign(message, other)); got != http.StatusForbidden {
+				t.Errorf("signed by another key: status = %d, want %d", got, http.StatusForbidden)
+			}
+			edited := strings.Replace(message, "Chain ID: 5", "Chain ID: 1", 1)
+			if got := submit(address, edited, sign(edited, key)); got != http.StatusForbidden {
+				t.Errorf("edited message: status = %d, want %d", got, http.StatusForbidden)
+			}
+			otherAddress := "0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B"
+			if got := submit(otherAddress, message, sign(message, key)); got != http.StatusForbidden {
+				t.Errorf("message for another address: status = %d, want %d", got, http.StatusForbidden)
+			}
+			signature := sign(message, key)
+			if got := submit(address, message, signature); got != http.StatusOK {
+				t.Errorf("signed: status = %d, want %d", got, http.StatusOK)
+			}
+			if got := submit(address, message, signature); got != http.StatusForbidden {
+				t.Errorf("replayed: status = %d, want %d", got, http.StatusForbidden)
+			}
+
+			expiring := fetch(address)
+			now = now.Add(time.Hour)
+			if got := submit(address, expiring, sign(expiring, key)); got != http.StatusForbidden {
+				t.Errorf("expired: status = %d, want %d", got, http.StatusForbidden)
+			}
+		})
+	}
+}
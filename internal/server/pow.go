@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Form fields of a claim carrying a solved proof-of-work challenge.
+const (
+	ChallengeKey = "challenge"
+	SolutionKey  = "solution"
+)
+
+type ProofOfWorkConfig struct {
+	// Secret signs challenges. Replicas behind one load balancer need the same secret.
+	Secret []byte
+	// Difficulty is the number of leading zero bits a solution needs while the queue is empty.
+	Difficulty int
+	// MaxDifficulty caps the difficulty however long the queue grows.
+	MaxDifficulty int
+	// QueueStep adds one bit of difficulty for every QueueStep claims waiting in the queue.
+	QueueStep int
+	// TTL is how long a challenge can be solved and submitted.
+	TTL time.Duration
+}
+
+// ProofOfWork is a hashcash-style guard. A client fetches a signed, expiring challenge from
+// /api/challenge and has to find a solution such that sha256("<challenge>:<solution>") starts
+// with as many zero bits as the challenge's difficulty. Each challenge can be used once.
+type ProofOfWork struct {
+	cfg   ProofOfWorkConfig
+	store LimiterStore
+	queue func() int
+	now   func() time.Time
+}
+
+// NewProofOfWork creates the guard. Used challenges are recorded in the store, so it can be
+// shared with the rate limiter to stop a challenge being replayed on another replica.
+func NewProofOfWork(cfg ProofOfWorkConfig, store LimiterStore) (*ProofOfWork, error) {
+	if cfg.Difficulty <= 0 || cfg.Difficulty > 64 {
+		return nil, fmt.Errorf("proof of work difficulty must be between 1 and 64, got %d", cfg.Difficulty)
+	}
+	if cfg.MaxDifficulty < cfg.Difficulty || cfg.MaxDifficulty > 64 {
+		return nil, fmt.Errorf("proof of work max difficulty must be between %d and 64, got %d", cfg.Difficulty, cfg.MaxDifficulty)
+	}
+	if cfg.TTL <= 0 {
+		return nil, fmt.Errorf("proof of work challenge ttl must be positive, got %s", cfg.TTL)
+	}
+	if len(cfg.Secret) == 0 {
+		cfg.Secret = make([]byte, 32)
+		if _, err := rand.Read(cfg.Secret); err != nil {
+			return nil, err
+		}
+	}
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &ProofOfWork{
+		cfg:   cfg,
+		store: store,
+		queue: func() int { return 0 },
+		now:   time.Now,
+	}, nil
+}
+
+func (p *ProofOfWork) Name() string {
+	return "pow"
+}
+
+// Public returns the current difficulty and where to fetch a challenge.
+func (p *ProofOfWork) Public() interface{} {
+	return map[string]interface{}{
+		"challengeURL": "/api/challenge",
+		"difficulty":   p.difficulty(),
+	}
+}
+
+func (p *ProofOfWork) watchQueue(length func() int) {
+	p.queue = length
+}
+
+func (p *ProofOfWork) routes(router *http.ServeMux) {
+	router.Handle("/api/challenge", p.handleChallenge())
+}
+
+// difficulty grows by one bit for every QueueStep claims waiting in the queue.
+func (p *ProofOfWork) difficulty() int {
+	difficulty := p.cfg.Difficulty
+	if p.cfg.QueueStep > 0 {
+		difficulty += p.queue() / p.cfg.QueueStep
+	}
+	if difficulty > p.cfg.MaxDifficulty {
+		difficulty = p.cfg.MaxDifficulty
+	}
+	return difficulty
+}
+
+func (p *ProofOfWork) handleChallenge() http.HandlerFunc {
+	type challenge struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+		Expires    int64  `json:"expires"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		difficulty := p.difficulty()
+		expires := p.now().Add(p.cfg.TTL)
+		token, err := p.issue(difficulty, expires)
+		if err != nil {
+			log.WithError(err).Error("Failed to issue proof of work challenge")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(challenge{Challenge: token, Difficulty: difficulty, Expires: expires.Unix()})
+	}
+}
+
+// issue signs a random nonce together with its expiry and difficulty.
+func (p *ProofOfWork) issue(difficulty int, expires time.Time) (string, error) {
+	payload := make([]byte, 16+8+1)
+	if _, err := rand.Read(payload[:16]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(payload[16:24], uint64(expires.Unix()))
+	payload[24] = byte(difficulty)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + p.sign(encoded), nil
+}
+
+func (p *ProofOfWork) sign(encoded string) string {
+	mac := hmac.New(sha256.New, p.cfg.Secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (p *ProofOfWork) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	token, solution := r.PostFormValue(ChallengeKey), r.PostFormValue(SolutionKey)
+	if token == "" || solution == "" {
+		writeError(w, r, http.StatusBadRequest, CodeVerificationRequired, "proof of work is required, please request a challenge")
+		return
+	}
+
+	now := p.now()
+	nonce, expires, difficulty, err := p.parse(token)
+	if err != nil || !now.Before(expires) {
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, "challenge is invalid or expired, please request a new one")
+		return
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(token+":"+solution))) < difficulty {
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, "solution does not meet the challenge difficulty")
+		return
+	}
+
+	fresh, err := reserveOnce(r.Context(), p.store, "pow:"+nonce, expires, now)
+	if err != nil {
+		log.WithError(err).Error("Failed to record proof of work challenge")
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "proof of work verification is unavailable, please try again later")
+		return
+	}
+	if !fresh {
+		writeError(w, r, http.StatusForbidden, CodeVerificationFailed, "challenge has already been used, please request a new one")
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// parse checks the signature of a challenge and returns its nonce, expiry and difficulty.
+func (p *ProofOfWork) parse(token string) (string, time.Time, int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(p.sign(parts[0]))) {
+		return "", time.Time{}, 0, fmt.Errorf("invalid challenge signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) != 25 {
+		return "", time.Time{}, 0, fmt.Errorf("malformed challenge")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[16:24])), 0)
+	return base64.RawURLEncoding.EncodeToString(payload[:16]), expires, int(payload[24]), nil
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
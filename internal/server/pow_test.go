@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/negroni"
+)
+
+func TestProofOfWork(t *testing.T) {
+	pow, err := NewProofOfWork(ProofOfWorkConfig{Difficulty: 8, MaxDifficulty: 10, QueueStep: 10, TTL: time.Minute}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := 0
+	pow.watchQueue(func() int { return queued })
+	now := time.Now()
+	pow.now = func() time.Time { return now }
+
+	router := http.NewServeMux()
+	pow.routes(router)
+	handler := negroni.New(pow, negroni.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+
+	fetch := func() (string, int) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/challenge", nil))
+		var body struct {
+			Challenge  string `json:"challenge"`
+			Difficulty int    `json:"difficulty"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Challenge, body.Difficulty
+	}
+	// solve returns the first solution that does or doesn't meet the difficulty.
+	solve := func(challenge string, difficulty int, valid bool) string {
+		for i := 0; ; i++ {
+			solution := strconv.Itoa(i)
+			if (leadingZeroBits(sha256.Sum256([]byte(challenge+":"+solution))) >= difficulty) == valid {
+				return solution
+			}
+		}
+	}
+	submit := func(challenge, solution string) int {
+		form := url.Values{ChallengeKey: {challenge}, SolutionKey: {solution}}
+		req := httptest.NewRequest("POST", "/api/claim", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	challenge, difficulty := fetch()
+	if difficulty != 8 {
+		t.Errorf("difficulty = %d, want 8", difficulty)
+	}
+	if got := submit(challenge, ""); got != http.StatusBadRequest {
+		t.Errorf("missing solution: status = %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := submit(challenge, solve(challenge, difficulty, false)); got != http.StatusForbidden {
+		t.Errorf("wrong solution: status = %d, want %d", got, http.StatusForbidden)
+	}
+	solution := solve(challenge, difficulty, true)
+	if got := submit(challenge, solution); got != http.StatusOK {
+		t.Errorf("solved: status = %d, want %d", got, http.StatusOK)
+	}
+	if got := submit(challenge, solution); got != http.StatusForbidden {
+		t.Errorf("replayed: status = %d, want %d", got, http.StatusForbidden)
+	}
+
+	tampered, _ := fetch()
+	parts := strings.Split(tampered, ".")
+	tampered = parts[0][:len(parts[0])-2] + "AA." + parts[1]
+	if got := submit(tampered, solve(tampered, 0, true)); got != http.StatusForbidden {
+		t.Errorf("tampered: status = %d, want %d", got, http.StatusForbidden)
+	}
+
+	expiring, difficulty := fetch()
+	now = now.Add(2 * time.Minute)
+	if got := submit(expiring, solve(expiring, difficulty, true)); got != http.StatusForbidden {
+		t.Errorf("expired: status = %d, want %d", got, http.StatusForbidden)
+	}
+
+	queued = 15
+	if _, difficulty := fetch(); difficulty != 9 {
+		t.Errorf("difficulty with 15 queued = %d, want 9", difficulty)
+	}
+	queued = 100
+	if _, difficulty := fetch(); difficulty != 10 {
+		t.Errorf("difficulty with 100 queued = %d, want 10", difficulty)
+	}
+}
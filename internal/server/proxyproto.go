@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	// maxAcceptDelay caps the backoff after temporary accept errors, as net/http does.
+	maxAcceptDelay = time.Second
+	// maxProxyHeaderV1 is the longest v1 header the spec allows, including the CRLF.
+	maxProxyHeaderV1 = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections that start with a PROXY protocol v1 or v2 header and
+// reports the client address from the header as the connection's remote address. Headers are
+// read off the accept loop so a slow peer cannot stall other connections.
+type proxyListener struct {
+	net.Listener
+	trusted func(net.IP) bool
+	conns   chan net.Conn
+	errs    chan error
+	// done is closed with the listener, so handshakes that are still running give up.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newProxyListener wraps a listener with PROXY protocol support. Connections from peers the
+// trusted function rejects are closed, since anyone else could forge their client address.
+func newProxyListener(inner net.Listener, trusted func(net.IP) bool) net.Listener {
+	l := &proxyListener{
+		Listener: inner,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// acceptLoop hands accepted connections to handshakes. Temporary errors, such as running out
+// of file descriptors, are retried with a growing delay, and any other error ends the loop.
+func (l *proxyListener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.WithError(err).Warnf("PROXY protocol accept error, retrying in %s", delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-l.done:
+				l.errs <- err
+				return
+			}
+		}
+		if err != nil {
+			l.errs <- err
+			return
+		}
+		delay = 0
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyListener) handshake(conn net.Conn) {
+	peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.trusted(peer.IP) {
+		log.WithField("peer", conn.RemoteAddr().String()).Warn("Rejected PROXY protocol connection from untrusted peer")
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	reader := bufio.NewReader(conn)
+	source, err := readProxyHeader(reader)
+	if err != nil {
+		log.WithError(err).WithField("peer", conn.RemoteAddr().String()).Warn("Invalid PROXY protocol header")
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	select {
+	case l.conns <- &proxyConn{Conn: conn, reader: reader, source: source}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// proxyConn is a connection whose remote address was taken from a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	source net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.source == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.source
+}
+
+// readProxyHeader consumes a PROXY protocol header and returns the source address it carries.
+// A nil address means the header announced a connection without client information, such as
+// a health check by the proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// Read the line byte by byte, so a peer can't make it grow past the limit.
+	var header []byte
+	for len(header) < maxProxyHeaderV1 && !bytes.HasSuffix(header, []byte("\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, b)
+	}
+	line := string(header)
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("malformed v1 header")
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("missing PROXY signature")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("unsupported v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid source address in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	command, family := header[12]&0x0f, header[13]>>4
+	if command == 0 {
+		return nil, nil
+	}
+	switch {
+	case family == 1 && len(payload) >= 12:
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case family == 2 && len(payload) >= 36:
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	case family == 0:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported address family %d", family)
+}
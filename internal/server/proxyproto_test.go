@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12)
+	v2 = append(v2, 203, 0, 113, 7, 10, 0, 0, 1)
+	v2 = binary.BigEndian.AppendUint16(v2, 51000)
+	v2 = binary.BigEndian.AppendUint16(v2, 443)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n"), want: "203.0.113.7:51000"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 443\r\n"), want: "[2001:db8::7]:51000"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n"), want: ""},
+		{name: "v2 ipv4", header: v2, want: "203.0.113.7:51000"},
+		{name: "missing header", header: []byte("GET / HTTP/1.1\r\n"), wantErr: true},
+		{name: "v1 too long", header: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := append(append([]byte{}, tt.header...), "GET / HTTP/1.1\r\n"...)
+			reader := bufio.NewReader(bytes.NewReader(payload))
+			addr, err := readProxyHeader(reader)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("readProxyHeader() = %v, want %v", got, tt.want)
+			}
+			if rest, _ := reader.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("request after header = %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newProxyListener(inner, func(ip net.IP) bool { return ip.IsLoopback() })
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 51000 80\r\nping\n"))
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51000" {
+		t.Errorf("RemoteAddr() = %v, want 203.0.113.7:51000", got)
+	}
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if strings.TrimSpace(line) != "ping" {
+		t.Errorf("Read() = %q, want ping", line)
+	}
+}
+
+// flakyListener fails its first accepts with a temporary error before it hands out conns.
+type flakyListener struct {
+	net.Listener
+	failures int
+	conns    chan net.Conn
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (f *flakyListener) Accept() (net.Conn, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, temporaryError{}
+	}
+	conn, ok := <-f.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (f *flakyListener) Close() error {
+	close(f.conns)
+	return nil
+}
+
+func TestProxyListenerAcceptErrors(t *testing.T) {
+	inner := &flakyListener{failures: 2, conns: make(chan net.Conn, 1)}
+	listener := newProxyListener(inner, func(net.IP) bool { return true })
+
+	// The listener survives temporary errors.
+	server, client := pipeConn()
+	inner.conns <- server
+	go client.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 51000 80\r\n"))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() after temporary errors: %v", err)
+	}
+	conn.Close()
+	client.Close()
+
+	// A handshake nobody accepts is closed with the listener.
+	server, client = pipeConn()
+	inner.conns <- server
+	client.Write([]byte("PROXY TCP4 203.0.113.8 127.0.0.1 51000 80\r\n"))
+	listener.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() of an unaccepted conn = %v, want EOF", err)
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Error("Accept() after Close() succeeded")
+	}
+}
+
+// pipeConn returns the ends of a TCP connection over loopback, so the server end has a TCP
+// remote address.
+func pipeConn() (server, client net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		panic(err)
+	}
+	return server, client
+}
@@ -0,0 +1,528 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// Asset is a fundable asset together with its payout policy. Contract is nil for the chain's
+// native asset, which is paid with plain value transfers.
+type Asset struct {
+	Symbol   string
+	Name     string
+	Decimals int
+	LogoURI  string
+	Contract *common.Address
+	Payout   *big.Int
+	Cooldown time.Duration
+	DailyCap *big.Int
+	builder  chain.TokenTxBuilder
+
+	// MinAmount and MaxAmount bound the amount a user may ask for in a single claim, and
+	// Quota is the total an address may claim within one cooldown window. IPQuota and
+	// SubnetQuota bound the same total per client IP and per client subnet, nil disables them.
+	MinAmount   *big.Int
+	MaxAmount   *big.Int
+	Quota       *big.Int
+	IPQuota     *big.Int
+	SubnetQuota *big.Int
+
+	// Paused assets are listed but can't be claimed until an operator resumes them.
+	Paused bool
+}
+
+// IsNative reports whether the asset is the chain's native asset.
+func (a *Asset) IsNative() bool {
+	return a.Contract == nil
+}
+
+// ClaimAmount parses the amount a user asked for, defaulting to the payout, and checks it
+// against the asset's bounds.
+func (a *Asset) ClaimAmount(input string) (*big.Int, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return a.Payout, nil
+	}
+
+	amount, err := chain.ParseUnits(input, a.Decimals)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Cmp(a.MinAmount) < 0 || amount.Cmp(a.MaxAmount) > 0 {
+		return nil, fmt.Errorf("amount must be between %s and %s %s",
+			chain.FormatUnits(a.MinAmount, a.Decimals), chain.FormatUnits(a.MaxAmount, a.Decimals), a.Symbol)
+	}
+	return amount, nil
+}
+
+// Registry holds the assets the faucet is able to fund, keyed by lower case symbol.
+type Registry struct {
+	native     *Asset
+	tokens     map[string]*Asset
+	byContract map[common.Address]*Asset
+	disabled   []*Asset
+}
+
+// AssetDefaults apply to assets whose config leaves the payout or cooldown out. The payout is
+// a decimal string that is scaled by each asset's own decimals.
+type AssetDefaults struct {
+	Payout   string
+	Cooldown time.Duration
+}
+
+// TokenDialer creates the transaction builder used to pay out a configured token.
+type TokenDialer func(token Erc20Token) (chain.TokenTxBuilder, error)
+
+// UnknownAssetError is returned when a claim names an asset that is not in the registry.
+type UnknownAssetError struct {
+	Symbol    string
+	Available []string
+}
+
+func (e *UnknownAssetError) Error() string {
+	return fmt.Sprintf("unknown asset %q, available assets: %s", e.Symbol, strings.Join(e.Available, ", "))
+}
+
+// LoadTokenConfig reads the token config from a file path or an http(s) URL. The source is
+// either the faucet's own array of tokens or a standard token list, in which case only the
+// tokens deployed on the given chain are returned.
+func LoadTokenConfig(source string, chainID int64) ([]Erc20Token, error) {
+	content, err := readSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var tokens []Erc20Token
+		if err := json.Unmarshal(trimmed, &tokens); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", source, err)
+		}
+		return tokens, nil
+	}
+
+	var list TokenList
+	if err := json.Unmarshal(trimmed, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", source, err)
+	}
+
+	var tokens []Erc20Token
+	for _, item := range list.Tokens {
+		if item.ChainID != chainID {
+			continue
+		}
+		tokens = append(tokens, Erc20Token{
+			ContractAddress: item.Address,
+			Decimal:         item.Decimals,
+			Symbol:          item.Symbol,
+			Name:            item.Name,
+			LogoURI:         item.LogoURI,
+			Payout:          item.Extensions.FaucetPayout,
+			Minutes:         item.Extensions.FaucetMinutes,
+			DailyCap:        item.Extensions.FaucetDailyCap,
+			MinAmount:       item.Extensions.FaucetMin,
+			MaxAmount:       item.Extensions.FaucetMax,
+			Quota:           item.Extensions.FaucetQuota,
+			IPQuota:         item.Extensions.FaucetIPQuota,
+			SubnetQuota:     item.Extensions.FaucetSubnetQuota,
+		})
+	}
+	return tokens, nil
+}
+
+func readSource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// BuildRegistry dials every configured token, validates it against the chain and returns a
+// registry of the tokens that passed. Tokens that don't match their contract are logged and
+// left out, while mistakes in the config, such as entries that clash with each other or an
+// invalid payout, make the whole config invalid. A token whose chain can't be reached keeps
+// running as it is in the running registry, which is nil at startup.
+func BuildRegistry(ctx context.Context, native NativeAsset, configs []Erc20Token, defaults AssetDefaults, dial TokenDialer, running *Registry) (*Registry, error) {
+	if err := checkTokenConfig(native, configs); err != nil {
+		return nil, err
+	}
+
+	nativePayout := string(native.Payout)
+	if nativePayout == "" {
+		nativePayout = defaults.Payout
+	}
+	payout, err := parsePayout(nativePayout, native.Decimals)
+	if err != nil {
+		return nil, fmt.Errorf("native payout: %w", err)
+	}
+	nativeAsset := &Asset{
+		Symbol:   strings.ToLower(native.Symbol),
+		Name:     native.Name,
+		Decimals: native.Decimals,
+		Payout:   payout,
+		Cooldown: defaults.Cooldown,
+	}
+	if err := applyBounds(nativeAsset, native.MinAmount, native.MaxAmount, native.Quota); err != nil {
+		return nil, fmt.Errorf("native asset: %w", err)
+	}
+	if err := applyClientQuotas(nativeAsset, native.IPQuota, native.SubnetQuota); err != nil {
+		return nil, fmt.Errorf("native asset: %w", err)
+	}
+
+	var tokens, disabled []*Asset
+	for _, cfg := range configs {
+		builder, err := dial(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("dial token %s: %w", cfg.Symbol, err)
+		}
+
+		token, err := validateToken(ctx, cfg, builder)
+		if kept, ok := running.unreachable(cfg, err); ok {
+			log.WithError(err).WithField("symbol", cfg.Symbol).Warn("Token could not be validated, keeping the running one")
+			token, err = kept, nil
+		}
+		if err != nil {
+			log.WithError(err).WithField("symbol", cfg.Symbol).Error("Token failed validation and is disabled")
+			disabled = append(disabled, disabledToken(cfg))
+			continue
+		}
+		if err := applyPolicy(token, cfg, defaults); err != nil {
+			return nil, fmt.Errorf("token %s: %w", cfg.Symbol, err)
+		}
+		log.Infof("token %s >> %s", token.Symbol, token.Contract.Hex())
+		tokens = append(tokens, token)
+	}
+
+	registry := NewRegistry(nativeAsset, tokens)
+	sort.Slice(disabled, func(i, j int) bool { return disabled[i].Symbol < disabled[j].Symbol })
+	registry.disabled = disabled
+	return registry, nil
+}
+
+// unreachableError marks a token check that failed because the chain couldn't be reached,
+// rather than because the contract doesn't match the config.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string { return e.err.Error() }
+func (e *unreachableError) Unwrap() error { return e.err }
+
+// unreachable returns the running token of the config entry without its policy, if it failed
+// validation only because the chain couldn't be reached. The registry may be nil.
+func (r *Registry) unreachable(cfg Erc20Token, err error) (*Asset, bool) {
+	var unreachable *unreachableError
+	if r == nil || !errors.As(err, &unreachable) {
+		return nil, false
+	}
+	prev, ok := r.tokens[strings.ToLower(cfg.Symbol)]
+	if !ok || *prev.Contract != common.HexToAddress(cfg.ContractAddress) {
+		return nil, false
+	}
+	token := disabledToken(cfg)
+	token.Decimals, token.Contract, token.builder = prev.Decimals, prev.Contract, prev.builder
+	return token, true
+}
+
+// disabledToken describes a token that failed validation by its config entry alone.
+func disabledToken(cfg Erc20Token) *Asset {
+	name := cfg.Name
+	if name == "" {
+		name = strings.ToUpper(cfg.Symbol)
+	}
+	contract := common.HexToAddress(cfg.ContractAddress)
+	return &Asset{
+		Symbol:   strings.ToLower(cfg.Symbol),
+		Name:     name,
+		Decimals: cfg.Decimal,
+		LogoURI:  cfg.LogoURI,
+		Contract: &contract,
+	}
+}
+
+// NewRegistry creates a registry from the native asset and already validated tokens.
+func NewRegistry(native *Asset, tokens []*Asset) *Registry {
+	r := &Registry{
+		native:     native,
+		tokens:     make(map[string]*Asset, len(tokens)),
+		byContract: make(map[common.Address]*Asset, len(tokens)),
+	}
+	for _, token := range tokens {
+		r.tokens[strings.ToLower(token.Symbol)] = token
+		r.byContract[*token.Contract] = token
+	}
+	return r
+}
+
+func checkTokenConfig(native NativeAsset, configs []Erc20Token) error {
+	symbols := map[string]bool{strings.ToLower(native.Symbol): true}
+	contracts := make(map[common.Address]bool)
+	for _, cfg := range configs {
+		if !chain.IsValidAddress(cfg.ContractAddress, false) {
+			return fmt.Errorf("token %s has invalid contract address %q", cfg.Symbol, cfg.ContractAddress)
+		}
+		symbol := strings.ToLower(cfg.Symbol)
+		if symbol == "" {
+			return fmt.Errorf("token %s has no symbol", cfg.ContractAddress)
+		}
+		if symbols[symbol] {
+			return fmt.Errorf("token symbol %s is used more than once or collides with the native asset", cfg.Symbol)
+		}
+		address := common.HexToAddress(cfg.ContractAddress)
+		if contracts[address] {
+			return fmt.Errorf("token contract %s is listed more than once", cfg.ContractAddress)
+		}
+		symbols[symbol] = true
+		contracts[address] = true
+	}
+	return nil
+}
+
+func validateToken(ctx context.Context, cfg Erc20Token, builder chain.TokenTxBuilder) (*Asset, error) {
+	// The code is looked up first, so it fails when the chain can't be reached, while the calls
+	// after it may fail because the contract is not a token.
+	hasCode, err := builder.HasCode(ctx)
+	if err != nil {
+		return nil, &unreachableError{err: err}
+	}
+	if !hasCode {
+		return nil, fmt.Errorf("no contract code at %s", cfg.ContractAddress)
+	}
+
+	symbol, err := builder.Symbol(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("symbol(): %w", err)
+	}
+	if !strings.EqualFold(symbol, cfg.Symbol) {
+		return nil, fmt.Errorf("contract symbol %q does not match configured %q", symbol, cfg.Symbol)
+	}
+
+	decimals, err := builder.Decimals(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("decimals(): %w", err)
+	}
+	if cfg.Decimal != 0 && int(decimals) != cfg.Decimal {
+		return nil, fmt.Errorf("contract decimals %d do not match configured %d", decimals, cfg.Decimal)
+	}
+
+	balance, err := builder.BalanceOf(ctx, builder.Sender())
+	if err != nil {
+		return nil, fmt.Errorf("balanceOf(): %w", err)
+	}
+	if balance.Cmp(big.NewInt(0)) <= 0 {
+		return nil, fmt.Errorf("faucet account %s holds no %s", builder.Sender().Hex(), cfg.Symbol)
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = strings.ToUpper(cfg.Symbol)
+	}
+	contract := builder.ContractAddress()
+	return &Asset{
+		Symbol:   strings.ToLower(cfg.Symbol),
+		Name:     name,
+		Decimals: int(decimals),
+		LogoURI:  cfg.LogoURI,
+		Contract: &contract,
+		builder:  builder,
+	}, nil
+}
+
+// applyPolicy sets the payout, cooldown and daily cap of a token from its config entry.
+func applyPolicy(token *Asset, cfg Erc20Token, defaults AssetDefaults) error {
+	payout := string(cfg.Payout)
+	if payout == "" {
+		payout = defaults.Payout
+	}
+	var err error
+	if token.Payout, err = parsePayout(payout, token.Decimals); err != nil {
+		return fmt.Errorf("payout: %w", err)
+	}
+
+	token.Cooldown = defaults.Cooldown
+	if cfg.Minutes != nil {
+		if *cfg.Minutes < 0 {
+			return errors.New("cooldown minutes must not be negative")
+		}
+		token.Cooldown = time.Duration(*cfg.Minutes) * time.Minute
+	}
+
+	if cfg.DailyCap != "" {
+		dailyCap, err := chain.ParseUnits(string(cfg.DailyCap), token.Decimals)
+		if err != nil {
+			return fmt.Errorf("daily cap: %w", err)
+		}
+		if dailyCap.Cmp(token.Payout) < 0 {
+			return errors.New("daily cap is smaller than a single payout")
+		}
+		token.DailyCap = dailyCap
+	}
+	if err := applyBounds(token, cfg.MinAmount, cfg.MaxAmount, cfg.Quota); err != nil {
+		return err
+	}
+	return applyClientQuotas(token, cfg.IPQuota, cfg.SubnetQuota)
+}
+
+// applyClientQuotas sets the per IP and per subnet quotas of an asset. The IP quota defaults to
+// the address quota and can be turned off with "unlimited", the subnet quota is off by default.
+func applyClientQuotas(asset *Asset, ipQuota, subnetQuota Amount) error {
+	var err error
+	asset.IPQuota, asset.SubnetQuota = asset.Quota, nil
+	if ipQuota == unlimited {
+		asset.IPQuota = nil
+	} else if ipQuota != "" {
+		if asset.IPQuota, err = parsePayout(string(ipQuota), asset.Decimals); err != nil {
+			return fmt.Errorf("ip quota: %w", err)
+		}
+		if asset.IPQuota.Cmp(asset.MinAmount) < 0 {
+			return errors.New("ip quota is smaller than the min amount")
+		}
+	}
+	if subnetQuota != "" {
+		if asset.SubnetQuota, err = parsePayout(string(subnetQuota), asset.Decimals); err != nil {
+			return fmt.Errorf("subnet quota: %w", err)
+		}
+		if asset.SubnetQuota.Cmp(asset.MinAmount) < 0 {
+			return errors.New("subnet quota is smaller than the min amount")
+		}
+	}
+	return nil
+}
+
+// applyBounds sets the claim amount bounds and the per-window quota of an asset whose payout
+// is already known. The bounds default to the payout, so users get a fixed amount unless a
+// range is configured, and the quota defaults to the maximum amount of a single claim.
+func applyBounds(asset *Asset, minAmount, maxAmount, quota Amount) error {
+	var err error
+	asset.MinAmount, asset.MaxAmount, asset.Quota = asset.Payout, asset.Payout, nil
+	if minAmount != "" {
+		if asset.MinAmount, err = parsePayout(string(minAmount), asset.Decimals); err != nil {
+			return fmt.Errorf("min amount: %w", err)
+		}
+	}
+	if maxAmount != "" {
+		if asset.MaxAmount, err = parsePayout(string(maxAmount), asset.Decimals); err != nil {
+			return fmt.Errorf("max amount: %w", err)
+		}
+	}
+	if asset.MinAmount.Cmp(asset.Payout) > 0 || asset.MaxAmount.Cmp(asset.Payout) < 0 {
+		return errors.New("payout must lie between the min and max amount")
+	}
+
+	asset.Quota = asset.MaxAmount
+	if quota != "" {
+		if asset.Quota, err = parsePayout(string(quota), asset.Decimals); err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+		if asset.Quota.Cmp(asset.MaxAmount) < 0 {
+			return errors.New("quota is smaller than the max amount")
+		}
+	}
+	return nil
+}
+
+// unlimited turns off an optional limit that is enforced by default.
+const unlimited = "unlimited"
+
+func parsePayout(amount string, decimals int) (*big.Int, error) {
+	payout, err := chain.ParseUnits(amount, decimals)
+	if err != nil {
+		return nil, err
+	}
+	if payout.Sign() <= 0 {
+		return nil, errors.New("payout must be positive")
+	}
+	return payout, nil
+}
+
+// Resolve maps the asset a user submitted, either a symbol or a token contract address, onto
+// a registered asset. Empty input and the native asset's symbol select the native asset.
+func (r *Registry) Resolve(input string) (*Asset, error) {
+	input = strings.TrimSpace(input)
+	symbol := strings.ToLower(input)
+	if symbol == "" || symbol == "null" || symbol == r.native.Symbol {
+		return r.native, nil
+	}
+	if token, ok := r.tokens[symbol]; ok {
+		return token, nil
+	}
+	if common.IsHexAddress(input) {
+		if token, ok := r.byContract[common.HexToAddress(input)]; ok {
+			return token, nil
+		}
+	}
+	return nil, &UnknownAssetError{Symbol: input, Available: r.Symbols()}
+}
+
+// lookup finds the asset with the symbol, including tokens that failed validation.
+func (r *Registry) lookup(symbol string) (*Asset, bool) {
+	if strings.TrimSpace(symbol) == "" || strings.EqualFold(symbol, "null") {
+		return nil, false
+	}
+	if asset, err := r.Resolve(symbol); err == nil {
+		return asset, true
+	}
+	for _, asset := range r.disabled {
+		if strings.EqualFold(asset.Symbol, symbol) {
+			return asset, true
+		}
+	}
+	return nil, false
+}
+
+// Assets lists the native asset first followed by the tokens in alphabetical order.
+func (r *Registry) Assets() []*Asset {
+	symbols := r.Symbols()
+	assets := make([]*Asset, 0, len(symbols))
+	assets = append(assets, r.native)
+	for _, symbol := range symbols[1:] {
+		assets = append(assets, r.tokens[symbol])
+	}
+	return assets
+}
+
+// Disabled lists the configured tokens that failed validation in alphabetical order. They are
+// shown to users but can't be claimed, and only their config is known.
+func (r *Registry) Disabled() []*Asset {
+	return r.disabled
+}
+
+// Native returns the chain's native asset.
+func (r *Registry) Native() *Asset {
+	return r.native
+}
+
+// Symbols lists the available assets, native asset first and tokens in alphabetical order.
+func (r *Registry) Symbols() []string {
+	symbols := make([]string, 0, len(r.tokens))
+	for symbol := range r.tokens {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return append([]string{r.native.Symbol}, symbols...)
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+type fakeToken struct {
+	contract common.Address
+	hasCode  bool
+	// down makes the chain unreachable.
+	down     bool
+	symbol   string
+	decimals uint8
+	balance  *big.Int
+}
+
+func (f *fakeToken) Sender() common.Address          { return common.HexToAddress("0x1") }
+func (f *fakeToken) ContractAddress() common.Address { return f.contract }
+func (f *fakeToken) Transfer(context.Context, string, *big.Int) (common.Hash, error) {
+	return common.Hash{}, nil
+}
+func (f *fakeToken) HasCode(context.Context) (bool, error) {
+	if f.down {
+		return false, errors.New("connection refused")
+	}
+	return f.hasCode, nil
+}
+func (f *fakeToken) Symbol(context.Context) (string, error)  { return f.symbol, nil }
+func (f *fakeToken) Decimals(context.Context) (uint8, error) { return f.decimals, nil }
+func (f *fakeToken) BalanceOf(context.Context, common.Address) (*big.Int, error) {
+	return f.balance, nil
+}
+
+var (
+	testNative   = NativeAsset{Symbol: "xt", Name: "XT", Decimals: 18, Payout: "0.05"}
+	testDefaults = AssetDefaults{Payout: "1", Cooldown: time.Hour}
+)
+
+func newTestAsset(symbol, contract string) *Asset {
+	address := common.HexToAddress(contract)
+	payout := big.NewInt(1000000)
+	return &Asset{
+		Symbol:    symbol,
+		Name:      symbol,
+		Decimals:  6,
+		Contract:  &address,
+		Payout:    payout,
+		Cooldown:  time.Hour,
+		MinAmount: payout,
+		MaxAmount: payout,
+		Quota:     payout,
+	}
+}
+
+func newTestRegistry(tokens ...*Asset) *Registry {
+	payout := chain.EtherToWei(1)
+	native := &Asset{Symbol: "xt", Name: "XT", Decimals: 18, Payout: payout, Cooldown: time.Hour, MinAmount: payout, MaxAmount: payout, Quota: payout}
+	return NewRegistry(native, tokens)
+}
+
+func fakeDialer(chainState map[string]*fakeToken) TokenDialer {
+	return func(token Erc20Token) (chain.TokenTxBuilder, error) {
+		f, ok := chainState[token.ContractAddress]
+		if !ok {
+			return nil, errors.New("not deployed")
+		}
+		f.contract = common.HexToAddress(token.ContractAddress)
+		return f, nil
+	}
+}
+
+func TestBuildRegistry(t *testing.T) {
+	const (
+		usdc = "0x30e78E4B291f69f540fd52b000e761F7378BEb86"
+		busd = "0x430EE2c2C8F97B17D8b6769156d156333062096E"
+		dai  = "0xfECE6a24ea30226a75139085A88bad1740B4fF6C"
+		link = "0x2CaBf400FD6dD1897E3141535BAB50f9e575bDF1"
+	)
+	state := map[string]*fakeToken{
+		usdc: {hasCode: true, symbol: "USDC", decimals: 6, balance: big.NewInt(100)},
+		busd: {hasCode: false},
+		dai:  {hasCode: true, symbol: "DAI", decimals: 18, balance: big.NewInt(0)},
+		link: {hasCode: true, symbol: "LINK", decimals: 18, balance: big.NewInt(1)},
+	}
+	configs := []Erc20Token{
+		{ContractAddress: usdc, Symbol: "usdc", Decimal: 6},
+		{ContractAddress: busd, Symbol: "busd", Decimal: 18},
+		{ContractAddress: dai, Symbol: "dai", Decimal: 18},
+		{ContractAddress: link, Symbol: "link", Decimal: 8},
+	}
+	minutes := 30
+	configs[0].Payout = "2.5"
+	configs[0].Minutes = &minutes
+	configs[0].DailyCap = "100"
+
+	registry, err := BuildRegistry(context.Background(), testNative, configs, testDefaults, fakeDialer(state), nil)
+	if err != nil {
+		t.Fatalf("BuildRegistry() error = %v", err)
+	}
+
+	symbols := registry.Symbols()
+	if len(symbols) != 2 || symbols[0] != "xt" || symbols[1] != "usdc" {
+		t.Errorf("Symbols() = %v, want [xt usdc]", symbols)
+	}
+	var disabled []string
+	for _, asset := range registry.Disabled() {
+		disabled = append(disabled, asset.Symbol)
+	}
+	if len(disabled) != 3 || disabled[0] != "busd" || disabled[1] != "dai" || disabled[2] != "link" {
+		t.Errorf("Disabled() = %v, want [busd dai link]", disabled)
+	}
+	if _, err := registry.Resolve("dai"); err == nil {
+		t.Error("a disabled token can be claimed")
+	}
+
+	usdcAsset, _ := registry.Resolve("usdc")
+	if usdcAsset.Payout.Cmp(big.NewInt(2500000)) != 0 || usdcAsset.Cooldown != 30*time.Minute || usdcAsset.DailyCap.Cmp(big.NewInt(100000000)) != 0 {
+		t.Errorf("usdc policy = %v %v %v", usdcAsset.Payout, usdcAsset.Cooldown, usdcAsset.DailyCap)
+	}
+	if native := registry.Native(); native.Payout.Cmp(big.NewInt(50000000000000000)) != 0 || native.Cooldown != time.Hour {
+		t.Errorf("native policy = %v %v", native.Payout, native.Cooldown)
+	}
+}
+
+func TestBuildRegistryRejectsInvalidPolicy(t *testing.T) {
+	const usdc = "0x30e78E4B291f69f540fd52b000e761F7378BEb86"
+	tests := []struct {
+		name string
+		cfg  Erc20Token
+	}{
+		{name: "too precise payout", cfg: Erc20Token{ContractAddress: usdc, Symbol: "usdc", Payout: "0.0000001"}},
+		{name: "zero payout", cfg: Erc20Token{ContractAddress: usdc, Symbol: "usdc", Payout: "0"}},
+		{name: "cap below payout", cfg: Erc20Token{ContractAddress: usdc, Symbol: "usdc", Payout: "2", DailyCap: "1"}},
+		{name: "payout above max", cfg: Erc20Token{ContractAddress: usdc, Symbol: "usdc", Payout: "2", MaxAmount: "1"}},
+		{name: "quota below max", cfg: Erc20Token{ContractAddress: usdc, Symbol: "usdc", MaxAmount: "5", Quota: "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := map[string]*fakeToken{usdc: {hasCode: true, symbol: "USDC", decimals: 6, balance: big.NewInt(1)}}
+			if _, err := BuildRegistry(context.Background(), testNative, []Erc20Token{tt.cfg}, testDefaults, fakeDialer(state), nil); err == nil {
+				t.Error("BuildRegistry() accepted a token with an invalid policy")
+			}
+		})
+	}
+}
+
+func TestBuildRegistryKeepsUnreachableTokens(t *testing.T) {
+	const (
+		usdc = "0x30e78E4B291f69f540fd52b000e761F7378BEb86"
+		dai  = "0xfECE6a24ea30226a75139085A88bad1740B4fF6C"
+	)
+	state := map[string]*fakeToken{
+		usdc: {hasCode: true, symbol: "USDC", decimals: 6, balance: big.NewInt(1)},
+		dai:  {hasCode: true, symbol: "DAI", decimals: 18, balance: big.NewInt(1)},
+	}
+	configs := []Erc20Token{{ContractAddress: usdc, Symbol: "usdc"}}
+	running, err := BuildRegistry(context.Background(), testNative, configs, testDefaults, fakeDialer(state), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The running usdc is kept with its new payout, while dai was never validated.
+	state[usdc].down, state[dai].down = true, true
+	configs = []Erc20Token{{ContractAddress: usdc, Symbol: "usdc", Payout: "3"}, {ContractAddress: dai, Symbol: "dai"}}
+	registry, err := BuildRegistry(context.Background(), testNative, configs, testDefaults, fakeDialer(state), running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asset, err := registry.Resolve("usdc"); err != nil || asset.Decimals != 6 || asset.Payout.Cmp(big.NewInt(3000000)) != 0 {
+		t.Errorf("Resolve(usdc) = %+v, %v, want the running token paying out 3", asset, err)
+	}
+	if _, err := registry.Resolve("dai"); err == nil {
+		t.Error("a token that was never validated can be claimed")
+	}
+
+	// Without a running registry, as at startup, the token is disabled.
+	registry, err = BuildRegistry(context.Background(), testNative, configs, testDefaults, fakeDialer(state), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Resolve("usdc"); err == nil {
+		t.Error("an unvalidated token can be claimed at startup")
+	}
+}
+
+func TestBuildRegistryRejectsNativePayout(t *testing.T) {
+	native := testNative
+	native.Payout = "0.0000000000000000001"
+	if _, err := BuildRegistry(context.Background(), native, nil, testDefaults, fakeDialer(nil), nil); err == nil {
+		t.Error("BuildRegistry() error = nil, want precision error")
+	}
+}
+
+func TestAmountUnmarshalJSON(t *testing.T) {
+	var cfg RuntimeConfig
+	if err := json.Unmarshal([]byte(`{"amount": 0.05, "native_amount": "1.5"}`), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if cfg.Payout != "0.05" || cfg.NativePayout != "1.5" {
+		t.Errorf("Unmarshal() got = %+v", cfg)
+	}
+	if err := json.Unmarshal([]byte(`{"amount": true}`), &cfg); err == nil {
+		t.Error("Unmarshal() error = nil, want error")
+	}
+}
+
+func TestBuildRegistryRejectsCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []Erc20Token
+	}{
+		{
+			name:    "native symbol",
+			configs: []Erc20Token{{ContractAddress: "0x30e78E4B291f69f540fd52b000e761F7378BEb86", Symbol: "XT"}},
+		},
+		{
+			name: "duplicate symbol",
+			configs: []Erc20Token{
+				{ContractAddress: "0x30e78E4B291f69f540fd52b000e761F7378BEb86", Symbol: "usdc"},
+				{ContractAddress: "0x430EE2c2C8F97B17D8b6769156d156333062096E", Symbol: "USDC"},
+			},
+		},
+		{
+			name:    "invalid address",
+			configs: []Erc20Token{{ContractAddress: "0x30e7", Symbol: "usdc"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := BuildRegistry(context.Background(), testNative, tt.configs, testDefaults, fakeDialer(nil), nil); err == nil {
+				t.Error("BuildRegistry() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestRegistryResolve(t *testing.T) {
+	registry := newTestRegistry(newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86"))
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: "xt"},
+		{name: "null", input: "null", want: "xt"},
+		{name: "native", input: "XT", want: "xt"},
+		{name: "symbol", input: "USDC", want: "usdc"},
+		{name: "contract", input: "0x30e78e4b291f69f540fd52b000e761f7378beb86", want: "usdc"},
+		{name: "unknown", input: "doge", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := registry.Resolve(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.Symbol != tt.want {
+				t.Errorf("Resolve() got = %v, want %v", got.Symbol, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTokenConfig(t *testing.T) {
+	want := []Erc20Token{{
+		ContractAddress: "0x30e78E4B291f69f540fd52b000e761F7378BEb86",
+		Decimal:         6,
+		Symbol:          "USDC",
+		Name:            "USD Coin",
+		LogoURI:         "https://example.org/usdc.png",
+	}}
+
+	got, err := LoadTokenConfig("testdata/tokenlist.json", 530)
+	if err != nil {
+		t.Fatalf("LoadTokenConfig() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadTokenConfig() got = %+v, want %+v", got, want)
+	}
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+	got, err = LoadTokenConfig(ts.URL+"/tokenlist.json", 530)
+	if err != nil {
+		t.Fatalf("LoadTokenConfig() from URL error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadTokenConfig() from URL got = %+v, want %+v", got, want)
+	}
+
+	legacy, err := LoadTokenConfig("../../tokens.json", 530)
+	if err != nil {
+		t.Fatalf("LoadTokenConfig() legacy error = %v", err)
+	}
+	if len(legacy) == 0 || legacy[0].Symbol != "usdc" {
+		t.Errorf("LoadTokenConfig() legacy got = %+v", legacy)
+	}
+}
+
+func TestAssetClaimAmount(t *testing.T) {
+	asset := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	if err := applyBounds(asset, "0.5", "10", "20"); err != nil {
+		t.Fatalf("applyBounds() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{name: "default", input: "", want: 1000000},
+		{name: "min", input: "0.5", want: 500000},
+		{name: "max", input: "10", want: 10000000},
+		{name: "below min", input: "0.4", wantErr: true},
+		{name: "above max", input: "10.000001", wantErr: true},
+		{name: "too precise", input: "1.0000001", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := asset.ClaimAmount(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ClaimAmount() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.Int64() != tt.want {
+				t.Errorf("ClaimAmount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
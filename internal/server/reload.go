@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chainflag/eth-faucet/internal/chain"
+)
+
+// Settings holds the parts of the faucet configuration that can be swapped at runtime.
+type Settings struct {
+	Registry *Registry
+
+	// DailyClaims caps the number of claims of any asset the faucet accepts in a rolling
+	// 24 hour window. Zero means no cap.
+	DailyClaims int
+
+	// Paused stops the faucet from accepting claims and paying out its queue.
+	Paused bool
+}
+
+// SettingsLoader builds a fresh set of settings from the configuration sources. State read
+// along with them, such as the access lists, is only swapped in by commit, which is called
+// once the settings are accepted. commit may be nil.
+type SettingsLoader func() (settings *Settings, commit func(), err error)
+
+// Reload loads new settings and swaps them in atomically, with the changes operators made
+// through the admin API applied on top. If loading fails, or the changes no longer fit the
+// loaded settings, the running settings are kept and nothing is committed. Claims already
+// accepted keep the asset and amount they were accepted with.
+func (s *Server) Reload(load SettingsLoader) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	loaded, commit, err := load()
+	var next *Settings
+	if err == nil {
+		next, err = s.operator.apply(loaded)
+	}
+	if err != nil {
+		log.WithError(err).Error("Rejected config reload, keeping the running config")
+		return err
+	}
+
+	prev := s.current()
+	for _, change := range diffSettings(prev, next) {
+		log.WithField("change", change).Info("Config reloaded")
+	}
+	if commit != nil {
+		commit()
+	}
+	s.loaded = loaded
+	s.settings.Store(next)
+	return nil
+}
+
+// WatchConfig reloads the settings whenever one of the files changes or a value arrives on
+// the trigger channel, typically SIGHUP. It polls the files at the given interval and blocks.
+func (s *Server) WatchConfig(paths []string, poll time.Duration, trigger <-chan os.Signal, load SettingsLoader) {
+	stamps := statFiles(paths)
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case sig := <-trigger:
+			log.Infof("Received %s, reloading config", sig)
+			stamps = statFiles(paths)
+		case <-ticker.C:
+			next := statFiles(paths)
+			changed := false
+			for path, stamp := range next {
+				if stamps[path] != stamp {
+					log.Infof("Config file %s changed, reloading config", path)
+					changed = true
+				}
+			}
+			stamps = next
+			if !changed {
+				continue
+			}
+		}
+		s.Reload(load)
+	}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		} else {
+			stamps[path] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+func diffSettings(prev, next *Settings) []string {
+	var changes []string
+	if prev.Paused != next.Paused {
+		changes = append(changes, fmt.Sprintf("paused %t -> %t", prev.Paused, next.Paused))
+	}
+	if prev.DailyClaims != next.DailyClaims {
+		changes = append(changes, fmt.Sprintf("daily claims %d -> %d", prev.DailyClaims, next.DailyClaims))
+	}
+	prevNative, nextNative := prev.Registry.Native(), next.Registry.Native()
+	if change := diffAsset(prevNative, nextNative); change != "" {
+		changes = append(changes, "changed native "+change)
+	}
+
+	var tokenChanges []string
+	for symbol, token := range next.Registry.tokens {
+		old, ok := prev.Registry.tokens[symbol]
+		if !ok {
+			tokenChanges = append(tokenChanges, fmt.Sprintf("added token %s at %s", symbol, token.Contract.Hex()))
+		} else if change := diffAsset(old, token); change != "" {
+			tokenChanges = append(tokenChanges, fmt.Sprintf("changed token %s %s", symbol, change))
+		}
+	}
+	for symbol, token := range prev.Registry.tokens {
+		if _, ok := next.Registry.tokens[symbol]; !ok {
+			tokenChanges = append(tokenChanges, fmt.Sprintf("removed token %s at %s", symbol, token.Contract.Hex()))
+		}
+	}
+	sort.Strings(tokenChanges)
+	return append(changes, tokenChanges...)
+}
+
+// diffAsset describes how an asset's contract and payout policy changed, or returns "".
+func diffAsset(prev, next *Asset) string {
+	var fields []string
+	if prev.Symbol != next.Symbol {
+		fields = append(fields, fmt.Sprintf("symbol %s -> %s", prev.Symbol, next.Symbol))
+	}
+	if !prev.IsNative() && *prev.Contract != *next.Contract {
+		fields = append(fields, fmt.Sprintf("contract %s -> %s", prev.Contract.Hex(), next.Contract.Hex()))
+	}
+	if prev.Decimals != next.Decimals {
+		fields = append(fields, fmt.Sprintf("decimals %d -> %d", prev.Decimals, next.Decimals))
+	}
+	if prev.Payout.Cmp(next.Payout) != 0 {
+		fields = append(fields, fmt.Sprintf("payout %s -> %s",
+			chain.FormatUnits(prev.Payout, prev.Decimals), chain.FormatUnits(next.Payout, next.Decimals)))
+	}
+	if prev.Cooldown != next.Cooldown {
+		fields = append(fields, fmt.Sprintf("cooldown %s -> %s", prev.Cooldown, next.Cooldown))
+	}
+	if prev.Paused != next.Paused {
+		fields = append(fields, fmt.Sprintf("paused %t -> %t", prev.Paused, next.Paused))
+	}
+	for _, bound := range []struct {
+		name       string
+		prev, next *big.Int
+	}{
+		{"min amount", prev.MinAmount, next.MinAmount},
+		{"max amount", prev.MaxAmount, next.MaxAmount},
+		{"quota", prev.Quota, next.Quota},
+	} {
+		if bound.prev.Cmp(bound.next) != 0 {
+			fields = append(fields, fmt.Sprintf("%s %s -> %s", bound.name,
+				chain.FormatUnits(bound.prev, prev.Decimals), chain.FormatUnits(bound.next, next.Decimals)))
+		}
+	}
+	for _, limit := range []struct {
+		name       string
+		prev, next *big.Int
+	}{
+		{"daily cap", prev.DailyCap, next.DailyCap},
+		{"ip quota", prev.IPQuota, next.IPQuota},
+		{"subnet quota", prev.SubnetQuota, next.SubnetQuota},
+	} {
+		prevLimit, nextLimit := formatLimit(limit.prev, prev.Decimals), formatLimit(limit.next, next.Decimals)
+		if prevLimit != nextLimit {
+			fields = append(fields, fmt.Sprintf("%s %s -> %s", limit.name, prevLimit, nextLimit))
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+func formatLimit(limit *big.Int, decimals int) string {
+	if limit == nil {
+		return "none"
+	}
+	return chain.FormatUnits(limit, decimals)
+}
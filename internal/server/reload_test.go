@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	usdc := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	dai := newTestAsset("dai", "0xfECE6a24ea30226a75139085A88bad1740B4fF6C")
+	initial := &Settings{Registry: newTestRegistry(usdc)}
+	s := NewServer(nil, initial, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+
+	queued, err := s.newClaim("0xAb5801a7D398351b8bE11C439e05C5B3259aeC9B", "usdc", "")
+	if err != nil {
+		t.Fatalf("newClaim() error = %v", err)
+	}
+
+	if err := s.Reload(func() (*Settings, func(), error) { return nil, nil, errors.New("broken file") }); err == nil {
+		t.Fatal("Reload() error = nil, want error")
+	}
+	if s.current() != initial {
+		t.Fatal("failed reload replaced the running settings")
+	}
+
+	changedUSDC := newTestAsset("usdc", "0x30e78E4B291f69f540fd52b000e761F7378BEb86")
+	changedUSDC.Cooldown = 0
+	next := &Settings{Registry: newTestRegistry(changedUSDC, dai)}
+	if err := s.Reload(func() (*Settings, func(), error) { return next, nil, nil }); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if s.current() != next {
+		t.Fatal("reload did not swap the settings")
+	}
+	if asset, _ := s.resolve("usdc"); asset != changedUSDC {
+		t.Error("reloaded token is not resolved")
+	}
+	if queued.asset != usdc {
+		t.Error("queued claim lost its asset after reload")
+	}
+
+	want := []string{
+		"added token dai at 0xfECE6a24ea30226a75139085A88bad1740B4fF6C",
+		"changed token usdc cooldown 1h0m0s -> 0s",
+	}
+	if got := diffSettings(initial, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSettings() = %v, want %v", got, want)
+	}
+}
+
+func TestReloadCommit(t *testing.T) {
+	s := NewServer(nil, &Settings{Registry: newTestRegistry()}, NewConfig("testnet", "", 8080, 10, ClientIPConfig{}, nil, nil, nil, nil, BatchConfig{}, AdminConfig{}))
+	s.operator = operatorState{assets: map[string]assetOverride{"xt": {Payout: "0"}}}
+
+	committed := false
+	load := func() (*Settings, func(), error) {
+		return &Settings{Registry: newTestRegistry()}, func() { committed = true }, nil
+	}
+	if err := s.Reload(load); err == nil || committed {
+		t.Fatalf("rejected reload: error = %v, committed = %v, want an error and no commit", err, committed)
+	}
+	s.operator = operatorState{}
+	if err := s.Reload(load); err != nil || !committed {
+		t.Errorf("accepted reload: error = %v, committed = %v, want a commit", err, committed)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/LK4D4/trylock"
@@ -20,88 +23,242 @@ import (
 const (
 	AddressKey = "address"
 	SymbolKey  = "symbol"
+	AmountKey  = "amount"
 )
 
 type Server struct {
-	tx     chain.TxBuilder
-	tokens map[string]*chain.TxTokenBuild
-	mutex  trylock.Mutex
-	cfg    *Config
-	queue  chan string
+	tx       chain.TxBuilder
+	settings atomic.Value
+	limiter  *Limiter
+	mutex    trylock.Mutex
+	reloadMu sync.Mutex
+	loaded   *Settings
+	operator operatorState
+	cfg      *Config
+	queue    chan claim
+	jobs     chan *batchJob
+	batches  batchJobs
+	feed     claimFeed
+	receipts chain.ReceiptReader
+	pending  pendingTxs
+	balances *balanceCache
+	replays  idempotencyKeys
 }
 
-func NewServer(builder chain.TxBuilder, tokens map[string]*chain.TxTokenBuild, cfg *Config) *Server {
-	return &Server{
-		tx:     builder,
-		cfg:    cfg,
-		tokens: tokens,
-		queue:  make(chan string, cfg.queueCap),
+// claim is a funding request waiting in the queue. The asset and amount are resolved when the
+// claim is accepted, so a config reload does not change claims that are already in flight.
+type claim struct {
+	id      string
+	address string
+	asset   *Asset
+	amount  *big.Int
+}
+
+func NewServer(builder chain.TxBuilder, settings *Settings, cfg *Config) *Server {
+	s := &Server{
+		tx:    builder,
+		cfg:   cfg,
+		queue: make(chan claim, cfg.queueCap),
+		jobs:  make(chan *batchJob, cfg.queueCap),
+	}
+	s.loaded = settings
+	s.settings.Store(settings)
+	s.balances = newBalanceCache(s.readBalance)
+	if receipts, ok := builder.(chain.ReceiptReader); ok {
+		s.receipts = receipts
+	}
+	s.limiter = NewLimiter(cfg.store, cfg.access, cfg.clientIP, s.current)
+	s.replays = idempotencyKeys{store: s.limiter.store}
+	for _, guard := range cfg.guards {
+		if guard, ok := guard.(queueAware); ok {
+			guard.watchQueue(func() int { return len(s.queue) })
+		}
 	}
+	return s
+}
+
+func (s *Server) current() *Settings {
+	return s.settings.Load().(*Settings)
+}
+
+func (s *Server) resolve(input string) (*Asset, error) {
+	return s.current().Registry.Resolve(input)
 }
 
 func (s *Server) setupRouter() *http.ServeMux {
 	router := http.NewServeMux()
 	router.Handle("/", http.FileServer(web.Dist()))
-	limiter := NewLimiter(s.cfg.proxyCount, time.Duration(s.cfg.interval)*time.Minute)
-	router.Handle("/api/claim", negroni.New(limiter, negroni.Wrap(s.handleClaim())))
+	v1Claim := negroni.New(negroni.HandlerFunc(formClaim))
+	v1Claim.UseHandler(s.claimChain())
+	router.Handle("/api/claim", v1Claim)
 	router.Handle("/api/info", s.handleInfo())
+	router.Handle("/api/cooldown", s.handleCooldown())
+	v2Claim := negroni.New(negroni.HandlerFunc(jsonClaim))
+	v2Claim.UseHandler(s.claimChain())
+	router.Handle("/api/v2/claim", v2Claim)
+	router.Handle("/api/v2/claims/", s.handleClaimStatus())
+	router.Handle("/api/v2/info", s.handleInfo())
+	router.Handle("/api/v2/cooldown", s.handleCooldown())
+	router.HandleFunc("/api/openapi.json", handleOpenAPI)
+	if s.cfg.keys != nil && s.cfg.batch.MaxItems > 0 {
+		batch := negroni.New(negroni.HandlerFunc(jsonAPI), apiKeyAuth{keys: s.cfg.keys})
+		batch.UseHandler(s.handleBatch())
+		router.Handle("/api/batch", batch)
+		router.Handle("/api/batch/", batch)
+	}
+	for _, guard := range s.cfg.guards {
+		if guard, ok := guard.(guardRoutes); ok {
+			guard.routes(router)
+		}
+	}
+	if s.cfg.admin.enabled() && s.cfg.admin.Port == 0 {
+		s.adminRoutes(router)
+	}
 
 	return router
 }
 
-func (s *Server) Run() {
-	go func() {
-		ticker := time.NewTicker(time.Second)
-		for range ticker.C {
-			s.consumeQueue()
-		}
-	}()
+// claimChain runs a claim past the API key check, the idempotency key, the anti-bot guards and
+// the rate limits before it is handled.
+func (s *Server) claimChain() *negroni.Negroni {
+	n := negroni.New(apiKeyAuth{keys: s.cfg.keys}, negroni.HandlerFunc(s.idempotent))
+	for _, guard := range s.cfg.guards {
+		n.Use(skipForAPIKey(guard))
+	}
+	n.Use(s.limiter)
+	n.UseHandler(s.handleClaim())
+	return n
+}
 
+// Handler returns the HTTP handler of the API and the frontend.
+func (s *Server) Handler() http.Handler {
 	n := negroni.New(negroni.NewRecovery(), negroni.NewLogger())
 	n.UseHandler(s.setupRouter())
+	return n
+}
+
+// ProcessQueue pays out the queued claims, and watches the receipts of sent transactions if
+// the transaction builder can look them up, every interval until the context is done.
+func (s *Server) ProcessQueue(ctx context.Context, interval time.Duration) {
+	go s.watchReceipts(ctx, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.consumeQueue()
+		}
+	}
+}
+
+func (s *Server) Run() {
+	go s.ProcessQueue(context.Background(), time.Second)
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(s.cfg.httpPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.cfg.clientIP.ProxyProtocol {
+		if len(s.cfg.clientIP.TrustedProxies) == 0 {
+			log.Fatal("PROXY protocol requires trusted proxies, or any peer could forge its address")
+		}
+		listener = newProxyListener(listener, s.cfg.clientIP.trusted)
+	}
 	log.Infof("Starting http server %d", s.cfg.httpPort)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(s.cfg.httpPort), n))
+	log.Fatal(http.Serve(listener, s.Handler()))
 }
 
 func (s *Server) consumeQueue() {
-	if len(s.queue) == 0 {
+	if len(s.queue) == 0 && len(s.jobs) == 0 || s.current().Paused {
 		return
 	}
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	for len(s.queue) != 0 {
-		q := <-s.queue
-		var txHash common.Hash
-		var txErr error
-
-		lists := strings.Split(q, ":")
-		address := lists[0]
-		var symbol string
-		if len(lists) > 1 {
-			symbol = lists[1]
-		}
-
-		log.Infof("address %s symbol %s", address, symbol)
-		if symbol == "" || symbol == "xt" {
-			txHash, txErr = s.tx.Transfer(context.Background(), address, chain.EtherToWei(int64(s.cfg.payout)))
-		} else {
-			log.Infof("tx address %s symbol %s", address, symbol)
-			token := s.tokens[strings.ToLower(symbol)]
-			log.Infof("token %#v symbol %s", token, symbol)
-			txHash, txErr = token.Transfer(context.Background(), address, chain.EtherTokenAmount(int64(s.cfg.payout)))
-		}
-
+		c := <-s.queue
+		s.feed.dequeue(c.id)
+		txHash, txErr := s.transfer(context.Background(), c)
+		s.settle(c, txHash, txErr)
 		if txErr != nil {
 			log.WithError(txErr).Error("Failed to handle transaction in the queue")
 		} else {
 			log.WithFields(log.Fields{
 				"txHash":  txHash,
-				"address": address,
-				"symbol":  symbol,
+				"address": c.address,
+				"symbol":  c.asset.Symbol,
+				"amount":  chain.FormatUnits(c.amount, c.asset.Decimals),
 			}).Info("Consume from queue successfully")
 		}
 	}
+	for len(s.jobs) != 0 {
+		job := <-s.jobs
+		s.payBatch(context.Background(), job)
+		log.WithField("batch", job.id).Info("Consume batch from queue successfully")
+	}
+}
+
+// newClaim resolves the submitted asset against the current settings and fixes the amount,
+// which defaults to the asset's payout.
+func (s *Server) newClaim(address, symbol, amount string) (claim, error) {
+	asset, err := s.resolve(symbol)
+	if err != nil {
+		return claim{}, err
+	}
+	value, err := asset.ClaimAmount(amount)
+	if err != nil {
+		return claim{}, err
+	}
+	return claim{address: address, asset: asset, amount: value}, nil
+}
+
+// record adds an accepted claim by the client to the ledger and returns it with its ledger ID.
+// The API key and login identity of the claim are taken from the context.
+func (s *Server) record(ctx context.Context, c claim, clientIP, batch string) claim {
+	entry := ClaimRecord{
+		Address:  c.address,
+		Symbol:   c.asset.Symbol,
+		Amount:   chain.FormatUnits(c.amount, c.asset.Decimals),
+		Status:   ClaimQueued,
+		ClientIP: clientIP,
+		Identity: identityFrom(ctx),
+		Batch:    batch,
+	}
+	if key := apiKeyFrom(ctx); key != nil {
+		entry.APIKey = key.ID
+	}
+	c.id = s.cfg.ledger.Add(entry).ID
+	return c
+}
+
+// settle records the outcome of a claim's transfer in the ledger and publishes it to the
+// followers of the claim. The receipt of a sent transaction is watched from then on.
+func (s *Server) settle(c claim, txHash common.Hash, err error) {
+	s.cfg.ledger.Update(c.id, func(entry *ClaimRecord) {
+		if err != nil {
+			entry.Status, entry.Error = ClaimFailed, err.Error()
+			return
+		}
+		entry.Status, entry.TxHash = ClaimSent, txHash.Hex()
+	})
+	if err != nil {
+		s.feed.publish(claimEvent{Type: EventFailed, ClaimID: c.id, Error: err.Error()})
+		return
+	}
+	s.feed.publish(claimEvent{Type: EventBroadcast, ClaimID: c.id, TxHash: txHash.Hex()})
+	if s.receipts != nil {
+		s.pending.add(txHash, c.id, time.Now())
+	}
+}
+
+// transfer pays out the claimed amount of the claimed asset to the claim address.
+func (s *Server) transfer(ctx context.Context, c claim) (common.Hash, error) {
+	if c.asset.IsNative() {
+		return s.tx.Transfer(ctx, c.address, c.amount)
+	}
+	return c.asset.builder.Transfer(ctx, c.address, c.amount)
 }
 
 func (s *Server) handleClaim() http.HandlerFunc {
@@ -112,78 +269,79 @@ func (s *Server) handleClaim() http.HandlerFunc {
 		}
 
 		address := r.PostFormValue(AddressKey)
-		inputSymbol := r.PostFormValue(SymbolKey)
+		c, err := s.newClaim(address, r.PostFormValue(SymbolKey), r.PostFormValue(AmountKey))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, claimErrorCode(err), err.Error())
+			return
+		}
+		c = s.record(r.Context(), c, s.cfg.clientIP.ClientIP(r), "")
+		w.Header().Set("X-Claim-Id", c.id)
 
-		symbol := strings.ToLower(inputSymbol)
-		if symbol == "" || symbol == "null" {
-			symbol = "xt"
+		queued, txHash, rejected := s.pay(r.Context(), c)
+		switch {
+		case rejected != nil:
+			writeClaimError(w, r, rejected)
+		case queued:
+			s.writeClaim(w, r, c, fmt.Sprintf("Added %s to the queue", address))
+		default:
+			s.writeClaim(w, r, c, fmt.Sprintf("Txhash: %s", txHash))
 		}
+	}
+}
 
-		log.Infof("address %s symbol %s", address, symbol)
-		// Try to lock mutex if the work queue is empty
-		if len(s.queue) != 0 || !s.mutex.TryLock() {
+// pay sends a recorded claim right away if the faucet is idle, or adds it to the queue, and
+// reports whether it was queued. Claims wait in the queue while the faucet is paused.
+func (s *Server) pay(ctx context.Context, c claim) (bool, common.Hash, *claimError) {
+	// Try to lock mutex if the work queue is empty
+	if len(s.queue) != 0 || s.current().Paused || !s.mutex.TryLock() {
+		queued := s.feed.enqueue(c.id, func() bool {
 			select {
-			case s.queue <- address + ":" + symbol:
-				log.WithFields(log.Fields{
-					"address": address,
-					"symbol":  symbol,
-				}).Info("Added to queue successfully")
-				fmt.Fprintf(w, "Added %s to the queue", address)
+			case s.queue <- c:
+				return true
 			default:
-				log.Warn("Max queue capacity reached")
-				errMsg := "Faucet queue is too long, please try again later"
-				http.Error(w, errMsg, http.StatusServiceUnavailable)
+				return false
 			}
-			return
-		}
-
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-		defer cancel()
-
-		var txHash common.Hash
-		var txErr error
-		if symbol == "" || symbol == "xt" {
-			txHash, txErr = s.tx.Transfer(ctx, address, chain.EtherToWei(int64(s.cfg.payout)))
-		} else {
-			log.Infof("tx address %s symbol %s", address, symbol)
-			token := s.tokens[strings.ToLower(symbol)]
-			log.Infof("token %#v symbol %s", token, symbol)
-			txHash, txErr = token.Transfer(ctx, address, chain.EtherTokenAmount(int64(s.cfg.payout)))
-		}
-
-		s.mutex.Unlock()
-		if txErr != nil {
-			log.WithError(txErr).Error("Failed to send transaction")
-			http.Error(w, txErr.Error(), http.StatusInternalServerError)
-			return
+		})
+		if !queued {
+			log.Warn("Max queue capacity reached")
+			s.settle(c, common.Hash{}, fmt.Errorf("queue is full"))
+			errMsg := "Faucet queue is too long, please try again later"
+			return false, common.Hash{}, &claimError{status: http.StatusServiceUnavailable, code: CodeQueueFull, message: errMsg}
 		}
-
 		log.WithFields(log.Fields{
-			"txHash":  txHash,
-			"address": address,
-			"symbol":  symbol,
-		}).Info("Funded directly successfully")
-		fmt.Fprintf(w, "Txhash: %s", txHash)
+			"address": c.address,
+			"symbol":  c.asset.Symbol,
+		}).Info("Added to queue successfully")
+		return true, common.Hash{}, nil
 	}
-}
 
-func (s *Server) handleInfo() http.HandlerFunc {
-	type info struct {
-		Account string `json:"account"`
-		Network string `json:"network"`
-		Payout  string `json:"payout"`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	txHash, txErr := s.transfer(ctx, c)
+	s.mutex.Unlock()
+	s.settle(c, txHash, txErr)
+	if txErr != nil {
+		log.WithError(txErr).Error("Failed to send transaction")
+		return false, txHash, &claimError{status: http.StatusInternalServerError, code: transferErrorCode(txErr), message: txErr.Error()}
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			http.NotFound(w, r)
-			return
-		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(info{
-			Account: s.tx.Sender().String(),
-			Network: s.cfg.network,
-			Payout:  strconv.Itoa(s.cfg.payout),
-		})
+	log.WithFields(log.Fields{
+		"txHash":  txHash,
+		"address": c.address,
+		"symbol":  c.asset.Symbol,
+		"amount":  chain.FormatUnits(c.amount, c.asset.Decimals),
+	}).Info("Funded directly successfully")
+	return false, txHash, nil
+}
+
+// writeClaim replies to an accepted claim with its ledger entry to a JSON API request, and
+// with the text to a form request.
+func (s *Server) writeClaim(w http.ResponseWriter, r *http.Request, c claim, text string) {
+	if !wantsJSON(r) {
+		fmt.Fprint(w, text)
+		return
 	}
+	record, _ := s.cfg.ledger.Get(c.id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.claimResult(record))
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chainflag/eth-faucet/internal/server"
+)
+
+const usage = `Manage the API keys in the file the faucet loads with -apikeys.file.
+
+Usage:
+  apikey -file apikeys.json create -name NAME [-assets xt,usdc] [-dailyclaims N] [-dailyamount usdc=100 ...]
+  apikey -file apikeys.json list
+  apikey -file apikeys.json revoke ID
+`
+
+// amounts collects repeated -dailyamount symbol=amount flags.
+type amounts map[string]server.Amount
+
+func (a amounts) String() string {
+	return fmt.Sprint(map[string]server.Amount(a))
+}
+
+func (a amounts) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected symbol=amount, got %q", value)
+	}
+	a[parts[0]] = server.Amount(parts[1])
+	return nil
+}
+
+func main() {
+	file := flag.String("file", "apikeys.json", "JSON file of issued API keys")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	keys, err := server.NewKeyStore(*file)
+	if err != nil {
+		panic(err)
+	}
+
+	switch flag.Arg(0) {
+	case "create":
+		create := flag.NewFlagSet("create", flag.ExitOnError)
+		name := create.String("name", "", "Name of the client the key is issued to")
+		assets := create.String("assets", "", "Comma separated symbols the key may claim, all if empty")
+		claims := create.Int("dailyclaims", 0, "Claims the key may make per 24 hours, unlimited if 0")
+		daily := amounts{}
+		create.Var(daily, "dailyamount", "Amount of an asset the key may claim per 24 hours as symbol=amount, repeatable")
+		create.Parse(flag.Args()[1:])
+
+		spec := server.APIKey{Name: *name, DailyClaims: *claims, DailyAmounts: daily}
+		if *assets != "" {
+			spec.Assets = strings.Split(*assets, ",")
+		}
+		// The tool doesn't know the decimals of the assets, so the faucet checks the daily
+		// amounts when it loads the file.
+		plaintext, key, err := keys.Create(spec, nil)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Created API key %s for %s, it won't be shown again:\n%s\n", key.ID, key.Name, plaintext)
+	case "list":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(keys.List())
+	case "revoke":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := keys.Revoke(flag.Arg(1)); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Revoked API key %s\n", flag.Arg(1))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}